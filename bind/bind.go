@@ -0,0 +1,295 @@
+package bind
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddddami/bindle/jsonx"
+)
+
+var (
+	ErrInvalidTarget   = errors.New("bind target must be a non-nil pointer to a struct")
+	ErrUnsupportedType = errors.New("unsupported field type")
+)
+
+// Sources are checked in this order; the first one holding a value for a field wins.
+var sources = []string{"path", "query", "form", "header"}
+
+type Options struct {
+	// MergeJSON decodes a JSON body on top of the bound values when the request is application/json
+	MergeJSON bool
+	// MaxMemory is passed to ParseMultipartForm for multipart bodies
+	MaxMemory int64
+	// TimeLayout is used for time.Time fields without a `layout` tag
+	TimeLayout string
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MergeJSON:  true,
+		MaxMemory:  32 << 20,
+		TimeLayout: time.RFC3339,
+	}
+}
+
+func mergeOptions(defaults Options, customs ...Options) Options {
+	result := defaults
+
+	if len(customs) == 0 {
+		return result
+	}
+
+	custom := customs[0]
+
+	result.MergeJSON = custom.MergeJSON
+
+	if custom.MaxMemory > 0 {
+		result.MaxMemory = custom.MaxMemory
+	}
+
+	if custom.TimeLayout != "" {
+		result.TimeLayout = custom.TimeLayout
+	}
+
+	return result
+}
+
+// FieldError describes a value that could not be converted into a struct field
+type FieldError struct {
+	Field  string
+	Source string
+	Value  string
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s %q: cannot use %q: %v", e.Source, e.Field, e.Value, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Errors aggregates every FieldError found while binding a request
+type Errors []*FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e Errors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Request fills target from the request's path values, query string, form body and headers
+// using `path:"…"`, `query:"…"`, `form:"…"` and `header:"…"` struct tags. Fields with no value
+// fall back to their `default:"…"` tag. Slices accept repeated keys or a comma-separated value,
+// and time.Time fields honour an optional `layout:"…"` tag.
+//
+// Conversion failures are collected and returned together as Errors. When MergeJSON is set
+// and the request carries a JSON body, it is decoded on top of the bound values.
+func Request(r *http.Request, target any, opts ...Options) error {
+	opt := mergeOptions(DefaultOptions(), opts...)
+
+	rv := reflect.ValueOf(target)
+	if target == nil || rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ErrInvalidTarget
+	}
+
+	contentType := strings.ToLower(r.Header.Get("Content-Type"))
+	if strings.HasPrefix(contentType, "multipart/form-data") {
+		if err := r.ParseMultipartForm(opt.MaxMemory); err != nil {
+			return fmt.Errorf("failed to parse multipart form: %w", err)
+		}
+	} else if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("failed to parse form: %w", err)
+	}
+
+	var errs Errors
+	bindStruct(r, rv.Elem(), opt, &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if opt.MergeJSON && strings.Contains(contentType, "application/json") {
+		if err := jsonx.DecodeJSON(r.Body, target); err != nil && !errors.Is(err, jsonx.ErrNoContent) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func bindStruct(r *http.Request, v reflect.Value, opt Options, errs *Errors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fv := v.Field(i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			bindStruct(r, fv, opt, errs)
+			continue
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		source, name, values := lookup(r, field)
+		if values == nil {
+			def, ok := field.Tag.Lookup("default")
+			if !ok {
+				continue
+			}
+			source, name, values = "default", field.Name, []string{def}
+		}
+
+		if err := setField(fv, field, values, opt); err != nil {
+			*errs = append(*errs, &FieldError{
+				Field:  name,
+				Source: source,
+				Value:  strings.Join(values, ","),
+				Err:    err,
+			})
+		}
+	}
+}
+
+func lookup(r *http.Request, field reflect.StructField) (source, name string, values []string) {
+	for _, src := range sources {
+		tag, ok := field.Tag.Lookup(src)
+		if !ok || tag == "" || tag == "-" {
+			continue
+		}
+		name = strings.Split(tag, ",")[0]
+
+		switch src {
+		case "path":
+			if v := r.PathValue(name); v != "" {
+				return src, name, []string{v}
+			}
+		case "query":
+			if v, ok := r.URL.Query()[name]; ok {
+				return src, name, v
+			}
+		case "form":
+			if r.PostForm != nil {
+				if v, ok := r.PostForm[name]; ok {
+					return src, name, v
+				}
+			}
+		case "header":
+			if v := r.Header.Values(name); len(v) > 0 {
+				return src, name, v
+			}
+		}
+	}
+	return "", "", nil
+}
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+func setField(fv reflect.Value, field reflect.StructField, values []string, opt Options) error {
+	if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+		if len(values) == 1 {
+			values = strings.Split(values[0], ",")
+		}
+		slice := reflect.MakeSlice(fv.Type(), len(values), len(values))
+		for i, raw := range values {
+			if err := setValue(slice.Index(i), field, strings.TrimSpace(raw), opt); err != nil {
+				return err
+			}
+		}
+		fv.Set(slice)
+		return nil
+	}
+
+	return setValue(fv, field, values[0], opt)
+}
+
+func setValue(v reflect.Value, field reflect.StructField, raw string, opt Options) error {
+	if v.Kind() == reflect.Ptr {
+		ptr := reflect.New(v.Type().Elem())
+		if err := setValue(ptr.Elem(), field, raw, opt); err != nil {
+			return err
+		}
+		v.Set(ptr)
+		return nil
+	}
+
+	switch v.Type() {
+	case timeType:
+		layout := field.Tag.Get("layout")
+		if layout == "" {
+			layout = opt.TimeLayout
+		}
+		parsed, err := time.Parse(layout, raw)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(parsed))
+		return nil
+	case durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(raw))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(raw, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return ErrUnsupportedType
+	}
+
+	return nil
+}
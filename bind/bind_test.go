@@ -0,0 +1,131 @@
+package bind
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type listFilters struct {
+	OrgID    int           `path:"org"`
+	Page     int           `query:"page" default:"1"`
+	PerPage  *int          `query:"per_page"`
+	Active   bool          `query:"active"`
+	Tags     []string      `query:"tag"`
+	IDs      []int64       `query:"ids"`
+	Since    time.Time     `query:"since" layout:"2006-01-02"`
+	Timeout  time.Duration `query:"timeout" default:"5s"`
+	TraceID  string        `header:"X-Trace-ID"`
+	Nickname string        `form:"nickname"`
+}
+
+func TestRequest(t *testing.T) {
+	mux := http.NewServeMux()
+	var got listFilters
+	var bindErr error
+	mux.HandleFunc("GET /orgs/{org}/users", func(w http.ResponseWriter, r *http.Request) {
+		got = listFilters{}
+		bindErr = Request(r, &got)
+	})
+
+	req := httptest.NewRequest("GET", "/orgs/7/users?per_page=20&active=true&tag=a&tag=b&ids=1,2,3&since=2024-05-01", nil)
+	req.Header.Set("X-Trace-ID", "trace-1")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	if bindErr != nil {
+		t.Fatalf("expected no error, got %v", bindErr)
+	}
+
+	if got.OrgID != 7 || got.Page != 1 || got.PerPage == nil || *got.PerPage != 20 || !got.Active {
+		t.Errorf("scalar fields not bound correctly: %+v", got)
+	}
+
+	if strings.Join(got.Tags, "|") != "a|b" || len(got.IDs) != 3 || got.IDs[2] != 3 {
+		t.Errorf("slice fields not bound correctly: tags=%v ids=%v", got.Tags, got.IDs)
+	}
+
+	if !got.Since.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) || got.Timeout != 5*time.Second {
+		t.Errorf("time fields not bound correctly: since=%v timeout=%v", got.Since, got.Timeout)
+	}
+
+	if got.TraceID != "trace-1" {
+		t.Errorf("TraceID = %q, want trace-1", got.TraceID)
+	}
+}
+
+func TestRequestForm(t *testing.T) {
+	form := url.Values{"nickname": {"dami"}}
+	req := httptest.NewRequest("POST", "/?page=3", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var got listFilters
+	if err := Request(req, &got); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if got.Nickname != "dami" || got.Page != 3 {
+		t.Errorf("form fields not bound correctly: %+v", got)
+	}
+}
+
+func TestRequestAggregatesErrors(t *testing.T) {
+	req := httptest.NewRequest("GET", "/?page=abc&active=maybe&since=yesterday", nil)
+
+	var got listFilters
+	err := Request(req, &got)
+
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected Errors, got %v", err)
+	}
+
+	if len(errs) != 3 {
+		t.Errorf("expected 3 field errors, got %d: %v", len(errs), err)
+	}
+
+	if errs[0].Field != "page" || errs[0].Source != "query" {
+		t.Errorf("unexpected first error: %+v", errs[0])
+	}
+}
+
+func TestRequestMergesJSON(t *testing.T) {
+	type input struct {
+		ID   int    `path:"id" json:"-"`
+		Mode string `query:"mode" json:"mode"`
+		Name string `json:"name"`
+	}
+
+	mux := http.NewServeMux()
+	var got input
+	var bindErr error
+	mux.HandleFunc("POST /items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		bindErr = Request(r, &got)
+	})
+
+	req := httptest.NewRequest("POST", "/items/9?mode=draft", strings.NewReader(`{"name":"widget","mode":"live"}`))
+	req.Header.Set("Content-Type", "application/json")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	if bindErr != nil {
+		t.Fatalf("expected no error, got %v", bindErr)
+	}
+
+	if got.ID != 9 || got.Name != "widget" || got.Mode != "live" {
+		t.Errorf("unexpected result: %+v", got)
+	}
+}
+
+func TestRequestInvalidTarget(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+
+	var notStruct int
+	for _, target := range []any{nil, listFilters{}, &notStruct} {
+		if err := Request(req, target); !errors.Is(err, ErrInvalidTarget) {
+			t.Errorf("Request(%T) error = %v, want ErrInvalidTarget", target, err)
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package fs
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// ErrUnsafePath is returned by SafeJoin for names that would escape the base directory
+var ErrUnsafePath = errors.New("path escapes the base directory")
+
 // CreateDirIfNotExists creates a dir at a specified path if it does not exists
 func CreateDirIfNotExists(path string) error {
 	return CreateDirIfNotExistsWithPerm(path, 0o755)
@@ -88,3 +93,13 @@ func CopyFile(src, dst string) error {
 
 	return nil
 }
+
+// SafeJoin joins a slash-separated name, such as an archive entry, onto base. It fails for
+// names that are absolute or that would climb out of base, like "../../etc/passwd" (zip slip).
+func SafeJoin(base, name string) (string, error) {
+	local := filepath.FromSlash(strings.ReplaceAll(name, "\\", "/"))
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	return filepath.Join(base, local), nil
+}
@@ -1,7 +1,9 @@
 package fs
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -149,3 +151,32 @@ func TestCopyFile(t *testing.T) {
 		t.Fatalf("expected file content to be 'Hello, World!', got %s", data)
 	}
 }
+
+func TestSafeJoin(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "docs/a.txt", want: filepath.Join("base", "docs", "a.txt")},
+		{name: "docs/../a.txt", want: filepath.Join("base", "a.txt")},
+		{name: "../a.txt", wantErr: true},
+		{name: "docs/../../a.txt", wantErr: true},
+		{name: "/etc/passwd", wantErr: true},
+		{name: "..\\..\\a.txt", wantErr: true},
+		{name: "", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := SafeJoin("base", tc.name)
+		if tc.wantErr {
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("SafeJoin(%q) error = %v, want ErrUnsafePath", tc.name, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("SafeJoin(%q) = %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
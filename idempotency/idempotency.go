@@ -0,0 +1,278 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ddddami/bindle/jsonx"
+)
+
+// Header is the request header carrying the client's idempotency key
+const Header = "Idempotency-Key"
+
+// ReplayedHeader is set on responses served from the store
+const ReplayedHeader = "Idempotent-Replayed"
+
+// MaxKeyLength is the longest accepted idempotency key
+const MaxKeyLength = 255
+
+type Options struct {
+	// Store holds keys and captured responses. Defaults to a MemoryStore with a 24 hour TTL.
+	Store Store
+	// Methods the middleware applies to. Defaults to POST and PATCH.
+	Methods []string
+	// MaxBodySize bounds how much of the request body is read for fingerprinting. Larger
+	// requests are passed to the handler without idempotency unless RejectLargeBodies is set.
+	MaxBodySize int64
+	// RejectLargeBodies answers requests with a key and a body over MaxBodySize with 413
+	RejectLargeBodies bool
+	// Scope namespaces keys, e.g. by authenticated user, so clients can't collide
+	Scope func(r *http.Request) string
+	// OnError is called when a response can't be stored or a key can't be released.
+	// Defaults to logging with slog.
+	OnError func(r *http.Request, err error)
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Methods:     []string{http.MethodPost, http.MethodPatch},
+		MaxBodySize: 1 << 20, // 1 MB
+	}
+}
+
+func mergeOptions(defaults Options, customs ...Options) Options {
+	result := defaults
+
+	if len(customs) > 0 {
+		custom := customs[0]
+
+		if custom.Store != nil {
+			result.Store = custom.Store
+		}
+
+		if len(custom.Methods) > 0 {
+			result.Methods = custom.Methods
+		}
+
+		if custom.MaxBodySize > 0 {
+			result.MaxBodySize = custom.MaxBodySize
+		}
+
+		result.RejectLargeBodies = custom.RejectLargeBodies
+
+		if custom.Scope != nil {
+			result.Scope = custom.Scope
+		}
+
+		if custom.OnError != nil {
+			result.OnError = custom.OnError
+		}
+	}
+
+	if result.OnError == nil {
+		result.OnError = func(r *http.Request, err error) {
+			slog.ErrorContext(r.Context(), "idempotency: store failed", "error", err)
+		}
+	}
+
+	if result.Store == nil {
+		result.Store = NewMemoryStore(24 * time.Hour)
+	}
+
+	return result
+}
+
+// Middleware makes retried requests that carry the same Idempotency-Key safe. The first response
+// is captured and stored; repeats get the stored response replayed. A repeat that arrives while
+// the first request is still running gets 409, and reusing a key for a different request body
+// gets 422. Server errors (5xx) are not stored so the client can retry them.
+func Middleware(next http.Handler, opts ...Options) http.Handler {
+	opt := mergeOptions(DefaultOptions(), opts...)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" || !methodAllowed(opt.Methods, r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > MaxKeyLength {
+			respondError(w, "IDEMPOTENCY_KEY_INVALID", "idempotency key is too long", http.StatusBadRequest)
+			return
+		}
+
+		if opt.Scope != nil {
+			key = opt.Scope(r) + ":" + key
+		}
+
+		fingerprint, err := fingerprintRequest(r, opt.MaxBodySize)
+		switch {
+		case errors.Is(err, errBodyTooLarge) && opt.RejectLargeBodies:
+			respondError(w, "REQUEST_BODY_TOO_LARGE", err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		case errors.Is(err, errBodyTooLarge):
+			next.ServeHTTP(w, r)
+			return
+		case err != nil:
+			respondError(w, "REQUEST_BODY_UNREADABLE", err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		record, err := opt.Store.Reserve(r.Context(), key, fingerprint)
+		switch {
+		case errors.Is(err, ErrInFlight):
+			respondError(w, "IDEMPOTENCY_KEY_IN_USE", err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, ErrFingerprintMismatch):
+			respondError(w, "IDEMPOTENCY_KEY_REUSED", err.Error(), http.StatusUnprocessableEntity)
+			return
+		case err != nil:
+			respondError(w, "IDEMPOTENCY_STORE_ERROR", "failed to check idempotency key", http.StatusInternalServerError)
+			return
+		}
+
+		if record != nil {
+			if record.Fingerprint != fingerprint {
+				respondError(w, "IDEMPOTENCY_KEY_REUSED", ErrFingerprintMismatch.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			replay(w, record)
+			return
+		}
+
+		// The outcome is stored even if the client has gone away, since its retry is what
+		// the key is for
+		ctx := context.WithoutCancel(r.Context())
+		capture := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			if err := opt.Store.Release(ctx, key); err != nil {
+				opt.OnError(r, fmt.Errorf("failed to release idempotency key: %w", err))
+			}
+		}()
+
+		next.ServeHTTP(capture, r)
+
+		if capture.status >= http.StatusInternalServerError {
+			return
+		}
+
+		if !capture.wroteHeader {
+			capture.header = w.Header().Clone()
+		}
+
+		err = opt.Store.Save(ctx, key, &Record{
+			Fingerprint: fingerprint,
+			Status:      capture.status,
+			Header:      capture.header,
+			Body:        capture.body.Bytes(),
+			CreatedAt:   time.Now(),
+		})
+		if err != nil {
+			// The deferred Release frees the key so a retry runs the handler again
+			opt.OnError(r, err)
+			return
+		}
+		completed = true
+	})
+}
+
+func methodAllowed(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+var errBodyTooLarge = errors.New("request body is too large to fingerprint")
+
+// fingerprintRequest hashes the method, path, query and body, and restores the body for the
+// handler, including when it's too large to fingerprint
+func fingerprintRequest(r *http.Request, maxBodySize int64) (string, error) {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+"\n"+r.URL.Path+"\n"+r.URL.RawQuery+"\n")
+
+	if r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			return "", err
+		}
+		if int64(len(body)) > maxBodySize {
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			return "", errBodyTooLarge
+		}
+		hash.Write(body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// replay writes a stored response. Headers already set by outer middleware, such as a fresh
+// X-Request-ID, are kept.
+func replay(w http.ResponseWriter, record *Record) {
+	for k, values := range record.Header {
+		if _, ok := w.Header()[k]; ok {
+			continue
+		}
+		w.Header()[k] = append([]string(nil), values...)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
+
+func respondError(w http.ResponseWriter, code, message string, status int) {
+	jsonx.RespondWithError(w, jsonx.ErrorDetail{Code: code, Message: message}, jsonx.Options{
+		ErrorStatus: status,
+	})
+}
+
+// captureWriter records the status, headers and body written by the handler
+type captureWriter struct {
+	http.ResponseWriter
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	c.status = status
+	c.header = c.ResponseWriter.Header().Clone()
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	c.body.Write(p)
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *captureWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
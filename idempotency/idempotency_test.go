@@ -0,0 +1,257 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ddddami/bindle/jsonx"
+)
+
+func newRequest(key, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/orders", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(Header, key)
+	}
+	return req
+}
+
+func TestMiddlewareReplaysResponse(t *testing.T) {
+	var calls atomic.Int32
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		jsonx.RespondWithSuccess(w, map[string]any{"order": n}, nil, jsonx.Options{
+			SuccessStatus: http.StatusCreated,
+			Headers:       map[string]string{"X-Order": "1"},
+		})
+	}))
+
+	first := httptest.NewRecorder()
+	handler.ServeHTTP(first, newRequest("key-1", `{"item":"book"}`))
+
+	second := httptest.NewRecorder()
+	handler.ServeHTTP(second, newRequest("key-1", `{"item":"book"}`))
+
+	if calls.Load() != 1 {
+		t.Fatalf("handler called %d times, want 1", calls.Load())
+	}
+
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %s, want %d %s", second.Code, second.Body.String(), first.Code, first.Body.String())
+	}
+
+	if second.Header().Get(ReplayedHeader) != "true" || second.Header().Get("X-Order") != "1" {
+		t.Errorf("replay headers = %v", second.Header())
+	}
+
+	third := httptest.NewRecorder()
+	handler.ServeHTTP(third, newRequest("", `{"item":"book"}`))
+	if calls.Load() != 2 {
+		t.Errorf("requests without a key should always reach the handler")
+	}
+}
+
+func TestMiddlewareRejectsDifferentBody(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonx.SendSuccess(w, "ok")
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("key-1", `{"item":"book"}`))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newRequest("key-1", `{"item":"pen"}`))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want 422", rr.Code)
+	}
+}
+
+func TestMiddlewareRejectsDifferentQuery(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonx.SendSuccess(w, r.URL.Query().Get("warehouse"))
+	}))
+
+	first := newRequest("key-1", `{"item":"book"}`)
+	first.URL.RawQuery = "warehouse=lagos"
+	handler.ServeHTTP(httptest.NewRecorder(), first)
+
+	second := newRequest("key-1", `{"item":"book"}`)
+	second.URL.RawQuery = "warehouse=abuja"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, second)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want 422", rr.Code)
+	}
+}
+
+func TestMiddlewareLargeBodies(t *testing.T) {
+	var received atomic.Int64
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received.Store(int64(len(body)))
+		jsonx.SendSuccess(w, "ok")
+	})
+	body := strings.Repeat("x", 100)
+
+	rr := httptest.NewRecorder()
+	Middleware(next, Options{MaxBodySize: 10}).ServeHTTP(rr, newRequest("key-1", body))
+	if rr.Code != http.StatusOK || received.Load() != 100 {
+		t.Errorf("status = %d, handler read %d bytes; want the whole body passed through", rr.Code, received.Load())
+	}
+
+	rr = httptest.NewRecorder()
+	Middleware(next, Options{MaxBodySize: 10, RejectLargeBodies: true}).ServeHTTP(rr, newRequest("key-2", body))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", rr.Code)
+	}
+}
+
+// failingStore fails every Save
+type failingStore struct {
+	*MemoryStore
+}
+
+func (s failingStore) Save(ctx context.Context, key string, record *Record) error {
+	return errors.New("store is down")
+}
+
+func TestMiddlewareSaveError(t *testing.T) {
+	var calls atomic.Int32
+	var reported error
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		jsonx.SendSuccess(w, "ok")
+	}), Options{
+		Store:   failingStore{NewMemoryStore(time.Hour)},
+		OnError: func(r *http.Request, err error) { reported = err },
+	})
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("key-1", `{}`))
+	if reported == nil {
+		t.Fatal("Save error wasn't reported")
+	}
+
+	// The key was released, so the retry isn't stuck behind a reservation
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newRequest("key-1", `{}`))
+	if rr.Code != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("retry: status = %d, calls = %d", rr.Code, calls.Load())
+	}
+}
+
+// stuckStore fails every Release
+type stuckStore struct {
+	*MemoryStore
+}
+
+func (s stuckStore) Release(ctx context.Context, key string) error {
+	return errors.New("store is down")
+}
+
+func TestMiddlewareReportsReleaseError(t *testing.T) {
+	var reported error
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonx.RespondWithError(w, "try again", jsonx.Options{ErrorStatus: http.StatusServiceUnavailable})
+	}), Options{
+		Store:   stuckStore{NewMemoryStore(time.Hour)},
+		OnError: func(r *http.Request, err error) { reported = err },
+	})
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("key-1", `{}`))
+	if reported == nil || !strings.Contains(reported.Error(), "store is down") {
+		t.Errorf("reported = %v, want the Release error", reported)
+	}
+}
+
+// contextStore fails calls made with a cancelled context, like a store talking to a database
+type contextStore struct {
+	*MemoryStore
+}
+
+func (s contextStore) Save(ctx context.Context, key string, record *Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.MemoryStore.Save(ctx, key, record)
+}
+
+func (s contextStore) Release(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.MemoryStore.Release(ctx, key)
+}
+
+func TestMiddlewareClientDisconnect(t *testing.T) {
+	var calls atomic.Int32
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		jsonx.SendSuccess(w, "ok")
+	}), Options{
+		Store:   contextStore{NewMemoryStore(time.Hour)},
+		OnError: func(r *http.Request, err error) { t.Errorf("OnError(%v)", err) },
+	})
+
+	// The client goes away while the handler runs
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("key-1", `{}`).WithContext(ctx))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newRequest("key-1", `{}`))
+	if rr.Code != http.StatusOK || rr.Header().Get(ReplayedHeader) != "true" || calls.Load() != 1 {
+		t.Errorf("retry: status = %d, replayed = %q, calls = %d", rr.Code, rr.Header().Get(ReplayedHeader), calls.Load())
+	}
+}
+
+func TestMiddlewareConcurrentDuplicate(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		jsonx.SendSuccess(w, "ok")
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest("key-1", `{}`))
+		close(done)
+	}()
+
+	<-started
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newRequest("key-1", `{}`))
+	close(release)
+	<-done
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("status = %d, want 409", rr.Code)
+	}
+}
+
+func TestMiddlewareDoesNotStoreServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			jsonx.RespondWithError(w, "try again", jsonx.Options{ErrorStatus: http.StatusServiceUnavailable})
+			return
+		}
+		jsonx.SendSuccess(w, "ok")
+	}), Options{Store: NewMemoryStore(time.Hour)})
+
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("key-1", `{}`))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newRequest("key-1", `{}`))
+
+	if calls.Load() != 2 || rr.Code != http.StatusOK {
+		t.Errorf("calls = %d, status = %d; want retry to reach the handler", calls.Load(), rr.Code)
+	}
+}
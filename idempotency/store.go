@@ -0,0 +1,119 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInFlight            = errors.New("a request with this idempotency key is still in progress")
+	ErrFingerprintMismatch = errors.New("idempotency key was already used for a different request")
+)
+
+// Record is a captured response stored under an idempotency key
+type Record struct {
+	Fingerprint string
+	Status      int
+	Header      http.Header
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// Store keeps idempotency keys and the responses they produced.
+//
+// Reserve claims key for a new request and returns (nil, nil). If the key already holds a
+// completed response that record is returned instead. While another request holds the key,
+// Reserve returns ErrInFlight, or ErrFingerprintMismatch if that request had a different fingerprint.
+type Store interface {
+	Reserve(ctx context.Context, key, fingerprint string) (*Record, error)
+	// Save stores the completed response for a reserved key
+	Save(ctx context.Context, key string, record *Record) error
+	// Release drops a reservation without storing a response so the request can be retried
+	Release(ctx context.Context, key string) error
+}
+
+type memoryEntry struct {
+	fingerprint string
+	record      *Record
+	expiresAt   time.Time
+}
+
+// MemoryStore is an in-process Store. Keys, including unfinished reservations, expire after the TTL.
+type MemoryStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*memoryEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		ttl:     ttl,
+		entries: make(map[string]*memoryEntry),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStore) Reserve(ctx context.Context, key, fingerprint string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expiresAt) {
+		if entry.record != nil {
+			return entry.record, nil
+		}
+		if entry.fingerprint != fingerprint {
+			return nil, ErrFingerprintMismatch
+		}
+		return nil, ErrInFlight
+	}
+
+	s.entries[key] = &memoryEntry{
+		fingerprint: fingerprint,
+		expiresAt:   now.Add(s.ttl),
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) Save(ctx context.Context, key string, record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = &memoryEntry{
+		fingerprint: record.Fingerprint,
+		record:      record,
+		expiresAt:   s.now().Add(s.ttl),
+	}
+	return nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.entries[key]; ok && entry.record == nil {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+// sweep drops expired entries, at most once per minute
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryStore(time.Hour)
+	store.now = func() time.Time { return now }
+
+	if rec, err := store.Reserve(ctx, "k", "fp"); rec != nil || err != nil {
+		t.Fatalf("first Reserve() = %v, %v; want nil, nil", rec, err)
+	}
+
+	if _, err := store.Reserve(ctx, "k", "fp"); !errors.Is(err, ErrInFlight) {
+		t.Errorf("Reserve() while in flight = %v, want ErrInFlight", err)
+	}
+
+	if _, err := store.Reserve(ctx, "k", "other"); !errors.Is(err, ErrFingerprintMismatch) {
+		t.Errorf("Reserve() with other fingerprint = %v, want ErrFingerprintMismatch", err)
+	}
+
+	store.Save(ctx, "k", &Record{Fingerprint: "fp", Status: 201})
+	if rec, err := store.Reserve(ctx, "k", "fp"); err != nil || rec == nil || rec.Status != 201 {
+		t.Errorf("Reserve() after Save = %v, %v; want stored record", rec, err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if rec, err := store.Reserve(ctx, "k", "fp"); rec != nil || err != nil {
+		t.Errorf("Reserve() after expiry = %v, %v; want a fresh reservation", rec, err)
+	}
+
+	store.Release(ctx, "k")
+	if rec, err := store.Reserve(ctx, "k", "fp"); rec != nil || err != nil {
+		t.Errorf("Reserve() after Release = %v, %v; want a fresh reservation", rec, err)
+	}
+}
@@ -0,0 +1,351 @@
+package jsonx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	OpAdd     = "add"
+	OpRemove  = "remove"
+	OpReplace = "replace"
+)
+
+type ArrayStrategy int
+
+const (
+	// ArrayByIndex compares array elements position by position
+	ArrayByIndex ArrayStrategy = iota
+	// ArrayByKey matches object elements by DiffOptions.ArrayKey, so inserting or removing an
+	// element doesn't show up as a change to every element after it. Arrays whose elements aren't
+	// all keyed objects, or whose matched elements were reordered, fall back to ArrayByIndex.
+	ArrayByKey
+)
+
+type DiffOptions struct {
+	ArrayStrategy ArrayStrategy
+	// ArrayKey is the object field used by ArrayByKey. Defaults to "id".
+	ArrayKey string
+	// NumericTolerance treats numbers whose difference is within it as equal
+	NumericTolerance float64
+}
+
+func DefaultDiffOptions() DiffOptions {
+	return DiffOptions{
+		ArrayStrategy: ArrayByIndex,
+		ArrayKey:      "id",
+	}
+}
+
+func mergeDiffOptions(defaults DiffOptions, customs ...DiffOptions) DiffOptions {
+	result := defaults
+
+	if len(customs) == 0 {
+		return result
+	}
+
+	custom := customs[0]
+
+	result.ArrayStrategy = custom.ArrayStrategy
+
+	if custom.ArrayKey != "" {
+		result.ArrayKey = custom.ArrayKey
+	}
+
+	if custom.NumericTolerance > 0 {
+		result.NumericTolerance = custom.NumericTolerance
+	}
+
+	return result
+}
+
+// Change is a single difference between two JSON documents. Path is a JSON pointer (RFC 6901).
+// Changes are ordered so that applying them in sequence turns the old document into the new one.
+type Change struct {
+	Op       string `json:"op"`
+	Path     string `json:"path"`
+	OldValue any    `json:"old_value,omitempty"`
+	Value    any    `json:"value,omitempty"`
+}
+
+// PatchOperation is an RFC 6902 JSON Patch operation
+type PatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// MarshalJSON omits "value" for remove operations, but keeps explicit nulls for add and replace
+func (p PatchOperation) MarshalJSON() ([]byte, error) {
+	if p.Op == OpRemove {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{p.Op, p.Path})
+	}
+
+	type operation PatchOperation
+	return json.Marshal(operation(p))
+}
+
+// Diff compares two JSON documents and returns the changes that turn a into b
+func Diff(a, b []byte, opts ...DiffOptions) ([]Change, error) {
+	left, err := decodeDiffValue(a)
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := decodeDiffValue(b)
+	if err != nil {
+		return nil, err
+	}
+
+	opt := mergeDiffOptions(DefaultDiffOptions(), opts...)
+
+	var changes []Change
+	diffValues("", left, right, opt, &changes)
+	return changes, nil
+}
+
+// DiffValues marshals a and b to JSON and compares the results with Diff
+func DiffValues(a, b any, opts ...DiffOptions) ([]Change, error) {
+	left, err := json.Marshal(a)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode first value: %w", err)
+	}
+
+	right, err := json.Marshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode second value: %w", err)
+	}
+
+	return Diff(left, right, opts...)
+}
+
+// ToPatch converts changes into an RFC 6902 JSON Patch document
+func ToPatch(changes []Change) []PatchOperation {
+	patch := make([]PatchOperation, len(changes))
+	for i, c := range changes {
+		patch[i] = PatchOperation{Op: c.Op, Path: c.Path, Value: c.Value}
+	}
+	return patch
+}
+
+// EscapePointerToken escapes a key for use as a JSON pointer segment
+func EscapePointerToken(token string) string {
+	token = strings.ReplaceAll(token, "~", "~0")
+	return strings.ReplaceAll(token, "/", "~1")
+}
+
+func decodeDiffValue(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, ErrInvalidJSON
+	}
+	return value, nil
+}
+
+func diffValues(path string, a, b any, opt DiffOptions, changes *[]Change) {
+	switch left := a.(type) {
+	case map[string]any:
+		if right, ok := b.(map[string]any); ok {
+			diffObjects(path, left, right, opt, changes)
+			return
+		}
+	case []any:
+		if right, ok := b.([]any); ok {
+			if opt.ArrayStrategy == ArrayByKey && diffKeyedArrays(path, left, right, opt, changes) {
+				return
+			}
+			diffArrays(path, left, right, opt, changes)
+			return
+		}
+	}
+
+	if !equalValues(a, b, opt) {
+		*changes = append(*changes, Change{Op: OpReplace, Path: path, OldValue: a, Value: b})
+	}
+}
+
+func diffObjects(path string, a, b map[string]any, opt DiffOptions, changes *[]Change) {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		childPath := path + "/" + EscapePointerToken(k)
+		left, inA := a[k]
+		right, inB := b[k]
+
+		switch {
+		case inA && !inB:
+			*changes = append(*changes, Change{Op: OpRemove, Path: childPath, OldValue: left})
+		case !inA && inB:
+			*changes = append(*changes, Change{Op: OpAdd, Path: childPath, Value: right})
+		default:
+			diffValues(childPath, left, right, opt, changes)
+		}
+	}
+}
+
+func diffArrays(path string, a, b []any, opt DiffOptions, changes *[]Change) {
+	common := min(len(a), len(b))
+	for i := 0; i < common; i++ {
+		diffValues(path+"/"+strconv.Itoa(i), a[i], b[i], opt, changes)
+	}
+
+	// Remove from the end so earlier indices stay valid while the patch is applied
+	for i := len(a) - 1; i >= common; i-- {
+		*changes = append(*changes, Change{Op: OpRemove, Path: path + "/" + strconv.Itoa(i), OldValue: a[i]})
+	}
+
+	for i := common; i < len(b); i++ {
+		*changes = append(*changes, Change{Op: OpAdd, Path: path + "/" + strconv.Itoa(i), Value: b[i]})
+	}
+}
+
+// diffKeyedArrays reports false when the arrays can't be matched by key
+func diffKeyedArrays(path string, a, b []any, opt DiffOptions, changes *[]Change) bool {
+	leftKeys, ok := arrayKeys(a, opt.ArrayKey)
+	if !ok {
+		return false
+	}
+	rightKeys, ok := arrayKeys(b, opt.ArrayKey)
+	if !ok {
+		return false
+	}
+
+	rightIndex := make(map[string]int, len(b))
+	for i, k := range rightKeys {
+		rightIndex[k] = i
+	}
+	leftIndex := make(map[string]int, len(a))
+	for i, k := range leftKeys {
+		leftIndex[k] = i
+	}
+
+	// Matched elements must keep their relative order, otherwise we'd need move operations
+	last := -1
+	for _, k := range leftKeys {
+		if j, ok := rightIndex[k]; ok {
+			if j < last {
+				return false
+			}
+			last = j
+		}
+	}
+
+	var result []Change
+	for i := len(a) - 1; i >= 0; i-- {
+		if _, ok := rightIndex[leftKeys[i]]; !ok {
+			result = append(result, Change{Op: OpRemove, Path: path + "/" + strconv.Itoa(i), OldValue: a[i]})
+		}
+	}
+
+	// After removals, a kept element's index is its position among the kept elements
+	kept := 0
+	for i, k := range leftKeys {
+		if j, ok := rightIndex[k]; ok {
+			diffValues(path+"/"+strconv.Itoa(kept), a[i], b[j], opt, &result)
+			kept++
+		}
+	}
+
+	for j, k := range rightKeys {
+		if _, ok := leftIndex[k]; !ok {
+			result = append(result, Change{Op: OpAdd, Path: path + "/" + strconv.Itoa(j), Value: b[j]})
+		}
+	}
+
+	*changes = append(*changes, result...)
+	return true
+}
+
+func arrayKeys(values []any, key string) ([]string, bool) {
+	keys := make([]string, len(values))
+	seen := make(map[string]bool, len(values))
+	for i, v := range values {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		id, ok := obj[key]
+		if !ok {
+			return nil, false
+		}
+		k, ok := arrayKey(id)
+		if !ok || seen[k] {
+			return nil, false
+		}
+		seen[k] = true
+		keys[i] = k
+	}
+	return keys, true
+}
+
+// arrayKey encodes an element's key with its JSON type, so the string "1" and the number 1
+// don't match
+func arrayKey(id any) (string, bool) {
+	if n, ok := id.(json.Number); ok {
+		if r, ok := new(big.Rat).SetString(n.String()); ok {
+			return "number:" + r.RatString(), true
+		}
+	}
+	data, err := json.Marshal(id)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+func equalValues(a, b any, opt DiffOptions) bool {
+	if left, ok := a.(json.Number); ok {
+		right, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if left == right {
+			return true
+		}
+		// Compared exactly, so integers too large for a float64 stay distinct
+		l, okL := new(big.Rat).SetString(left.String())
+		r, okR := new(big.Rat).SetString(right.String())
+		if !okL || !okR {
+			return false
+		}
+		diff := l.Sub(l, r)
+		tolerance := new(big.Rat)
+		if opt.NumericTolerance > 0 {
+			tolerance.SetFloat64(opt.NumericTolerance)
+		}
+		return diff.Abs(diff).Cmp(tolerance) <= 0
+	}
+
+	switch left := a.(type) {
+	case nil:
+		return b == nil
+	case string:
+		right, ok := b.(string)
+		return ok && left == right
+	case bool:
+		right, ok := b.(bool)
+		return ok && left == right
+	}
+
+	return false
+}
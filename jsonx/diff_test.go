@@ -0,0 +1,226 @@
+package jsonx
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		opts DiffOptions
+		want []Change
+	}{
+		{
+			name: "identical documents",
+			a:    `{"a":1,"b":[1,2]}`,
+			b:    `{"b":[1,2],"a":1}`,
+			want: nil,
+		},
+		{
+			name: "object add remove replace",
+			a:    `{"name":"Dami","age":30,"city":"Lagos"}`,
+			b:    `{"name":"Dami","age":31,"email":"dami@dami.dev"}`,
+			want: []Change{
+				{Op: OpReplace, Path: "/age", OldValue: json.Number("30"), Value: json.Number("31")},
+				{Op: OpRemove, Path: "/city", OldValue: "Lagos"},
+				{Op: OpAdd, Path: "/email", Value: "dami@dami.dev"},
+			},
+		},
+		{
+			name: "escaped pointer tokens",
+			a:    `{"a/b":1,"c~d":1}`,
+			b:    `{"a/b":2,"c~d":2}`,
+			want: []Change{
+				{Op: OpReplace, Path: "/a~1b", OldValue: json.Number("1"), Value: json.Number("2")},
+				{Op: OpReplace, Path: "/c~0d", OldValue: json.Number("1"), Value: json.Number("2")},
+			},
+		},
+		{
+			name: "array by index",
+			a:    `[1,2,3]`,
+			b:    `[1,5]`,
+			want: []Change{
+				{Op: OpReplace, Path: "/1", OldValue: json.Number("2"), Value: json.Number("5")},
+				{Op: OpRemove, Path: "/2", OldValue: json.Number("3")},
+			},
+		},
+		{
+			name: "array by key",
+			a:    `[{"id":1,"n":"a"},{"id":2,"n":"b"},{"id":3,"n":"c"}]`,
+			b:    `[{"id":1,"n":"a"},{"id":3,"n":"C"},{"id":4,"n":"d"}]`,
+			opts: DiffOptions{ArrayStrategy: ArrayByKey},
+			want: []Change{
+				{Op: OpRemove, Path: "/1", OldValue: map[string]any{"id": json.Number("2"), "n": "b"}},
+				{Op: OpReplace, Path: "/1/n", OldValue: "c", Value: "C"},
+				{Op: OpAdd, Path: "/2", Value: map[string]any{"id": json.Number("4"), "n": "d"}},
+			},
+		},
+		{
+			name: "numeric tolerance",
+			a:    `{"price":10.001,"qty":1}`,
+			b:    `{"price":10.002,"qty":1.0}`,
+			opts: DiffOptions{NumericTolerance: 0.01},
+			want: nil,
+		},
+		{
+			name: "large integers",
+			a:    `{"id":9007199254740993}`,
+			b:    `{"id":9007199254740992}`,
+			want: []Change{
+				{Op: OpReplace, Path: "/id", OldValue: json.Number("9007199254740993"), Value: json.Number("9007199254740992")},
+			},
+		},
+		{
+			name: "array keys keep their type",
+			a:    `[{"id":1,"n":"a"},{"id":"1","n":"b"}]`,
+			b:    `[{"id":"1","n":"b"}]`,
+			opts: DiffOptions{ArrayStrategy: ArrayByKey},
+			want: []Change{
+				{Op: OpRemove, Path: "/0", OldValue: map[string]any{"id": json.Number("1"), "n": "a"}},
+			},
+		},
+		{
+			name: "type change",
+			a:    `{"a":{"b":1}}`,
+			b:    `{"a":[1]}`,
+			want: []Change{
+				{Op: OpReplace, Path: "/a", OldValue: map[string]any{"b": json.Number("1")}, Value: []any{json.Number("1")}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Diff([]byte(tt.a), []byte(tt.b), tt.opts)
+			if err != nil {
+				t.Fatalf("Diff() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffPatchRoundTrip(t *testing.T) {
+	tests := []struct {
+		a, b string
+		opts DiffOptions
+	}{
+		{a: `{"a":[1,2,3,4],"b":{"c":null}}`, b: `{"a":[0],"b":{"c":false,"d":[]}}`},
+		{a: `[1]`, b: `[1,2,3]`},
+		{
+			a:    `{"items":[{"id":"x"},{"id":"y","v":1},{"id":"z"}]}`,
+			b:    `{"items":[{"id":"w"},{"id":"y","v":2},{"id":"v"},{"id":"z"},{"id":"u"}]}`,
+			opts: DiffOptions{ArrayStrategy: ArrayByKey},
+		},
+		{
+			a:    `[{"id":1},{"id":2}]`,
+			b:    `[{"id":2},{"id":1}]`,
+			opts: DiffOptions{ArrayStrategy: ArrayByKey},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			changes, err := Diff([]byte(tt.a), []byte(tt.b), tt.opts)
+			if err != nil {
+				t.Fatalf("Diff() error = %v", err)
+			}
+
+			doc, _ := decodeDiffValue([]byte(tt.a))
+			for _, op := range ToPatch(changes) {
+				doc = applyOperation(t, doc, op)
+			}
+
+			want, _ := decodeDiffValue([]byte(tt.b))
+			if !reflect.DeepEqual(doc, want) {
+				t.Errorf("patched document = %v, want %v", doc, want)
+			}
+		})
+	}
+}
+
+func TestDiffInvalidJSON(t *testing.T) {
+	if _, err := Diff([]byte(`{`), []byte(`{}`)); !errors.Is(err, ErrInvalidJSON) {
+		t.Errorf("Diff() error = %v, want ErrInvalidJSON", err)
+	}
+}
+
+func TestPatchOperationJSON(t *testing.T) {
+	patch := ToPatch([]Change{
+		{Op: OpRemove, Path: "/a", OldValue: 1},
+		{Op: OpReplace, Path: "/b", OldValue: 1, Value: nil},
+	})
+
+	data, err := json.Marshal(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[{"op":"remove","path":"/a"},{"op":"replace","path":"/b","value":null}]`
+	if string(data) != want {
+		t.Errorf("patch = %s, want %s", data, want)
+	}
+}
+
+// applyOperation is a minimal RFC 6902 add/remove/replace implementation for round-trip tests
+func applyOperation(t *testing.T, doc any, op PatchOperation) any {
+	t.Helper()
+
+	if op.Path == "" {
+		return op.Value
+	}
+
+	parts := strings.Split(op.Path[1:], "/")
+	for i, p := range parts {
+		parts[i] = strings.ReplaceAll(strings.ReplaceAll(p, "~1", "/"), "~0", "~")
+	}
+
+	var apply func(node any, parts []string) any
+	apply = func(node any, parts []string) any {
+		head := parts[0]
+		switch n := node.(type) {
+		case map[string]any:
+			if len(parts) > 1 {
+				n[head] = apply(n[head], parts[1:])
+			} else if op.Op == OpRemove {
+				delete(n, head)
+			} else {
+				n[head] = op.Value
+			}
+			return n
+		case []any:
+			idx, err := strconv.Atoi(head)
+			if err != nil {
+				t.Fatalf("bad index %q in %s", head, op.Path)
+			}
+			if len(parts) > 1 {
+				n[idx] = apply(n[idx], parts[1:])
+				return n
+			}
+			switch op.Op {
+			case OpRemove:
+				return append(n[:idx:idx], n[idx+1:]...)
+			case OpAdd:
+				out := append(n[:idx:idx], op.Value)
+				return append(out, n[idx:]...)
+			default:
+				n[idx] = op.Value
+				return n
+			}
+		}
+		t.Fatalf("cannot apply %s at %s", op.Op, op.Path)
+		return nil
+	}
+
+	return apply(doc, parts)
+}
@@ -1,12 +1,15 @@
 package jsonx
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
 	"reflect"
 	"strings"
+
+	"github.com/ddddami/bindle/requestid"
 )
 
 var (
@@ -199,6 +202,15 @@ func RespondWithError(w http.ResponseWriter, err any, opts ...Options) error {
 		w.Header().Set(k, v)
 	}
 
+	// The request ID goes in structured error bodies, and in meta next to plain messages
+	if id := w.Header().Get(requestid.Header); id != "" {
+		if withID, ok := withRequestID(resp.Error, id); ok {
+			resp.Error = withID
+		} else {
+			resp.Meta, _ = withRequestID(nil, id)
+		}
+	}
+
 	w.WriteHeader(opt.ErrorStatus)
 
 	return EncodeJSON(w, resp, opt)
@@ -217,6 +229,15 @@ func RespondWithSuccess(w http.ResponseWriter, data any, meta any, opts ...Optio
 		resp.Meta = meta
 	}
 
+	// Meta that isn't an object is wrapped so the request ID has somewhere to go
+	if id := w.Header().Get(requestid.Header); id != "" {
+		if withID, ok := withRequestID(meta, id); ok {
+			resp.Meta = withID
+		} else {
+			resp.Meta = map[string]any{"request_id": id, "meta": meta}
+		}
+	}
+
 	w.Header().Set("Content-Type", opt.ContentType)
 	for k, v := range opt.Headers {
 		w.Header().Set(k, v)
@@ -227,6 +248,35 @@ func RespondWithSuccess(w http.ResponseWriter, data any, meta any, opts ...Optio
 	return EncodeJSON(w, resp, opt)
 }
 
+// withRequestID adds a "request_id" field to v when it encodes as a JSON object, or
+// returns an object holding only the ID when v is nil. ok is false for other values, which
+// can't hold the ID.
+func withRequestID(v any, id string) (any, bool) {
+	if v == nil {
+		return map[string]string{"request_id": id}, true
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return v, false
+	}
+
+	if bytes.Equal(bytes.TrimSpace(buf.Bytes()), []byte("null")) {
+		return map[string]string{"request_id": id}, true
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		return v, false
+	}
+	if _, exists := fields["request_id"]; !exists {
+		fields["request_id"], _ = json.Marshal(id)
+	}
+	return fields, true
+}
+
 // Send is a shorthand for RespondWithJSON with default options
 func Send(w http.ResponseWriter, data any) error {
 	return RespondWithJSON(w, data)
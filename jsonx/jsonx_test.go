@@ -7,6 +7,8 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/ddddami/bindle/requestid"
 )
 
 func TestDecodeJSON(t *testing.T) {
@@ -284,3 +286,44 @@ func TestRespondFunctions(t *testing.T) {
 		})
 	}
 }
+
+func TestResponseIncludesRequestID(t *testing.T) {
+	handler := requestid.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			SendError(w, errors.New("boom"))
+		case "/detail":
+			RespondWithError(w, ErrorDetail{Code: "not_found", Message: "no such user"}, Options{ErrorStatus: http.StatusNotFound})
+		case "/meta":
+			RespondWithSuccess(w, "ok", struct {
+				Total int `json:"total"`
+			}{Total: 3})
+		case "/list-meta":
+			RespondWithSuccess(w, "ok", []string{"a", "b"})
+		default:
+			SendSuccess(w, "ok")
+		}
+	}))
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/ok", `{"success":true,"data":"ok","error":null,"meta":{"request_id":"req-1"}}`},
+		{"/meta", `{"success":true,"data":"ok","error":null,"meta":{"request_id":"req-1","total":3}}`},
+		{"/list-meta", `{"success":true,"data":"ok","error":null,"meta":{"meta":["a","b"],"request_id":"req-1"}}`},
+		{"/fail", `{"success":false,"data":null,"error":"boom","meta":{"request_id":"req-1"}}`},
+		{"/detail", `{"success":false,"data":null,"error":{"code":"not_found","message":"no such user","request_id":"req-1"},"meta":null}`},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set(requestid.Header, "req-1")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if got := strings.TrimSpace(rr.Body.String()); got != tt.want {
+			t.Errorf("%s: body = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package jsonxtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ddddami/bindle/jsonx"
+)
+
+const (
+	// UpdateEnv is the environment variable that rewrites golden files, e.g.
+	// JSONXTEST_UPDATE=1 go test ./...
+	UpdateEnv = "JSONXTEST_UPDATE"
+	// UpdateFlag is the test flag that also rewrites golden files when the test package
+	// defines it, e.g. var update = flag.Bool("update", false, "…") and go test ./... -update.
+	// jsonxtest only looks it up, so it never clashes with a flag of the same name.
+	UpdateFlag = "update"
+)
+
+// Envelope mirrors jsonx.Response with a typed Data field
+type Envelope[T any] struct {
+	Success bool            `json:"success"`
+	Data    T               `json:"data"`
+	Error   json.RawMessage `json:"error"`
+	Meta    json.RawMessage `json:"meta"`
+}
+
+// NewRequest builds a request whose body is body encoded as JSON.
+// Strings and byte slices are sent as-is; a nil body sends no body at all.
+func NewRequest(t testing.TB, method, target string, body any) *http.Request {
+	t.Helper()
+
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	case []byte:
+		reader = bytes.NewReader(b)
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("failed to encode request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, target, reader)
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req
+}
+
+// Do runs the handler against req and returns the recorded response
+func Do(t testing.TB, h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+// AssertStatus fails the test if the recorded status code is not want
+func AssertStatus(t testing.TB, rr *httptest.ResponseRecorder, want int) {
+	t.Helper()
+
+	if rr.Code != want {
+		t.Errorf("status = %d, want %d (body: %s)", rr.Code, want, strings.TrimSpace(rr.Body.String()))
+	}
+}
+
+// AssertHeader fails the test if the recorded header key does not equal want
+func AssertHeader(t testing.TB, rr *httptest.ResponseRecorder, key, want string) {
+	t.Helper()
+
+	if got := rr.Header().Get(key); got != want {
+		t.Errorf("header %s = %q, want %q", key, got, want)
+	}
+}
+
+// DecodeEnvelope decodes a jsonx.Response body, with Data decoded into T
+func DecodeEnvelope[T any](t testing.TB, rr *httptest.ResponseRecorder) Envelope[T] {
+	t.Helper()
+
+	var env Envelope[T]
+	if err := json.Unmarshal(rr.Body.Bytes(), &env); err != nil {
+		t.Fatalf("failed to decode response envelope: %v (body: %s)", err, rr.Body.String())
+	}
+	return env
+}
+
+// AssertJSONEqual compares two JSON documents semantically, ignoring key order and whitespace.
+// Values at the given ignore paths (JSON pointers such as "/meta/generated_at") are removed
+// from both documents before comparing.
+func AssertJSONEqual(t testing.TB, want, got []byte, ignore ...string) {
+	t.Helper()
+
+	wantValue, err := normalize(want, ignore)
+	if err != nil {
+		t.Fatalf("invalid expected JSON: %v", err)
+	}
+
+	gotValue, err := normalize(got, ignore)
+	if err != nil {
+		t.Fatalf("invalid actual JSON: %v (got: %s)", err, got)
+	}
+
+	if !reflect.DeepEqual(wantValue, gotValue) {
+		t.Errorf("JSON mismatch\n got: %s\nwant: %s%s", pretty(gotValue), pretty(wantValue), describeChanges(wantValue, gotValue))
+	}
+}
+
+// describeChanges lists what has to change in want to get got
+func describeChanges(want, got any) string {
+	changes, err := jsonx.DiffValues(want, got)
+	if err != nil || len(changes) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("\nchanges:")
+	for _, c := range changes {
+		switch c.Op {
+		case jsonx.OpAdd:
+			fmt.Fprintf(&b, "\n  + %s: %s", c.Path, pretty(c.Value))
+		case jsonx.OpRemove:
+			fmt.Fprintf(&b, "\n  - %s: %s", c.Path, pretty(c.OldValue))
+		default:
+			fmt.Fprintf(&b, "\n  ~ %s: %s -> %s", c.Path, pretty(c.OldValue), pretty(c.Value))
+		}
+	}
+	return b.String()
+}
+
+// AssertBodyJSON compares the recorded body against want with AssertJSONEqual
+func AssertBodyJSON(t testing.TB, rr *httptest.ResponseRecorder, want string, ignore ...string) {
+	t.Helper()
+
+	AssertJSONEqual(t, []byte(want), rr.Body.Bytes(), ignore...)
+}
+
+// AssertGolden compares got against the JSON stored in the golden file at path.
+// When UpdateEnv is set, or the test package's -update flag, the file is (re)written with
+// got instead.
+func AssertGolden(t testing.TB, path string, got []byte, ignore ...string) {
+	t.Helper()
+
+	if updating() {
+		value, err := normalize(got, nil)
+		if err != nil {
+			t.Fatalf("invalid actual JSON: %v", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to create golden directory: %v", err)
+		}
+		if err := os.WriteFile(path, append(pretty(value), '\n'), 0o644); err != nil {
+			t.Fatalf("failed to write golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file (run with %s=1 to create it): %v", UpdateEnv, err)
+	}
+
+	AssertJSONEqual(t, want, got, ignore...)
+}
+
+func updating() bool {
+	if update, err := strconv.ParseBool(os.Getenv(UpdateEnv)); err == nil && update {
+		return true
+	}
+
+	f := flag.Lookup(UpdateFlag)
+	if f == nil {
+		return false
+	}
+	update, _ := strconv.ParseBool(f.Value.String())
+	return update
+}
+
+func normalize(data []byte, ignore []string) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	value = canonicalNumbers(value)
+	for _, path := range ignore {
+		value = removePath(value, splitPointer(path))
+	}
+	return value, nil
+}
+
+// canonicalNumbers rewrites json.Numbers exactly in a canonical form, so 1, 1.0 and 1e0
+// compare equal while integers too large for a float64 stay distinct
+func canonicalNumbers(v any) any {
+	switch val := v.(type) {
+	case json.Number:
+		return canonicalNumber(val)
+	case map[string]any:
+		for k, child := range val {
+			val[k] = canonicalNumbers(child)
+		}
+	case []any:
+		for i, child := range val {
+			val[i] = canonicalNumbers(child)
+		}
+	}
+	return v
+}
+
+func canonicalNumber(n json.Number) json.Number {
+	r, ok := new(big.Rat).SetString(n.String())
+	if !ok {
+		return n
+	}
+	if r.IsInt() {
+		return json.Number(r.Num().String())
+	}
+
+	// JSON numbers are finite decimals, so scaling by 10 eventually gives an integer
+	digits := 0
+	ten := big.NewRat(10, 1)
+	for scaled := new(big.Rat).Set(r); !scaled.IsInt(); digits++ {
+		scaled.Mul(scaled, ten)
+	}
+	return json.Number(r.FloatString(digits))
+}
+
+func splitPointer(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return nil
+	}
+
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		p = strings.ReplaceAll(p, "~1", "/")
+		parts[i] = strings.ReplaceAll(p, "~0", "~")
+	}
+	return parts
+}
+
+// removePath deletes the value at parts. A "*" segment matches every key or index.
+func removePath(v any, parts []string) any {
+	if len(parts) == 0 {
+		return nil
+	}
+
+	head, rest := parts[0], parts[1:]
+	switch val := v.(type) {
+	case map[string]any:
+		for k, child := range val {
+			if head != "*" && k != head {
+				continue
+			}
+			if len(rest) == 0 {
+				delete(val, k)
+			} else {
+				val[k] = removePath(child, rest)
+			}
+		}
+	case []any:
+		for i, child := range val {
+			if head != "*" && strconv.Itoa(i) != head {
+				continue
+			}
+			if len(rest) == 0 {
+				val[i] = nil
+			} else {
+				val[i] = removePath(child, rest)
+			}
+		}
+	}
+	return v
+}
+
+func pretty(v any) []byte {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return []byte(err.Error())
+	}
+	return data
+}
@@ -0,0 +1,152 @@
+package jsonxtest
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ddddami/bindle/jsonx"
+)
+
+// recordingTB captures failures instead of failing the surrounding test
+type recordingTB struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+type user struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func userHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input user
+		if err := jsonx.DecodeJSONFromRequest(r, &input); err != nil {
+			jsonx.SendError(w, err)
+			return
+		}
+		input.ID = 1
+		jsonx.RespondWithSuccess(w, input, map[string]any{"version": 2}, jsonx.Options{
+			SuccessStatus: http.StatusCreated,
+			Headers:       map[string]string{"X-Resource-ID": "1"},
+		})
+	})
+}
+
+func TestHandlerHelpers(t *testing.T) {
+	req := NewRequest(t, "POST", "/users", user{Name: "Dami"})
+	rr := Do(t, userHandler(), req)
+
+	AssertStatus(t, rr, http.StatusCreated)
+	AssertHeader(t, rr, "X-Resource-ID", "1")
+
+	env := DecodeEnvelope[user](t, rr)
+	if !env.Success || env.Data.ID != 1 || env.Data.Name != "Dami" {
+		t.Errorf("unexpected envelope: %+v", env)
+	}
+
+	AssertBodyJSON(t, rr, `{"meta":{"version":2.0},"error":null,"success":true,"data":{"name":"Dami","id":1}}`)
+}
+
+func TestAssertJSONEqual(t *testing.T) {
+	tests := []struct {
+		name     string
+		want     string
+		got      string
+		ignore   []string
+		wantFail bool
+	}{
+		{
+			name: "key order is ignored",
+			want: `{"a":1,"b":[1,2]}`,
+			got:  `{"b":[1,2],"a":1}`,
+		},
+		{
+			name:     "different values fail",
+			want:     `{"a":1}`,
+			got:      `{"a":2}`,
+			wantFail: true,
+		},
+		{
+			name:   "ignored paths are skipped",
+			want:   `{"a":1,"meta":{"at":"yesterday"}}`,
+			got:    `{"a":1,"meta":{"at":"today"}}`,
+			ignore: []string{"/meta/at"},
+		},
+		{
+			name: "equal numbers in other notations",
+			want: `{"a":1,"b":0.5,"c":1500}`,
+			got:  `{"a":1.0,"b":5e-1,"c":1.5e3}`,
+		},
+		{
+			name:     "large integers keep their precision",
+			want:     `{"a":9007199254740993}`,
+			got:      `{"a":9007199254740992}`,
+			wantFail: true,
+		},
+		{
+			name:   "wildcard paths",
+			want:   `{"items":[{"id":1,"ts":1},{"id":2,"ts":2}]}`,
+			got:    `{"items":[{"id":1,"ts":3},{"id":2,"ts":4}]}`,
+			ignore: []string{"/items/*/ts"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recordingTB{TB: t}
+			AssertJSONEqual(rec, []byte(tt.want), []byte(tt.got), tt.ignore...)
+
+			if failed := len(rec.failures) > 0; failed != tt.wantFail {
+				t.Errorf("failed = %v, want %v (%v)", failed, tt.wantFail, rec.failures)
+			}
+
+			if tt.name == "different values fail" && !strings.Contains(rec.failures[0], "~ /a: 1 -> 2") {
+				t.Errorf("failure should describe the change, got: %s", rec.failures[0])
+			}
+		})
+	}
+}
+
+func TestAssertGolden(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testdata", "user.golden.json")
+
+	t.Setenv(UpdateEnv, "1")
+	AssertGolden(t, path, []byte(`{"id":1,"name":"Dami"}`))
+
+	t.Setenv(UpdateEnv, "")
+	AssertGolden(t, path, []byte(`{"name":"Dami","id":1}`))
+
+	rec := &recordingTB{TB: t}
+	AssertGolden(rec, path, []byte(`{"name":"Ngozi","id":1}`))
+	if len(rec.failures) == 0 {
+		t.Errorf("expected golden mismatch to fail")
+	}
+}
+
+func TestAssertGoldenUpdateFlag(t *testing.T) {
+	// jsonxtest doesn't define -update, so test packages can define their own
+	update := flag.Bool(UpdateFlag, false, "update golden files")
+	path := filepath.Join(t.TempDir(), "user.golden.json")
+
+	*update = true
+	defer func() { *update = false }()
+	AssertGolden(t, path, []byte(`{"id":1}`))
+
+	*update = false
+	rec := &recordingTB{TB: t}
+	AssertGolden(rec, path, []byte(`{"id":2}`))
+	if len(rec.failures) == 0 {
+		t.Errorf("expected golden mismatch to fail")
+	}
+}
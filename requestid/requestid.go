@@ -0,0 +1,190 @@
+package requestid
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/ddddami/bindle/random"
+)
+
+// Header is the HTTP header used to receive and propagate request IDs
+const Header = "X-Request-ID"
+
+// MaxLength is the longest incoming request ID that will be reused
+const MaxLength = 128
+
+type contextKey struct{}
+
+type Options struct {
+	// TrustIncoming reuses a well-formed ID sent by the client instead of generating a new one
+	TrustIncoming bool
+	// Length of generated IDs
+	Length int
+	// Generator overrides how new IDs are created. Defaults to random.Generate.
+	Generator func() (string, error)
+}
+
+func DefaultOptions() Options {
+	return Options{
+		TrustIncoming: true,
+		Length:        20,
+	}
+}
+
+func mergeOptions(defaults Options, customs ...Options) Options {
+	result := defaults
+
+	if len(customs) == 0 {
+		return result
+	}
+
+	custom := customs[0]
+
+	result.TrustIncoming = custom.TrustIncoming
+
+	if custom.Length > 0 {
+		result.Length = custom.Length
+	}
+
+	if custom.Generator != nil {
+		result.Generator = custom.Generator
+	}
+
+	return result
+}
+
+// NewContext returns a copy of ctx carrying the request ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID stored in ctx, or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// FromRequest returns the request ID attached to r by Middleware
+func FromRequest(r *http.Request) string {
+	return FromContext(r.Context())
+}
+
+// Middleware accepts the incoming X-Request-ID (when trusted and valid) or generates a new one,
+// stores it in the request context and echoes it back in the response header.
+func Middleware(next http.Handler, opts ...Options) http.Handler {
+	opt := mergeOptions(DefaultOptions(), opts...)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := ""
+		if opt.TrustIncoming {
+			if incoming := r.Header.Get(Header); IsValid(incoming) {
+				id = incoming
+			}
+		}
+
+		if id == "" {
+			generated, err := generate(opt)
+			if err != nil {
+				http.Error(w, "failed to generate request id", http.StatusInternalServerError)
+				return
+			}
+			id = generated
+		}
+
+		w.Header().Set(Header, id)
+		r.Header.Set(Header, id)
+
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// IsValid reports whether id is safe to reuse: non-empty, at most MaxLength long
+// and made of letters, digits, '-', '_', '.' or ':' only.
+func IsValid(id string) bool {
+	if id == "" || len(id) > MaxLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func generate(opt Options) (string, error) {
+	if opt.Generator != nil {
+		return opt.Generator()
+	}
+	return random.Generate(random.Options{Length: opt.Length})
+}
+
+// LogHandler is a slog.Handler that adds the request ID found in the record's context
+// as a top-level "request_id" attribute before delegating to the wrapped handler, even
+// when the logger has groups.
+type LogHandler struct {
+	// root is the wrapped handler with the attributes added before the first group
+	root    slog.Handler
+	handler slog.Handler
+	// grouped replays the WithGroup and WithAttrs calls made since the first group
+	grouped []func(slog.Handler) slog.Handler
+}
+
+// NewLogHandler wraps h so that log calls made with a request context include its ID
+func NewLogHandler(h slog.Handler) *LogHandler {
+	return &LogHandler{root: h, handler: h}
+}
+
+func (h *LogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *LogHandler) Handle(ctx context.Context, record slog.Record) error {
+	id := FromContext(ctx)
+	if id == "" {
+		return h.handler.Handle(ctx, record)
+	}
+
+	if len(h.grouped) == 0 {
+		record = record.Clone()
+		record.AddAttrs(slog.String("request_id", id))
+		return h.handler.Handle(ctx, record)
+	}
+
+	// Record attributes would land in the groups, so add the ID before replaying them
+	handler := h.root.WithAttrs([]slog.Attr{slog.String("request_id", id)})
+	for _, apply := range h.grouped {
+		handler = apply(handler)
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(h.grouped) == 0 {
+		root := h.root.WithAttrs(attrs)
+		return &LogHandler{root: root, handler: root}
+	}
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *LogHandler) with(apply func(slog.Handler) slog.Handler) *LogHandler {
+	return &LogHandler{
+		root:    h.root,
+		handler: apply(h.handler),
+		grouped: append(slices.Clip(h.grouped), apply),
+	}
+}
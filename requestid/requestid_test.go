@@ -0,0 +1,116 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		opts     Options
+		wantSame bool
+	}{
+		{
+			name:     "generates id when missing",
+			incoming: "",
+			opts:     DefaultOptions(),
+			wantSame: false,
+		},
+		{
+			name:     "reuses valid incoming id",
+			incoming: "abc-123",
+			opts:     DefaultOptions(),
+			wantSame: true,
+		},
+		{
+			name:     "replaces invalid incoming id",
+			incoming: "bad id\r\n",
+			opts:     DefaultOptions(),
+			wantSame: false,
+		},
+		{
+			name:     "ignores incoming id when not trusted",
+			incoming: "abc-123",
+			opts:     Options{TrustIncoming: false},
+			wantSame: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = FromRequest(r)
+			}), tt.opts)
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(Header, tt.incoming)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if seen == "" {
+				t.Fatalf("expected request id in context, got none")
+			}
+
+			if got := rr.Header().Get(Header); got != seen {
+				t.Errorf("response header = %q, want %q", got, seen)
+			}
+
+			if tt.wantSame && seen != tt.incoming {
+				t.Errorf("request id = %q, want incoming %q", seen, tt.incoming)
+			}
+
+			if !tt.wantSame && seen == tt.incoming {
+				t.Errorf("expected a generated id, got incoming %q", seen)
+			}
+		})
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(NewLogHandler(slog.NewJSONHandler(buf, nil))).With("service", "test")
+
+	logger.InfoContext(NewContext(context.Background(), "req-42"), "hello")
+	if !strings.Contains(buf.String(), `"request_id":"req-42"`) {
+		t.Errorf("log output = %s, want request_id attribute", buf.String())
+	}
+
+	buf.Reset()
+	logger.InfoContext(context.Background(), "hello")
+	if strings.Contains(buf.String(), "request_id") {
+		t.Errorf("log output = %s, did not expect request_id attribute", buf.String())
+	}
+}
+
+func TestLogHandlerWithGroups(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(NewLogHandler(slog.NewJSONHandler(buf, nil))).
+		With("service", "test").
+		WithGroup("http").
+		With("method", "GET")
+
+	logger.InfoContext(NewContext(context.Background(), "req-7"), "hello", "status", 200)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["request_id"] != "req-7" || entry["service"] != "test" {
+		t.Errorf("log entry = %v, want request_id and service at the top level", entry)
+	}
+	group, _ := entry["http"].(map[string]any)
+	if group["method"] != "GET" || group["status"] != float64(200) || group["request_id"] != nil {
+		t.Errorf("http group = %v", group)
+	}
+}
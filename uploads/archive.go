@@ -0,0 +1,243 @@
+package uploads
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"mime/multipart"
+	"path"
+	"strings"
+
+	"github.com/ddddami/bindle/fs"
+	"github.com/ddddami/bindle/strutil"
+)
+
+var (
+	ErrUnsupportedArchive = errors.New("unsupported archive format")
+	// ErrUnsafeArchiveEntry is returned for entries that would land outside the extraction
+	// prefix, either by name (zip slip) or through a link
+	ErrUnsafeArchiveEntry = errors.New("unsafe archive entry")
+)
+
+type ExtractOptions struct {
+	// Limits are enforced while extracting, whatever the archive headers claim
+	Limits ArchiveLimits
+	// Flatten stores every entry directly under KeyPrefix instead of recreating the
+	// directories inside the archive
+	Flatten bool
+}
+
+func DefaultExtractOptions() ExtractOptions {
+	return ExtractOptions{
+		Limits: DefaultArchiveLimits(),
+	}
+}
+
+// ExtractArchive unpacks an uploaded zip, tar or tar.gz archive. Every entry goes through
+// the same extension, MIME, size and validator checks as a regular upload, with its name
+// cleaned up by strutil.FormatFilename, and is stored under opts.KeyPrefix. Directories and
+// empty files are skipped, and links are never extracted: links pointing outside the
+// archive fail the extraction, others are skipped.
+//
+// If any entry is rejected, the files extracted so far are removed.
+func ExtractArchive(ctx context.Context, file *multipart.FileHeader, opts *FileUploadOptions, extractOpts ExtractOptions) ([]*SavedFile, error) {
+	if opts == nil {
+		defaultOpts := DefaultOptions()
+		opts = &defaultOpts
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open uploaded file: %w", err)
+	}
+
+	defer src.Close()
+
+	x := &extractor{
+		ctx:    ctx,
+		opts:   opts,
+		budget: newArchiveBudget(extractOpts.Limits, file.Size),
+		flat:   extractOpts.Flatten,
+	}
+
+	head := bufio.NewReaderSize(src, 512)
+	magic, _ := head.Peek(4)
+
+	switch {
+	case archiveFormat(magic) == "zip":
+		err = x.zip(src, file.Size)
+	case archiveFormat(magic) == "gzip":
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(head); err != nil {
+			return nil, fmt.Errorf("invalid gzip file: %w", err)
+		}
+		defer gz.Close()
+
+		expanded := bufio.NewReader(x.budget.reader(gz))
+		if !isTar(expanded) {
+			return nil, fmt.Errorf("%w: gzip file doesn't contain a tar archive", ErrUnsupportedArchive)
+		}
+		err = x.tar(expanded)
+	case isTar(head):
+		err = x.tar(x.budget.reader(head))
+	default:
+		return nil, ErrUnsupportedArchive
+	}
+
+	if err != nil {
+		x.rollback()
+		return nil, err
+	}
+	return x.saved, nil
+}
+
+// extractor saves archive entries and remembers them for rollback
+type extractor struct {
+	ctx    context.Context
+	opts   *FileUploadOptions
+	budget *archiveBudget
+	flat   bool
+	saved  []*SavedFile
+}
+
+func (x *extractor) zip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("invalid zip archive: %w", err)
+	}
+
+	for _, f := range zr.File {
+		if err := x.budget.addFile(); err != nil {
+			return err
+		}
+
+		mode := f.Mode()
+		if mode&iofs.ModeSymlink != 0 {
+			// Zip stores the link target as the entry's content
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("invalid zip entry %q: %w", f.Name, err)
+			}
+			target, err := io.ReadAll(io.LimitReader(rc, 4096))
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("invalid zip entry %q: %w", f.Name, err)
+			}
+			if err := checkLink(f.Name, symlinkTarget(f.Name, string(target))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !mode.IsRegular() || f.UncompressedSize64 == 0 {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("invalid zip entry %q: %w", f.Name, err)
+		}
+		err = x.save(f.Name, int64(f.UncompressedSize64), x.budget.reader(rc))
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid tar archive: %w", err)
+		}
+
+		if err := x.budget.addFile(); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			if err := checkLink(hdr.Name, symlinkTarget(hdr.Name, hdr.Linkname)); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			// Hard link targets are relative to the archive root
+			if err := checkLink(hdr.Name, hdr.Linkname); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if hdr.Size == 0 {
+				continue
+			}
+			if err := x.save(hdr.Name, hdr.Size, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// save stores one archive entry through the regular upload pipeline
+func (x *extractor) save(name string, size int64, r io.Reader) error {
+	if _, err := fs.SafeJoin("", name); err != nil {
+		return fmt.Errorf("%w: %w", ErrUnsafeArchiveEntry, err)
+	}
+	name = strings.ReplaceAll(name, "\\", "/")
+
+	entryOpts := *x.opts
+	if !x.flat && !x.opts.ContentAddressed {
+		// Content-addressed keys don't depend on names, so there's no directory to recreate
+		if dir := path.Dir(path.Clean(name)); dir != "." {
+			segments := strings.Split(dir, "/")
+			for i, segment := range segments {
+				segments[i] = strutil.FormatFilename(segment)
+			}
+			entryOpts.KeyPrefix = path.Join(x.opts.KeyPrefix, path.Join(segments...))
+		}
+	}
+
+	saved, err := saveFile(x.ctx, fileSource{filename: path.Base(name), size: size}, r, &entryOpts)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	saved.OriginalName = name
+	x.saved = append(x.saved, saved)
+	return nil
+}
+
+func (x *extractor) rollback() {
+	ctx := context.WithoutCancel(x.ctx)
+	for _, saved := range x.saved {
+		DeleteSavedFile(ctx, saved, x.opts)
+	}
+}
+
+// symlinkTarget resolves a symlink's target against the directory of the link, leaving
+// absolute targets as they are
+func symlinkTarget(name, target string) string {
+	target = strings.ReplaceAll(target, "\\", "/")
+	if path.IsAbs(target) {
+		return target
+	}
+	return path.Join(path.Dir(strings.ReplaceAll(name, "\\", "/")), target)
+}
+
+// checkLink rejects links whose archive-relative target lies outside the archive
+func checkLink(name, target string) error {
+	if _, err := fs.SafeJoin("", target); err != nil {
+		return fmt.Errorf("%w: %s links to %s", ErrUnsafeArchiveEntry, name, target)
+	}
+	return nil
+}
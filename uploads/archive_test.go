@@ -0,0 +1,149 @@
+package uploads
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+type testEntry struct {
+	name    string
+	content string
+	link    string
+}
+
+func zipEntries(entries ...testEntry) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		content := e.content
+		if e.link != "" {
+			hdr.SetMode(fs.ModeSymlink | 0o777)
+			content = e.link
+		}
+		w, _ := zw.CreateHeader(hdr)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func tarEntries(entries ...testEntry) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		if e.link != "" {
+			tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeSymlink, Linkname: e.link})
+			continue
+		}
+		tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(e.content))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func extractTestOptions(storage Storage) *FileUploadOptions {
+	return &FileUploadOptions{
+		Storage:     storage,
+		KeyPrefix:   "bundles/42",
+		MaxSize:     1 << 20,
+		AllowedExts: []string{"txt", "csv"},
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	entries := []testEntry{
+		{name: "README.txt", content: "read me"},
+		{name: "Q1 Reports/Sales Figures.csv", content: "a,b\n1,2\n"},
+		{name: "empty.txt"},
+		{name: "docs/link.txt", link: "../README.txt"},
+	}
+
+	archives := map[string][]byte{
+		"bundle.zip":    zipEntries(entries...),
+		"bundle.tar":    tarEntries(entries...),
+		"bundle.tar.gz": testGzip(tarEntries(entries...)),
+	}
+
+	for name, archive := range archives {
+		t.Run(name, func(t *testing.T) {
+			storage := NewMemoryStorage()
+			saved, err := ExtractArchive(context.Background(), createTestFileHeader(name, archive), extractTestOptions(storage), DefaultExtractOptions())
+			if err != nil {
+				t.Fatalf("ExtractArchive() error = %v", err)
+			}
+
+			if len(saved) != 2 {
+				t.Fatalf("extracted %d files, want 2", len(saved))
+			}
+
+			want := map[string]string{
+				"bundles/42/readme.txt":                   "README.txt",
+				"bundles/42/q1_reports/sales_figures.csv": "Q1 Reports/Sales Figures.csv",
+			}
+			for _, file := range saved {
+				if want[file.Key] != file.OriginalName {
+					t.Errorf("saved %s from %s, want one of %v", file.Key, file.OriginalName, want)
+				}
+				if _, err := storage.Stat(context.Background(), file.Key); err != nil {
+					t.Errorf("%s not stored: %v", file.Key, err)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractArchiveFlatten(t *testing.T) {
+	storage := NewMemoryStorage()
+	archive := zipEntries(testEntry{name: "a/b/c.txt", content: "deep"})
+
+	saved, err := ExtractArchive(context.Background(), createTestFileHeader("a.zip", archive), extractTestOptions(storage), ExtractOptions{Flatten: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Key != "bundles/42/c.txt" {
+		t.Errorf("saved = %+v, want bundles/42/c.txt", saved)
+	}
+}
+
+func TestExtractArchiveRejects(t *testing.T) {
+	ok := testEntry{name: "ok.txt", content: "fine"}
+
+	tests := []struct {
+		name    string
+		archive []byte
+		limits  ArchiveLimits
+		wantErr error
+	}{
+		{name: "zip slip", archive: zipEntries(ok, testEntry{name: "../../etc/cron.txt", content: "x"}), wantErr: ErrUnsafeArchiveEntry},
+		{name: "tar slip", archive: tarEntries(ok, testEntry{name: "a/../../evil.txt", content: "x"}), wantErr: ErrUnsafeArchiveEntry},
+		{name: "absolute path", archive: tarEntries(ok, testEntry{name: "/etc/evil.txt", content: "x"}), wantErr: ErrUnsafeArchiveEntry},
+		{name: "zip symlink escape", archive: zipEntries(ok, testEntry{name: "link.txt", link: "../../etc/passwd"}), wantErr: ErrUnsafeArchiveEntry},
+		{name: "tar absolute symlink", archive: tarEntries(ok, testEntry{name: "link.txt", link: "/etc/passwd"}), wantErr: ErrUnsafeArchiveEntry},
+		{name: "disallowed entry", archive: zipEntries(ok, testEntry{name: "run.sh", content: "#!/bin/sh"}), wantErr: ErrInvalidFileType},
+		{name: "too many files", archive: zipEntries(ok, ok, ok), limits: ArchiveLimits{MaxFiles: 2}, wantErr: ErrArchiveTooLarge},
+		{name: "expands too far", archive: zipEntries(ok, testEntry{name: "big.txt", content: string(bytes.Repeat([]byte("a"), 200))}), limits: ArchiveLimits{MaxExpandedSize: 100}, wantErr: ErrArchiveTooLarge},
+		{name: "not an archive", archive: []byte("just text"), wantErr: ErrUnsupportedArchive},
+		{name: "plain gzip", archive: testGzip([]byte("just text")), wantErr: ErrUnsupportedArchive},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := NewMemoryStorage()
+			_, err := ExtractArchive(context.Background(), createTestFileHeader("a.zip", tt.archive), extractTestOptions(storage), ExtractOptions{Limits: tt.limits})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ExtractArchive() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if objects, _ := storage.List(context.Background(), ""); len(objects) != 0 {
+				t.Errorf("objects left behind after rollback: %v", objects)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"path"
+	"sort"
+	"strings"
+)
+
+// FileError is the reason one file of a batch was rejected
+type FileError struct {
+	// Index is the file's position in the batch
+	Index    int
+	Filename string
+	Err      error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Filename, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError lists every file of a batch that was rejected. errors.Is and errors.As look
+// through all of them.
+type BatchError struct {
+	// Total is the number of files in the batch
+	Total int
+	Files []*FileError
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Files))
+	for i, f := range e.Files {
+		msgs[i] = f.Error()
+	}
+	return fmt.Sprintf("%d of %d files rejected: %s", len(e.Files), e.Total, strings.Join(msgs, "; "))
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Files))
+	for i, f := range e.Files {
+		errs[i] = f
+	}
+	return errs
+}
+
+func (e *BatchError) add(index int, filename string, err error) {
+	e.Files = append(e.Files, &FileError{Index: index, Filename: filename, Err: err})
+}
+
+type BatchOptions struct {
+	// BestEffort saves every file that passes and reports the others in a BatchError,
+	// instead of saving nothing when any file is rejected
+	BestEffort bool
+}
+
+// SaveFiles saves a batch of uploaded files, all or nothing. Every file is checked before
+// anything is written, then written to a temporary key, and only moved to its final key
+// once the whole batch has been stored. If any file is rejected, nothing is left behind and
+// the returned *BatchError describes each rejected file.
+//
+// With BatchOptions.BestEffort, the files that pass are saved and returned along with a
+// *BatchError for the rest.
+func SaveFiles(ctx context.Context, files []*multipart.FileHeader, opts *FileUploadOptions, batchOpts ...BatchOptions) ([]*SavedFile, error) {
+	if opts == nil {
+		defaultOpts := DefaultOptions()
+		opts = &defaultOpts
+	}
+
+	var batchOpt BatchOptions
+	if len(batchOpts) > 0 {
+		batchOpt = batchOpts[0]
+	}
+
+	batchErr := &BatchError{Total: len(files)}
+	result := func(saved []*SavedFile) ([]*SavedFile, error) {
+		if len(batchErr.Files) == 0 {
+			return saved, nil
+		}
+		sort.Slice(batchErr.Files, func(i, j int) bool { return batchErr.Files[i].Index < batchErr.Files[j].Index })
+		return saved, batchErr
+	}
+
+	// Check every file before anything is written. The checked files stay open, so they're
+	// stored from what was checked rather than checked again.
+	var accepted []int
+	prepared := make(map[int]*preparedFile)
+	for i, file := range files {
+		src, err := openBatchFile(file)
+		if err == nil {
+			defer src.Close()
+			prepared[i], err = prepareFile(formFileSource(file), src, opts)
+		}
+		if err != nil {
+			batchErr.add(i, file.Filename, err)
+			continue
+		}
+		accepted = append(accepted, i)
+	}
+	if len(batchErr.Files) > 0 && !batchOpt.BestEffort {
+		return result(nil)
+	}
+
+	cleanupCtx := context.WithoutCancel(ctx)
+	storage := opts.storage()
+
+	var staged []*SavedFile
+	var stagedIndexes []int
+	discard := func() {
+		for _, saved := range staged {
+			DeleteSavedFile(cleanupCtx, saved, opts)
+		}
+	}
+
+	for _, i := range accepted {
+		saved, err := storeFile(ctx, prepared[i], opts, true)
+		if err != nil {
+			batchErr.add(i, files[i].Filename, err)
+			if !batchOpt.BestEffort {
+				discard()
+				return result(nil)
+			}
+			continue
+		}
+		staged = append(staged, saved)
+		stagedIndexes = append(stagedIndexes, i)
+	}
+
+	if opts.ContentAddressed {
+		// Content-addressed files are already under their final key
+		return result(staged)
+	}
+
+	// An all-or-nothing batch keeps the files it overwrites until every file is in place, so
+	// they can be put back when a later one fails
+	commit := &batchCommit{storage: storage, opts: opts, keepReplaced: !batchOpt.BestEffort}
+	for n, saved := range staged {
+		if err := commit.add(ctx, saved); err != nil {
+			batchErr.add(stagedIndexes[n], files[stagedIndexes[n]].Filename, err)
+			DeleteSavedFile(cleanupCtx, saved, opts)
+			if !batchOpt.BestEffort {
+				commit.rollback(cleanupCtx)
+				staged = staged[n+1:]
+				discard()
+				return result(nil)
+			}
+			continue
+		}
+	}
+	commit.finish(cleanupCtx)
+
+	return result(commit.committed)
+}
+
+// openBatchFile opens a file of a batch, rejecting empty ones
+func openBatchFile(file *multipart.FileHeader) (multipart.File, error) {
+	if file.Size == 0 {
+		return nil, ErrEmptyFile
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open uploaded file: %w", err)
+	}
+	return src, nil
+}
+
+// batchCommit moves the staged files of a batch to their final keys
+type batchCommit struct {
+	storage      Storage
+	opts         *FileUploadOptions
+	keepReplaced bool
+
+	committed []*SavedFile
+	// replaced maps the keys of overwritten files to where they were set aside
+	replaced map[string]string
+}
+
+// add moves a staged file to its final key, applying the collision policy
+func (c *batchCommit) add(ctx context.Context, saved *SavedFile) error {
+	key, err := CleanKey(path.Join(c.opts.KeyPrefix, saved.SavedName))
+	if err != nil {
+		return err
+	}
+
+	if c.opts.OnCollision == CollisionOverwrite && c.keepReplaced {
+		if err := c.setAside(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	// Other policies never replace a file, so undoing the batch only deletes its own files
+	placed, err := placeStaged(ctx, c.storage, saved.Key, key, key, c.opts.OnCollision)
+	if err != nil {
+		c.restore(ctx, key)
+		return err
+	}
+	key = placed
+
+	saved.Key = key
+	saved.SavedName = path.Base(key)
+	saved.SavedPath = ""
+	if local, ok := localStorage(c.storage); ok {
+		saved.SavedPath, _ = local.Path(key)
+	}
+	c.committed = append(c.committed, saved)
+	if c.keepReplaced {
+		// The replaced file's markers go in finish, once it's certain not to come back
+		return writeRetention(ctx, c.storage, saved, c.opts)
+	}
+	return recordRetention(ctx, c.storage, saved, c.opts)
+}
+
+// setAside moves the file under key, if any, to a temporary key until the batch is done.
+// Files the batch already put there are its own and aren't kept.
+func (c *batchCommit) setAside(ctx context.Context, key string) error {
+	if _, ok := c.replaced[key]; ok {
+		return nil
+	}
+
+	aside, err := tempKey(c.opts.KeyPrefix, strings.TrimPrefix(path.Ext(key), "."))
+	if err != nil {
+		return err
+	}
+	if err := MoveObject(ctx, c.storage, key, aside); err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to keep the file being replaced: %w", err)
+	}
+
+	if c.replaced == nil {
+		c.replaced = make(map[string]string)
+	}
+	c.replaced[key] = aside
+	return nil
+}
+
+// restore puts back the file set aside from key
+func (c *batchCommit) restore(ctx context.Context, key string) {
+	if aside, ok := c.replaced[key]; ok {
+		if MoveObject(ctx, c.storage, aside, key) == nil {
+			delete(c.replaced, key)
+		}
+	}
+}
+
+// rollback deletes the files committed so far and puts back the files they replaced,
+// along with their retention markers
+func (c *batchCommit) rollback(ctx context.Context) {
+	for _, saved := range c.committed {
+		if c.storage.Delete(ctx, saved.Key) == nil {
+			forgetSavedFile(ctx, c.storage, saved, c.opts, false)
+		}
+	}
+	for key := range c.replaced {
+		c.restore(ctx, key)
+	}
+	c.committed = nil
+}
+
+// finish drops the replaced files and their retention markers once the batch is in place
+func (c *batchCommit) finish(ctx context.Context) {
+	for key, aside := range c.replaced {
+		c.storage.Delete(ctx, aside)
+
+		var keep string
+		for _, saved := range c.committed {
+			if saved.Key == key {
+				keep = saved.RetentionID
+			}
+		}
+		clearRetention(ctx, c.storage, key, keep)
+	}
+}
@@ -0,0 +1,190 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"testing"
+	"time"
+)
+
+func batchTestOptions(storage Storage) *FileUploadOptions {
+	return &FileUploadOptions{
+		Storage:     storage,
+		KeyPrefix:   "docs",
+		MaxSize:     64,
+		AllowedExts: []string{"txt"},
+		OnCollision: CollisionSuffix,
+	}
+}
+
+func TestSaveFilesAllOrNothing(t *testing.T) {
+	storage := NewMemoryStorage()
+	files := []*multipart.FileHeader{
+		createTestFileHeader("a.txt", []byte("first")),
+		createTestFileHeader("b.exe", []byte("MZ")),
+		createTestFileHeader("c.txt", bytes.Repeat([]byte("x"), 100)),
+		createTestFileHeader("d.txt", []byte("fourth")),
+	}
+
+	saved, err := SaveFiles(context.Background(), files, batchTestOptions(storage))
+	if saved != nil {
+		t.Errorf("saved = %v, want nothing", saved)
+	}
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("error = %v, want *BatchError", err)
+	}
+	if batchErr.Total != 4 || len(batchErr.Files) != 2 {
+		t.Fatalf("BatchError = %v, want 2 of 4 rejected", batchErr)
+	}
+	if batchErr.Files[0].Index != 1 || !errors.Is(batchErr.Files[0], ErrInvalidFileType) {
+		t.Errorf("first rejection = %v, want b.exe with ErrInvalidFileType", batchErr.Files[0])
+	}
+	if batchErr.Files[1].Index != 2 || !errors.Is(batchErr.Files[1], ErrFileTooLarge) {
+		t.Errorf("second rejection = %v, want c.txt with ErrFileTooLarge", batchErr.Files[1])
+	}
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Error("errors.Is should see through the BatchError")
+	}
+
+	if objects, _ := storage.List(context.Background(), ""); len(objects) != 0 {
+		t.Errorf("objects stored for a rejected batch: %v", objects)
+	}
+}
+
+func TestSaveFilesCommit(t *testing.T) {
+	storage := NewMemoryStorage()
+	opts := batchTestOptions(storage)
+	ctx := context.Background()
+
+	SaveUploadedFile(createTestFileHeader("a.txt", []byte("existing")), opts)
+
+	files := []*multipart.FileHeader{
+		createTestFileHeader("a.txt", []byte("first")),
+		createTestFileHeader("a.txt", []byte("second")),
+		createTestFileHeader("b.txt", []byte("third")),
+	}
+
+	saved, err := SaveFiles(ctx, files, opts)
+	if err != nil {
+		t.Fatalf("SaveFiles() error = %v", err)
+	}
+
+	want := []string{"docs/a_1.txt", "docs/a_2.txt", "docs/b.txt"}
+	for i, file := range saved {
+		if file.Key != want[i] || file.SavedName != want[i][len("docs/"):] {
+			t.Errorf("file %d saved as %s (%s), want %s", i, file.Key, file.SavedName, want[i])
+		}
+	}
+
+	objects, _ := storage.List(ctx, "")
+	if len(objects) != 4 {
+		t.Errorf("stored objects = %v, want the existing file and 3 new ones without staging leftovers", objects)
+	}
+}
+
+// failingMoveStorage fails moves onto failKey, like a storage error halfway through a batch
+type failingMoveStorage struct {
+	*MemoryStorage
+	failKey string
+}
+
+func (s failingMoveStorage) Move(ctx context.Context, srcKey, dstKey string) error {
+	if dstKey == s.failKey {
+		return errors.New("storage unavailable")
+	}
+	return s.MemoryStorage.Move(ctx, srcKey, dstKey)
+}
+
+func TestSaveFilesRollbackRestoresOverwritten(t *testing.T) {
+	ctx := context.Background()
+	storage := failingMoveStorage{MemoryStorage: NewMemoryStorage(), failKey: "docs/b.txt"}
+	opts := batchTestOptions(storage)
+	opts.OnCollision = CollisionOverwrite
+
+	temporary := *opts
+	temporary.TTL = time.Hour
+	if _, err := SaveUploadedFile(createTestFileHeader("a.txt", []byte("existing")), &temporary); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []*multipart.FileHeader{
+		createTestFileHeader("a.txt", []byte("replacement")),
+		createTestFileHeader("b.txt", []byte("second")),
+	}
+	if saved, err := SaveFiles(ctx, files, opts); err == nil || saved != nil {
+		t.Fatalf("SaveFiles() = %v, %v, want the batch to fail", saved, err)
+	}
+
+	rc, _, err := storage.Get(ctx, "docs/a.txt")
+	if err != nil {
+		t.Fatalf("overwritten file lost: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "existing" {
+		t.Errorf("docs/a.txt = %q, want the file from before the batch", data)
+	}
+
+	if objects, _ := storage.List(ctx, "docs/"); len(objects) != 1 {
+		t.Errorf("stored objects = %v, want only the restored file", objects)
+	}
+	if markers, _ := storage.List(ctx, retentionPrefix+"/"); len(markers) != 1 {
+		t.Errorf("retention markers = %v, want the restored file's", markers)
+	}
+
+	// Once the batch succeeds, the replaced file is gone
+	storage.failKey = ""
+	opts.Storage = storage
+	if _, err := SaveFiles(ctx, files, opts); err != nil {
+		t.Fatal(err)
+	}
+	if objects, _ := storage.List(ctx, ""); len(objects) != 2 {
+		t.Errorf("stored objects = %v, want a.txt and b.txt without the replaced file's marker", objects)
+	}
+}
+
+func TestSaveFilesBestEffort(t *testing.T) {
+	storage := NewMemoryStorage()
+	files := []*multipart.FileHeader{
+		createTestFileHeader("a.txt", []byte("first")),
+		createTestFileHeader("b.exe", []byte("MZ")),
+		createTestFileHeader("c.txt", []byte("third")),
+	}
+
+	saved, err := SaveFiles(context.Background(), files, batchTestOptions(storage), BatchOptions{BestEffort: true})
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Files) != 1 || batchErr.Files[0].Filename != "b.exe" {
+		t.Fatalf("error = %v, want b.exe rejected", err)
+	}
+
+	if len(saved) != 2 || saved[0].Key != "docs/a.txt" || saved[1].Key != "docs/c.txt" {
+		t.Errorf("saved = %+v, want a.txt and c.txt", saved)
+	}
+}
+
+func TestSaveMultipleFormFiles(t *testing.T) {
+	req := newMultipartRequest(
+		testPart{field: "files", filename: "a.txt", content: []byte("first")},
+		testPart{field: "files", filename: "b.exe", content: []byte("MZ")},
+	)
+	storage := NewMemoryStorage()
+
+	saved, err := SaveMultipleFormFiles(req, "files", batchTestOptions(storage))
+	if err == nil || saved != nil {
+		t.Fatalf("SaveMultipleFormFiles() = %v, %v, want an error and nothing saved", saved, err)
+	}
+	if StatusForError(err) != 415 {
+		t.Errorf("StatusForError() = %d, want 415", StatusForError(err))
+	}
+
+	req = newMultipartRequest(testPart{field: "files", filename: "a.txt", content: []byte("first")})
+	if saved, err := SaveMultipleFormFiles(req, "files", batchTestOptions(storage)); err != nil || len(saved) != 1 {
+		t.Errorf("SaveMultipleFormFiles() = %v, %v", saved, err)
+	}
+}
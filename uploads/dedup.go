@@ -0,0 +1,313 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ddddami/bindle/random"
+)
+
+// ErrRefCounterRequired is returned when content-addressed files are kept in a storage other
+// servers may share, such as S3, without a RefCounter set
+var ErrRefCounterRequired = errors.New("content-addressed uploads to shared storage need a RefCounter")
+
+// RefCounter tracks how many saved uploads share one content-addressed object
+type RefCounter interface {
+	// Acquire adds a reference to key and returns the new count
+	Acquire(ctx context.Context, key string) (int64, error)
+	// Release drops a reference to key and returns the remaining count
+	Release(ctx context.Context, key string) (int64, error)
+}
+
+// ContentLocker is implemented by RefCounters shared between processes, for example with a
+// database row lock. Lock holds key in every process until the returned function is called,
+// so content isn't deleted while another server deduplicates against it. RefCounters
+// without it only lock keys within the process.
+type ContentLocker interface {
+	Lock(ctx context.Context, key string) (unlock func(), err error)
+}
+
+// MemoryRefCounter keeps reference counts in memory. Counts are lost on restart.
+type MemoryRefCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func NewMemoryRefCounter() *MemoryRefCounter {
+	return &MemoryRefCounter{counts: make(map[string]int64)}
+}
+
+func (c *MemoryRefCounter) Acquire(ctx context.Context, key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts[key]++
+	return c.counts[key], nil
+}
+
+func (c *MemoryRefCounter) Release(ctx context.Context, key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[key] > 0 {
+		c.counts[key]--
+	}
+	n := c.counts[key]
+	if n == 0 {
+		delete(c.counts, key)
+	}
+	return n, nil
+}
+
+// storageRefMu serializes read-modify-write cycles of every StorageRefCounter in the process
+var storageRefMu sync.Mutex
+
+// StorageRefCounter persists reference counts as small objects next to the content, under
+// "<prefix>/<content key>". Updates are serialized within the process only, so don't share
+// the same storage between several processes with it.
+type StorageRefCounter struct {
+	Storage Storage
+	Prefix  string
+}
+
+func NewStorageRefCounter(storage Storage, prefix string) *StorageRefCounter {
+	return &StorageRefCounter{Storage: storage, Prefix: prefix}
+}
+
+func (c *StorageRefCounter) Acquire(ctx context.Context, key string) (int64, error) {
+	return c.add(ctx, key, 1)
+}
+
+func (c *StorageRefCounter) Release(ctx context.Context, key string) (int64, error) {
+	return c.add(ctx, key, -1)
+}
+
+func (c *StorageRefCounter) add(ctx context.Context, key string, delta int64) (int64, error) {
+	storageRefMu.Lock()
+	defer storageRefMu.Unlock()
+
+	refKey := path.Join(c.Prefix, key)
+
+	var count int64
+	rc, _, err := c.Storage.Get(ctx, refKey)
+	switch {
+	case err == nil:
+		data, readErr := io.ReadAll(rc)
+		rc.Close()
+		if readErr != nil {
+			return 0, fmt.Errorf("failed to read reference count: %w", readErr)
+		}
+		if count, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid reference count for %s: %w", key, err)
+		}
+	case !errors.Is(err, ErrObjectNotFound):
+		return 0, err
+	}
+
+	count = max(count+delta, 0)
+	if count == 0 {
+		return 0, c.Storage.Delete(ctx, refKey)
+	}
+
+	data := strconv.FormatInt(count, 10)
+	if _, err := c.Storage.Put(ctx, refKey, strings.NewReader(data), PutOptions{ContentType: "text/plain", Size: int64(len(data))}); err != nil {
+		return 0, fmt.Errorf("failed to write reference count: %w", err)
+	}
+	return count, nil
+}
+
+// refCounter returns the configured RefCounter, defaulting to counts stored in ".refs"
+// next to the content. The default only holds up within one process, so it's limited to
+// local and memory storage.
+func (o *FileUploadOptions) refCounter(storage Storage) (RefCounter, error) {
+	if o.RefCounter != nil {
+		return o.RefCounter, nil
+	}
+	if inner, ok := storage.(*EncryptedStorage); ok {
+		storage = inner.Storage
+	}
+	switch storage.(type) {
+	case *LocalStorage, *MemoryStorage:
+		return NewStorageRefCounter(storage, path.Join(o.KeyPrefix, ".refs")), nil
+	}
+	return nil, ErrRefCounterRequired
+}
+
+// lockContent locks a content key with the RefCounter when it's a ContentLocker, or within
+// the process otherwise
+func lockContent(ctx context.Context, refs RefCounter, key string) (func(), error) {
+	if locker, ok := refs.(ContentLocker); ok {
+		return locker.Lock(ctx, key)
+	}
+	return contentLocks.lock(key), nil
+}
+
+// ContentKey returns the content-addressed key for a SHA-256 hex digest,
+// sharded by the first two bytes: "<prefix>/sha256/ab/cd/abcd….pdf"
+func ContentKey(prefix, digest, ext string) string {
+	name := digest
+	if ext != "" {
+		name += "." + ext
+	}
+	return path.Join(prefix, "sha256", digest[:2], digest[2:4], name)
+}
+
+// tempPrefix holds files staged before they're moved into place, under
+// "<prefix>/<KeyPrefix>/<random name>", so a Sweeper finds leftovers with a single listing
+const tempPrefix = ".tmp"
+
+// tempKey returns a unique key for staging a file before it's moved into place
+func tempKey(prefix, ext string) (string, error) {
+	id, err := random.Generate(random.Options{Length: 16})
+	if err != nil {
+		return "", fmt.Errorf("failed to generate random string: %w", err)
+	}
+	if ext != "" {
+		id += "." + ext
+	}
+	return path.Join(tempPrefix, prefix, id), nil
+}
+
+// contentLocks serializes committing and deleting each content key in the process, so a
+// file being deduplicated against isn't deleted in between. RefCounters shared between
+// processes lock keys themselves, see ContentLocker.
+var contentLocks = keyedMutex{locks: make(map[string]*keyedLock)}
+
+// keyedMutex hands out one mutex per key, dropping it once nobody holds or waits for it
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks key and returns the function unlocking it
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	l := m.locks[key]
+	if l == nil {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		m.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// commitContentAddressed moves a staged file to its content key, or drops it when identical
+// content is already stored, and takes a reference on the content.
+func commitContentAddressed(ctx context.Context, storage Storage, stagedKey, digest, ext string, opts *FileUploadOptions) (string, bool, error) {
+	key := ContentKey(opts.KeyPrefix, digest, ext)
+	refs, err := opts.refCounter(storage)
+	if err != nil {
+		return "", false, err
+	}
+	unlock, err := lockContent(ctx, refs, key)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to lock content: %w", err)
+	}
+	defer unlock()
+
+	deduplicated := false
+	_, err = storage.Stat(ctx, key)
+	switch {
+	case err == nil:
+		deduplicated = true
+		if err := storage.Delete(ctx, stagedKey); err != nil {
+			return "", false, err
+		}
+	case errors.Is(err, ErrObjectNotFound):
+		if err := MoveObject(ctx, storage, stagedKey, key); err != nil {
+			return "", false, err
+		}
+	default:
+		return "", false, err
+	}
+
+	if _, err := refs.Acquire(ctx, key); err != nil {
+		return "", false, err
+	}
+	return key, deduplicated, nil
+}
+
+// DeleteSavedFile removes a saved upload and the files derived from it. Content-addressed
+// files are only deleted once the last upload referencing them is gone. With opts.Quota set,
+// the file's size is given back to opts.QuotaOwner.
+func DeleteSavedFile(ctx context.Context, file *SavedFile, opts *FileUploadOptions) error {
+	if opts == nil {
+		defaultOpts := DefaultOptions()
+		opts = &defaultOpts
+	}
+
+	// Derived files are dropped from the list as they go, so a failed delete can be retried
+	for len(file.Derived) > 0 {
+		if err := DeleteSavedFile(ctx, file.Derived[0], opts); err != nil {
+			return err
+		}
+		file.Derived = file.Derived[1:]
+	}
+
+	storage := opts.storage()
+
+	if opts.ContentAddressed && file.Digest != "" {
+		refs, err := opts.refCounter(storage)
+		if err != nil {
+			return err
+		}
+		unlock, err := lockContent(ctx, refs, file.Key)
+		if err != nil {
+			return fmt.Errorf("failed to lock content: %w", err)
+		}
+		defer unlock()
+
+		remaining, err := refs.Release(ctx, file.Key)
+		if err != nil {
+			return err
+		}
+		if remaining > 0 {
+			return forgetSavedFile(ctx, storage, file, opts, false)
+		}
+	}
+
+	if err := storage.Delete(ctx, file.Key); err != nil {
+		return err
+	}
+	return forgetSavedFile(ctx, storage, file, opts, true)
+}
+
+// forgetSavedFile drops the retention marker of a deleted upload and gives back the quota
+// it used. Once the object itself is gone, every marker left for its key is dropped.
+func forgetSavedFile(ctx context.Context, storage Storage, file *SavedFile, opts *FileUploadOptions, deleted bool) error {
+	if deleted {
+		if err := clearRetention(ctx, storage, file.Key); err != nil {
+			return err
+		}
+	} else if file.RetentionID != "" {
+		if err := storage.Delete(ctx, retentionMarkerKey(file.Key, file.RetentionID)); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+	}
+	if opts.Quota == nil || opts.QuotaOwner == "" {
+		return nil
+	}
+	return opts.Quota.Free(ctx, opts.QuotaOwner, file.Size)
+}
@@ -0,0 +1,223 @@
+package uploads
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestContentAddressedDeduplication(t *testing.T) {
+	for name, refs := range map[string]RefCounter{
+		"storage refs": nil,
+		"memory refs":  NewMemoryRefCounter(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			storage := NewMemoryStorage()
+			opts := &FileUploadOptions{
+				Storage:          storage,
+				KeyPrefix:        "docs",
+				MaxSize:          1 << 20,
+				ContentAddressed: true,
+				RefCounter:       refs,
+			}
+
+			content := []byte("%PDF-1.4 same content")
+			sum := sha256.Sum256(content)
+			digest := hex.EncodeToString(sum[:])
+
+			first, err := SaveUploadedFile(createTestFileHeader("a.pdf", content), opts)
+			if err != nil {
+				t.Fatalf("first save: %v", err)
+			}
+			second, err := SaveUploadedFile(createTestFileHeader("b.pdf", content), opts)
+			if err != nil {
+				t.Fatalf("second save: %v", err)
+			}
+
+			wantKey := "docs/sha256/" + digest[:2] + "/" + digest[2:4] + "/" + digest + ".pdf"
+			if first.Key != wantKey || second.Key != wantKey {
+				t.Errorf("keys = %q, %q, want %q", first.Key, second.Key, wantKey)
+			}
+			if first.Digest != digest {
+				t.Errorf("Digest = %q, want %q", first.Digest, digest)
+			}
+			if first.Deduplicated || !second.Deduplicated {
+				t.Errorf("Deduplicated = %v, %v, want false, true", first.Deduplicated, second.Deduplicated)
+			}
+			if second.OriginalName != "b.pdf" {
+				t.Errorf("OriginalName = %q, want b.pdf", second.OriginalName)
+			}
+
+			staged, _ := storage.List(ctx, ".tmp/docs/")
+			if len(staged) != 0 {
+				t.Errorf("staged objects left behind: %v", staged)
+			}
+
+			if err := DeleteSavedFile(ctx, first, opts); err != nil {
+				t.Fatalf("DeleteSavedFile: %v", err)
+			}
+			if _, err := storage.Stat(ctx, wantKey); err != nil {
+				t.Errorf("content deleted while still referenced: %v", err)
+			}
+
+			if err := DeleteSavedFile(ctx, second, opts); err != nil {
+				t.Fatalf("DeleteSavedFile: %v", err)
+			}
+			if _, err := storage.Stat(ctx, wantKey); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("Stat() after last reference = %v, want ErrObjectNotFound", err)
+			}
+
+			if objects, _ := storage.List(ctx, ""); len(objects) != 0 {
+				t.Errorf("objects left behind: %v", objects)
+			}
+		})
+	}
+}
+
+func TestContentAddressedLocalStorage(t *testing.T) {
+	opts := &FileUploadOptions{
+		DestinationDir:   t.TempDir(),
+		MaxSize:          1 << 20,
+		ContentAddressed: true,
+	}
+
+	first, err := SaveUploadedFile(createTestFileHeader("a.png", testPNG(4, 4)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SaveUploadedFile(createTestFileHeader("b.png", testPNG(4, 4)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.SavedPath == "" || first.SavedPath != second.SavedPath {
+		t.Errorf("SavedPath = %q, %q, want the same path", first.SavedPath, second.SavedPath)
+	}
+	if !strings.HasPrefix(first.SavedName, first.Digest) {
+		t.Errorf("SavedName = %q, want it to start with the digest", first.SavedName)
+	}
+}
+
+func TestSavedFileDigest(t *testing.T) {
+	content := []byte("%PDF-1.4 plain")
+	sum := sha256.Sum256(content)
+
+	saved, err := SaveUploadedFile(createTestFileHeader("a.pdf", content), &FileUploadOptions{
+		Storage: NewMemoryStorage(),
+		MaxSize: 1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Digest != hex.EncodeToString(sum[:]) || saved.Deduplicated {
+		t.Errorf("Digest = %q, Deduplicated = %v", saved.Digest, saved.Deduplicated)
+	}
+}
+
+// slowDeleteStorage pauses before deleting content keys, widening the gap between a
+// reference being released and the content going away
+type slowDeleteStorage struct {
+	*MemoryStorage
+}
+
+func (s slowDeleteStorage) Delete(ctx context.Context, key string) error {
+	if strings.HasPrefix(key, "sha256/") {
+		time.Sleep(time.Millisecond)
+	}
+	return s.MemoryStorage.Delete(ctx, key)
+}
+
+func TestContentAddressedConcurrentDelete(t *testing.T) {
+	ctx := context.Background()
+	storage := slowDeleteStorage{NewMemoryStorage()}
+	opts := &FileUploadOptions{
+		Storage:          storage,
+		MaxSize:          1 << 20,
+		ContentAddressed: true,
+		RefCounter:       NewMemoryRefCounter(),
+	}
+	content := []byte("%PDF-1.4 shared content")
+
+	// Saving a copy while the only other one is deleted must leave the new copy readable
+	for i := 0; i < 50; i++ {
+		first, err := SaveUploadedFile(createTestFileHeader("a.pdf", content), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var second *SavedFile
+		var saveErr, deleteErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			second, saveErr = SaveUploadedFile(createTestFileHeader("b.pdf", content), opts)
+		}()
+		go func() {
+			defer wg.Done()
+			deleteErr = DeleteSavedFile(ctx, first, opts)
+		}()
+		wg.Wait()
+		if saveErr != nil || deleteErr != nil {
+			t.Fatalf("save: %v, delete: %v", saveErr, deleteErr)
+		}
+
+		if _, err := storage.Stat(ctx, second.Key); err != nil {
+			t.Fatalf("iteration %d: content deleted under a live reference: %v", i, err)
+		}
+		if err := DeleteSavedFile(ctx, second, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if objects, _ := storage.List(ctx, ""); len(objects) != 0 {
+		t.Errorf("objects left after deleting every copy: %v", objects)
+	}
+}
+
+// lockingRefCounter counts the content locks taken through it, like a RefCounter backed by
+// a database shared between servers
+type lockingRefCounter struct {
+	*MemoryRefCounter
+	mu    sync.Mutex
+	locks int
+}
+
+func (c *lockingRefCounter) Lock(ctx context.Context, key string) (func(), error) {
+	c.mu.Lock()
+	c.locks++
+	return c.mu.Unlock, nil
+}
+
+func TestContentAddressedSharedStorage(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("%PDF-1.4 shared content")
+
+	// slowDeleteStorage stands in for storage other servers may share
+	opts := &FileUploadOptions{Storage: slowDeleteStorage{NewMemoryStorage()}, MaxSize: 1 << 20, ContentAddressed: true}
+	if _, err := SaveUploadedFile(createTestFileHeader("a.pdf", content), opts); !errors.Is(err, ErrRefCounterRequired) {
+		t.Fatalf("save without a RefCounter: err = %v, want ErrRefCounterRequired", err)
+	}
+	if objects, _ := opts.Storage.List(ctx, ""); len(objects) != 0 {
+		t.Errorf("objects written = %v", objects)
+	}
+
+	refs := &lockingRefCounter{MemoryRefCounter: NewMemoryRefCounter()}
+	opts.RefCounter = refs
+	saved, err := SaveUploadedFile(createTestFileHeader("a.pdf", content), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteSavedFile(ctx, saved, opts); err != nil {
+		t.Fatal(err)
+	}
+	if refs.locks != 2 {
+		t.Errorf("content locked %d times through the RefCounter, want 2", refs.locks)
+	}
+}
@@ -0,0 +1,159 @@
+package uploads
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/textproto"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrInvalidDisposition = errors.New("invalid Content-Disposition header")
+
+// ContentDisposition builds a Content-Disposition header value (RFC 6266) for dispositionType,
+// usually "attachment" or "inline". The filename is sent as an ASCII-only filename parameter
+// and, when that had to alter it, in full as a UTF-8 filename* parameter (RFC 5987).
+// Control characters and directories are dropped, so the result is always safe to put in
+// a header.
+func ContentDisposition(dispositionType, filename string) string {
+	filename = cleanFilename(filename)
+	if filename == "" {
+		return dispositionType
+	}
+
+	fallback := asciiFilename(filename)
+	value := dispositionType + `; filename="` + fallback + `"`
+	if fallback != filename {
+		value += "; filename*=UTF-8''" + encodeExtValue(filename)
+	}
+	return value
+}
+
+// ParseContentDisposition returns the disposition type and filename of a Content-Disposition
+// header value, preferring filename* over filename. Browsers escape quotes and line breaks
+// in multipart filenames as %22, %0D and %0A; those are decoded. The filename is reduced to
+// its base name without control characters.
+func ParseContentDisposition(value string) (dispositionType, filename string, err error) {
+	dispositionType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		// Be lenient with headers that only get the parameters wrong
+		dispositionType, filename, ok := parseDispositionLeniently(value)
+		if !ok {
+			return "", "", fmt.Errorf("%w: %v", ErrInvalidDisposition, err)
+		}
+		return dispositionType, cleanFilename(decodeFormFilename(filename)), nil
+	}
+
+	filename = params["filename"]
+	if !strings.Contains(strings.ToLower(value), "filename*") {
+		filename = decodeFormFilename(filename)
+	}
+	return dispositionType, cleanFilename(filename), nil
+}
+
+// partFilename returns the filename of a multipart part from its headers, falling back to
+// what the multipart reader decoded
+func partFilename(header textproto.MIMEHeader, fallback string) string {
+	if _, filename, err := ParseContentDisposition(header.Get("Content-Disposition")); err == nil && filename != "" {
+		return filename
+	}
+	return cleanFilename(fallback)
+}
+
+// parseDispositionLeniently pulls the type and a filename parameter out of a header that
+// mime.ParseMediaType rejected, e.g. because of an unescaped quote inside the filename
+func parseDispositionLeniently(value string) (dispositionType, filename string, ok bool) {
+	dispositionType, rest, _ := strings.Cut(value, ";")
+	dispositionType = strings.ToLower(strings.TrimSpace(dispositionType))
+	if dispositionType == "" || strings.ContainsAny(dispositionType, " \t\"=") {
+		return "", "", false
+	}
+
+	lower := strings.ToLower(rest)
+	i := strings.Index(lower, "filename=")
+	if i < 0 {
+		return dispositionType, "", true
+	}
+
+	filename = strings.TrimSpace(rest[i+len("filename="):])
+	if strings.HasPrefix(filename, `"`) {
+		filename = filename[1:]
+		if end := strings.LastIndex(filename, `"`); end >= 0 {
+			filename = filename[:end]
+		}
+	} else if end := strings.IndexByte(filename, ';'); end >= 0 {
+		filename = filename[:end]
+	}
+	return dispositionType, strings.TrimSpace(filename), true
+}
+
+// decodeFormFilename undoes the escaping browsers apply to multipart filenames
+func decodeFormFilename(filename string) string {
+	return strings.NewReplacer("%22", `"`, "%0D", "\r", "%0d", "\r", "%0A", "\n", "%0a", "\n").Replace(filename)
+}
+
+// cleanFilename drops directories, invalid UTF-8 and control characters
+func cleanFilename(filename string) string {
+	filename = strings.ToValidUTF8(filename, "")
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filename)
+
+	filename = strings.TrimSpace(filename)
+	if filename == "." || filename == ".." {
+		return ""
+	}
+	return filename
+}
+
+// asciiFilename replaces what can't appear safely in a quoted filename parameter.
+// Percent signs are replaced too, as some browsers decode them.
+func asciiFilename(filename string) string {
+	var b strings.Builder
+	for _, r := range filename {
+		switch {
+		case r == '"' || r == '\\' || r == '%':
+			b.WriteByte('_')
+		case r >= utf8.RuneSelf:
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// encodeExtValue percent-encodes everything outside RFC 5987's attr-char
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAttrChar(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xF])
+	}
+	return b.String()
+}
+
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
@@ -0,0 +1,98 @@
+package uploads
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{filename: "report.pdf", want: `attachment; filename="report.pdf"`},
+		{filename: "résumé.pdf", want: `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{filename: "年度报告.pdf", want: `attachment; filename="____.pdf"; filename*=UTF-8''%E5%B9%B4%E5%BA%A6%E6%8A%A5%E5%91%8A.pdf`},
+		{filename: `say "hi".txt`, want: `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{filename: "100%.txt", want: `attachment; filename="100_.txt"; filename*=UTF-8''100%25.txt`},
+		{filename: "evil.txt\r\nSet-Cookie: a=b", want: `attachment; filename="evil.txtSet-Cookie: a=b"`},
+		{filename: "../../etc/passwd", want: `attachment; filename="passwd"`},
+		{filename: "", want: `attachment`},
+	}
+
+	for _, tt := range tests {
+		got := ContentDisposition("attachment", tt.filename)
+		if got != tt.want {
+			t.Errorf("ContentDisposition(%q) = %s, want %s", tt.filename, got, tt.want)
+		}
+
+		if tt.filename == "" {
+			continue
+		}
+		if _, parsed, err := ParseContentDisposition(got); err != nil || parsed != cleanFilename(tt.filename) {
+			t.Errorf("ParseContentDisposition(%s) = %q, %v, want the filename back", got, parsed, err)
+		}
+	}
+}
+
+func TestParseContentDisposition(t *testing.T) {
+	tests := []struct {
+		value    string
+		wantType string
+		wantName string
+		wantErr  bool
+	}{
+		{value: `form-data; name="file"; filename="report.pdf"`, wantType: "form-data", wantName: "report.pdf"},
+		{value: `attachment; filename="fallback.pdf"; filename*=UTF-8''%E2%82%AC%20rates.pdf`, wantType: "attachment", wantName: "€ rates.pdf"},
+		{value: `form-data; name="file"; filename="résumé.pdf"`, wantType: "form-data", wantName: "résumé.pdf"},
+		{value: `form-data; name="file"; filename="say %22hi%22.txt"`, wantType: "form-data", wantName: `say "hi".txt`},
+		{value: `form-data; name="file"; filename="C:\\Users\\dami\\photo.jpg"`, wantType: "form-data", wantName: "photo.jpg"},
+		{value: `form-data; name="file"; filename="bad"quote.txt"`, wantType: "form-data", wantName: `bad"quote.txt`},
+		{value: `inline`, wantType: "inline"},
+		{value: `; filename="x"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		gotType, gotName, err := ParseContentDisposition(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseContentDisposition(%s) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if gotType != tt.wantType || gotName != tt.wantName {
+			t.Errorf("ParseContentDisposition(%s) = %q, %q, want %q, %q", tt.value, gotType, gotName, tt.wantType, tt.wantName)
+		}
+	}
+}
+
+func TestSaveUploadedFileDecodesFilename(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writer := multipart.NewWriter(buf)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="file"; filename="Q1 %22final%22.txt"; filename*=UTF-8''Q1%20%E2%80%9Cfinal%E2%80%9D.txt`)
+	part, _ := writer.CreatePart(header)
+	part.Write([]byte("numbers"))
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", "/", buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	saved, err := SaveSingleFormFile(req, "file", &FileUploadOptions{Storage: NewMemoryStorage(), MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.OriginalName != "Q1 “final”.txt" {
+		t.Errorf("OriginalName = %q, want Q1 “final”.txt", saved.OriginalName)
+	}
+
+	streamed := newMultipartRequest(testPart{field: "file", filename: `say "hi".txt`, content: []byte("hello")})
+	saved, err = StreamSingleFormFile(streamed, "file", &FileUploadOptions{Storage: NewMemoryStorage(), MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.OriginalName != `say "hi".txt` {
+		t.Errorf("streamed OriginalName = %q, want say \"hi\".txt", saved.OriginalName)
+	}
+}
@@ -0,0 +1,285 @@
+// Package imaging turns uploaded images into resized variants. It decodes JPEG, PNG and GIF
+// uploads with the standard library, rotates them upright, strips their metadata by
+// re-encoding them and stores thumbnails next to the original.
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"path"
+	"strings"
+
+	"github.com/ddddami/bindle/uploads"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrInvalidVariant    = errors.New("invalid image variant")
+)
+
+// Variant describes a resized copy of the uploaded image
+type Variant struct {
+	// Name is appended to the original's key: "photo.jpg" gets "photo_thumb.jpg"
+	Name   string
+	Width  int
+	Height int
+	Mode   Mode
+}
+
+type Options struct {
+	Variants []Variant
+	// KeepMetadata stores the original as uploaded. By default JPEG and PNG originals are
+	// rotated upright and re-encoded, which drops EXIF data such as GPS coordinates.
+	KeepMetadata bool
+	// JPEGQuality is used when re-encoding JPEGs (1-100)
+	JPEGQuality int
+	// Limits bounds the image dimensions, checked from the header before the image is decoded
+	Limits uploads.ImageLimits
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Variants:    []Variant{{Name: "thumb", Width: 256, Height: 256, Mode: ModeFill}},
+		JPEGQuality: 85,
+		Limits:      uploads.ImageLimits{MaxPixels: 40_000_000},
+	}
+}
+
+func mergeOptions(defaults Options, customs ...Options) Options {
+	result := defaults
+
+	if len(customs) == 0 {
+		return result
+	}
+
+	custom := customs[0]
+
+	if custom.Variants != nil {
+		result.Variants = custom.Variants
+	}
+
+	result.KeepMetadata = custom.KeepMetadata
+
+	if custom.JPEGQuality > 0 {
+		result.JPEGQuality = custom.JPEGQuality
+	}
+
+	if custom.Limits != (uploads.ImageLimits{}) {
+		result.Limits = custom.Limits
+	}
+
+	return result
+}
+
+// SavedVariant is a stored resized copy of an image
+type SavedVariant struct {
+	Name string
+	Key  string
+	// SavedPath is the filesystem path of the variant, when it was saved to a LocalStorage
+	SavedPath string
+	Width     int
+	Height    int
+	Size      int64
+	MIMEType  string
+}
+
+// Result is the saved original along with its variants
+type Result struct {
+	*uploads.SavedFile
+	// Width and Height are the dimensions of the original after orientation
+	Width    int
+	Height   int
+	Variants []SavedVariant
+}
+
+// Variant returns the saved variant called name, or nil
+func (r *Result) Variant(name string) *SavedVariant {
+	for i := range r.Variants {
+		if r.Variants[i].Name == name {
+			return &r.Variants[i]
+		}
+	}
+	return nil
+}
+
+// SaveImage decodes an uploaded image, saves the original through uploads.SaveReader (so
+// the usual extension, MIME and validator checks apply) and stores every variant next to it.
+// If a variant can't be saved, everything saved so far is removed.
+func SaveImage(ctx context.Context, file *multipart.FileHeader, uploadOpts *uploads.FileUploadOptions, opts ...Options) (*Result, error) {
+	options := mergeOptions(DefaultOptions(), opts...)
+	if uploadOpts == nil {
+		defaultOpts := uploads.DefaultOptions()
+		uploadOpts = &defaultOpts
+	}
+
+	if err := validateVariants(options.Variants); err != nil {
+		return nil, err
+	}
+
+	if file.Size == 0 {
+		return nil, uploads.ErrEmptyFile
+	}
+	if file.Size > uploadOpts.MaxSize {
+		return nil, uploads.ErrFileTooLarge
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open uploaded file: %w", err)
+	}
+
+	defer src.Close()
+
+	data, err := io.ReadAll(io.LimitReader(src, uploadOpts.MaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read uploaded file: %w", err)
+	}
+	if int64(len(data)) > uploadOpts.MaxSize {
+		return nil, uploads.ErrFileTooLarge
+	}
+
+	img, format, err := decode(data, options.Limits)
+	if err != nil {
+		return nil, err
+	}
+
+	img = Orient(img, Orientation(data))
+
+	content := data
+	if !options.KeepMetadata && format != "gif" {
+		// GIFs carry no EXIF data, and re-encoding would drop their animation
+		buf := new(bytes.Buffer)
+		if err := encode(buf, img, format, options.JPEGQuality); err != nil {
+			return nil, err
+		}
+		content = buf.Bytes()
+	}
+
+	saved, err := uploads.SaveReader(ctx, file.Filename, bytes.NewReader(content), uploadOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		SavedFile: saved,
+		Width:     img.Bounds().Dx(),
+		Height:    img.Bounds().Dy(),
+	}
+
+	for _, v := range options.Variants {
+		variant, err := saveVariant(ctx, saved, img, format, v, uploadOpts, options)
+		if err != nil {
+			// The original's Derived list holds the variants saved so far
+			uploads.DeleteSavedFile(context.WithoutCancel(ctx), saved, uploadOpts)
+			return nil, fmt.Errorf("failed to save %s variant: %w", v.Name, err)
+		}
+		result.Variants = append(result.Variants, *variant)
+	}
+
+	return result, nil
+}
+
+// saveVariant saves a resized copy of img through uploads.SaveReader, so it's encrypted,
+// scanned, counted against the quota and expired like the original. It's named after the
+// original but never replaces another file, and is added to the original's Derived files.
+func saveVariant(ctx context.Context, original *uploads.SavedFile, img image.Image, format string, v Variant, uploadOpts *uploads.FileUploadOptions, opts Options) (*SavedVariant, error) {
+	resized := Resize(img, v.Width, v.Height, v.Mode)
+
+	buf := new(bytes.Buffer)
+	if err := encode(buf, resized, format, opts.JPEGQuality); err != nil {
+		return nil, err
+	}
+
+	variantOpts := *uploadOpts
+	variantOpts.FilenamePrefix = ""
+	variantOpts.RandomizeFilename = false
+	if variantOpts.OnCollision != uploads.CollisionRandomize {
+		variantOpts.OnCollision = uploads.CollisionSuffix
+	}
+	// The original was validated, and the variant is made from it
+	variantOpts.Validators = nil
+	variantOpts.Progress = nil
+
+	ext := path.Ext(original.SavedName)
+	name := strings.TrimSuffix(original.SavedName, ext) + "_" + v.Name + ext
+	saved, err := uploads.SaveReader(ctx, name, buf, &variantOpts)
+	if err != nil {
+		return nil, err
+	}
+	original.Derived = append(original.Derived, saved)
+
+	return &SavedVariant{
+		Name:      v.Name,
+		Key:       saved.Key,
+		SavedPath: saved.SavedPath,
+		Width:     resized.Bounds().Dx(),
+		Height:    resized.Bounds().Dy(),
+		Size:      saved.Size,
+		MIMEType:  "image/" + format,
+	}, nil
+}
+
+// decode checks the image header against limits before decoding the whole image
+func decode(data []byte, limits uploads.ImageLimits) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, "", ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read image header: %w", err)
+	}
+
+	if err := limits.Check(config.Width, config.Height); err != nil {
+		return nil, "", err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, format, nil
+}
+
+func encode(w io.Writer, img image.Image, format string, quality int) error {
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "png":
+		err = png.Encode(w, img)
+	case "gif":
+		err = gif.Encode(w, img, nil)
+	default:
+		return ErrUnsupportedFormat
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", format, err)
+	}
+	return nil
+}
+
+func validateVariants(variants []Variant) error {
+	seen := make(map[string]bool, len(variants))
+	for _, v := range variants {
+		switch {
+		case v.Name == "" || strings.ContainsAny(v.Name, "/\\"):
+			return fmt.Errorf("%w: invalid name %q", ErrInvalidVariant, v.Name)
+		case seen[v.Name]:
+			return fmt.Errorf("%w: duplicate name %q", ErrInvalidVariant, v.Name)
+		case v.Width < 0 || v.Height < 0:
+			return fmt.Errorf("%w: %s has a negative size", ErrInvalidVariant, v.Name)
+		case v.Mode < ModeFit || v.Mode > ModeCrop:
+			return fmt.Errorf("%w: %s has unknown mode %d", ErrInvalidVariant, v.Name, v.Mode)
+		}
+		seen[v.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ddddami/bindle/uploads"
+)
+
+func createTestFileHeader(filename string, content []byte) *multipart.FileHeader {
+	buf := new(bytes.Buffer)
+	writer := multipart.NewWriter(buf)
+	part, _ := writer.CreateFormFile("file", filename)
+	part.Write(content)
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", "/", buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	req.ParseMultipartForm(32 << 20)
+	return req.MultipartForm.File["file"][0]
+}
+
+func TestSaveImage(t *testing.T) {
+	ctx := context.Background()
+	storage := uploads.NewMemoryStorage()
+	uploadOpts := &uploads.FileUploadOptions{
+		Storage:   storage,
+		KeyPrefix: "photos",
+		MaxSize:   1 << 20,
+	}
+
+	// A 40x20 photo taken with the camera rotated, so it displays as 20x40
+	data := jpegWithOrientation(t, image.NewRGBA(image.Rect(0, 0, 40, 20)), 6, binary.BigEndian)
+
+	result, err := SaveImage(ctx, createTestFileHeader("holiday.jpg", data), uploadOpts, Options{
+		Variants: []Variant{
+			{Name: "thumb", Width: 10, Height: 10, Mode: ModeFill},
+			{Name: "small", Width: 10, Mode: ModeFit},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SaveImage() error = %v", err)
+	}
+
+	if result.Key != "photos/holiday.jpg" || result.Width != 20 || result.Height != 40 {
+		t.Errorf("original = %s %dx%d, want photos/holiday.jpg 20x40", result.Key, result.Width, result.Height)
+	}
+
+	rc, _, err := storage.Get(ctx, result.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := new(bytes.Buffer)
+	stored.ReadFrom(rc)
+	rc.Close()
+	if bytes.Contains(stored.Bytes(), []byte("Exif")) {
+		t.Error("stored original still carries EXIF data")
+	}
+	if config, _ := jpeg.DecodeConfig(bytes.NewReader(stored.Bytes())); config.Width != 20 || config.Height != 40 {
+		t.Errorf("stored original is %dx%d, want it rotated to 20x40", config.Width, config.Height)
+	}
+
+	thumb := result.Variant("thumb")
+	if thumb == nil || thumb.Key != "photos/holiday_thumb.jpg" || thumb.Width != 10 || thumb.Height != 10 || thumb.MIMEType != "image/jpeg" {
+		t.Errorf("thumb variant = %+v", thumb)
+	}
+	small := result.Variant("small")
+	if small == nil || small.Width != 10 || small.Height != 20 {
+		t.Errorf("small variant = %+v, want 10x20", small)
+	}
+
+	if _, err := storage.Stat(ctx, "photos/holiday_small.jpg"); err != nil {
+		t.Errorf("small variant not stored: %v", err)
+	}
+}
+
+func TestSaveImageVariantsFollowUploadOptions(t *testing.T) {
+	ctx := context.Background()
+	storage := uploads.NewMemoryStorage()
+	keys, _ := uploads.NewStaticKeyProvider("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	quota := uploads.NewMemoryQuotaStore(uploads.QuotaLimits{})
+	uploadOpts := &uploads.FileUploadOptions{
+		Storage:     storage,
+		MaxSize:     1 << 20,
+		OnCollision: uploads.CollisionOverwrite,
+		Encryption:  keys,
+		Quota:       quota,
+		QuotaOwner:  "alice",
+		TTL:         time.Hour,
+	}
+
+	// Another upload already has the name the thumbnail would get
+	pngData := new(bytes.Buffer)
+	png.Encode(pngData, image.NewGray(image.Rect(0, 0, 20, 20)))
+	other, err := uploads.SaveReader(ctx, "a_thumb.png", bytes.NewReader(pngData.Bytes()), &uploads.FileUploadOptions{Storage: storage, MaxSize: 1 << 20, Encryption: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := SaveImage(ctx, createTestFileHeader("a.png", pngData.Bytes()), uploadOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb := result.Variant("thumb")
+	if thumb == nil || thumb.Key == other.Key || len(result.Derived) != 1 {
+		t.Fatalf("thumb = %+v, derived = %v, want it saved next to the other upload", thumb, result.Derived)
+	}
+
+	plain, err := uploads.NewEncryptedStorage(storage, keys).Stat(ctx, thumb.Key)
+	if err != nil || plain.Size != thumb.Size {
+		t.Errorf("thumbnail isn't encrypted: %+v, %v", plain, err)
+	}
+	if usage, _ := quota.Usage(ctx, "alice"); usage.Files != 2 {
+		t.Errorf("quota usage = %+v, want the original and its thumbnail", usage)
+	}
+	if result.Derived[0].ExpiresAt.IsZero() {
+		t.Errorf("thumbnail has no TTL")
+	}
+
+	if err := uploads.DeleteSavedFile(ctx, result.SavedFile, uploadOpts); err != nil {
+		t.Fatal(err)
+	}
+	objects, _ := storage.List(ctx, "")
+	if len(objects) != 1 || objects[0].Key != other.Key {
+		t.Errorf("objects after deleting the original = %v, want only the other upload", objects)
+	}
+	if usage, _ := quota.Usage(ctx, "alice"); usage != (uploads.QuotaUsage{}) {
+		t.Errorf("quota usage after delete = %+v", usage)
+	}
+}
+
+func TestSaveImageKeepMetadata(t *testing.T) {
+	storage := uploads.NewMemoryStorage()
+	data := jpegWithOrientation(t, image.NewRGBA(image.Rect(0, 0, 8, 8)), 3, binary.LittleEndian)
+
+	result, err := SaveImage(context.Background(), createTestFileHeader("a.jpg", data),
+		&uploads.FileUploadOptions{Storage: storage, MaxSize: 1 << 20}, Options{KeepMetadata: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Size != int64(len(data)) {
+		t.Errorf("Size = %d, want the original %d bytes", result.Size, len(data))
+	}
+	if len(result.Variants) != 1 || result.Variants[0].Name != "thumb" {
+		t.Errorf("Variants = %+v, want the default thumb", result.Variants)
+	}
+}
+
+func TestSaveImageRejects(t *testing.T) {
+	pngData := new(bytes.Buffer)
+	png.Encode(pngData, image.NewGray(image.Rect(0, 0, 100, 100)))
+
+	tests := []struct {
+		name     string
+		filename string
+		content  []byte
+		opts     Options
+		wantErr  error
+	}{
+		{name: "not an image", filename: "a.png", content: []byte("plain text"), wantErr: ErrUnsupportedFormat},
+		{name: "too many pixels", filename: "a.png", content: pngData.Bytes(), opts: Options{Limits: uploads.ImageLimits{MaxPixels: 99 * 100}}, wantErr: uploads.ErrImageTooLarge},
+		{name: "too wide", filename: "a.png", content: pngData.Bytes(), opts: Options{Limits: uploads.ImageLimits{MaxWidth: 99}}, wantErr: uploads.ErrImageTooLarge},
+		{name: "disallowed extension", filename: "a.bmp", content: pngData.Bytes(), wantErr: uploads.ErrInvalidFileType},
+		{name: "duplicate variant", filename: "a.png", content: pngData.Bytes(), opts: Options{Variants: []Variant{{Name: "x"}, {Name: "x"}}}, wantErr: ErrInvalidVariant},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := uploads.NewMemoryStorage()
+			uploadOpts := uploads.DefaultOptions()
+			uploadOpts.Storage = storage
+
+			_, err := SaveImage(context.Background(), createTestFileHeader(tt.filename, tt.content), &uploadOpts, tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("SaveImage() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if objects, _ := storage.List(context.Background(), ""); len(objects) != 0 {
+				t.Errorf("objects left behind: %v", objects)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// Orientation returns the EXIF orientation (1-8) of a JPEG, or 1 when the data isn't a
+// JPEG or carries no orientation tag. Only the segments before the image data are read.
+func Orientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xD8 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0xFF {
+			// Markers without a length
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image: metadata comes before this
+			return 1
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return 1
+		}
+
+		if marker == 0xE1 {
+			if o, ok := exifOrientation(data[i+4 : end]); ok {
+				return o
+			}
+		}
+		i = end
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from IFD0 of an APP1 Exif payload
+func exifOrientation(payload []byte) (int, bool) {
+	tiff, ok := bytes.CutPrefix(payload, []byte("Exif\x00\x00"))
+	if !ok || len(tiff) < 8 {
+		return 0, false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+
+	count := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+		// Orientation is tag 0x0112, a SHORT stored inline in the value field
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o >= 1 && o <= 8 {
+				return o, true
+			}
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// Orient rotates and flips img so that it displays upright for the given EXIF orientation
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		// Orientations 5-8 rotate by a quarter turn and swap the sides
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotated 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated 90° counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], src.Pix[src.PixOffset(sx, sy):][:4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,104 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// jpegWithOrientation encodes img as a JPEG carrying an EXIF orientation tag
+func jpegWithOrientation(t *testing.T, img image.Image, orientation int, order binary.ByteOrder) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tiff := new(bytes.Buffer)
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(tiff, order, uint16(42))
+	binary.Write(tiff, order, uint32(8))
+	binary.Write(tiff, order, uint16(1))
+	binary.Write(tiff, order, uint16(0x0112))
+	binary.Write(tiff, order, uint16(3))
+	binary.Write(tiff, order, uint32(1))
+	binary.Write(tiff, order, uint16(orientation))
+	binary.Write(tiff, order, uint16(0))
+	binary.Write(tiff, order, uint32(0))
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+func TestOrientation(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for o := 1; o <= 8; o++ {
+			if got := Orientation(jpegWithOrientation(t, img, o, order)); got != o {
+				t.Errorf("Orientation() = %d, want %d (%v)", got, o, order)
+			}
+		}
+	}
+
+	plain := new(bytes.Buffer)
+	jpeg.Encode(plain, img, nil)
+	if got := Orientation(plain.Bytes()); got != 1 {
+		t.Errorf("Orientation() without EXIF = %d, want 1", got)
+	}
+
+	if got := Orientation([]byte("\x89PNG\r\n\x1a\n")); got != 1 {
+		t.Errorf("Orientation() of a PNG = %d, want 1", got)
+	}
+
+	if got := Orientation([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF}); got != 1 {
+		t.Errorf("Orientation() of truncated data = %d, want 1", got)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 2x1 image: red on the left, blue on the right
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.SetRGBA(0, 0, red)
+	src.SetRGBA(1, 0, blue)
+
+	tests := []struct {
+		orientation int
+		size        image.Point
+		red         image.Point
+	}{
+		{orientation: 1, size: image.Pt(2, 1), red: image.Pt(0, 0)},
+		{orientation: 2, size: image.Pt(2, 1), red: image.Pt(1, 0)},
+		{orientation: 3, size: image.Pt(2, 1), red: image.Pt(1, 0)},
+		{orientation: 4, size: image.Pt(2, 1), red: image.Pt(0, 0)},
+		{orientation: 5, size: image.Pt(1, 2), red: image.Pt(0, 0)},
+		{orientation: 6, size: image.Pt(1, 2), red: image.Pt(0, 0)},
+		{orientation: 7, size: image.Pt(1, 2), red: image.Pt(0, 1)},
+		{orientation: 8, size: image.Pt(1, 2), red: image.Pt(0, 1)},
+	}
+
+	for _, tt := range tests {
+		got := Orient(src, tt.orientation)
+		if size := got.Bounds().Size(); size != tt.size {
+			t.Errorf("orientation %d: size = %v, want %v", tt.orientation, size, tt.size)
+			continue
+		}
+		if c := color.RGBAModel.Convert(got.At(tt.red.X, tt.red.Y)).(color.RGBA); c != red {
+			t.Errorf("orientation %d: pixel %v = %v, want red", tt.orientation, tt.red, c)
+		}
+	}
+}
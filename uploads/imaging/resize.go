@@ -0,0 +1,189 @@
+package imaging
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Mode controls how an image is fitted into a variant's box
+type Mode int
+
+const (
+	// ModeFit scales the image down to fit inside the box, keeping its aspect ratio.
+	// Images that already fit are left at their size.
+	ModeFit Mode = iota
+	// ModeFill scales the image to cover the box and crops the overflow around the centre,
+	// producing exactly Width × Height
+	ModeFill
+	// ModeCrop cuts a Width × Height region out of the centre without scaling
+	ModeCrop
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeFit:
+		return "fit"
+	case ModeFill:
+		return "fill"
+	case ModeCrop:
+		return "crop"
+	default:
+		return "unknown"
+	}
+}
+
+// Resize fits img into a width × height box using mode. For ModeFit, a zero width or
+// height leaves that side unconstrained.
+func Resize(img image.Image, width, height int, mode Mode) *image.RGBA {
+	src := toRGBA(img)
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+
+	switch mode {
+	case ModeFill:
+		width, height = defaultSize(width, height, sw, sh)
+		// Crop the source to the box's aspect ratio, then scale
+		cw, ch := sw, int(math.Round(float64(sw)*float64(height)/float64(width)))
+		if ch > sh {
+			cw, ch = int(math.Round(float64(sh)*float64(width)/float64(height))), sh
+		}
+		return resample(centerCrop(src, max(cw, 1), max(ch, 1)), width, height)
+
+	case ModeCrop:
+		width, height = defaultSize(width, height, sw, sh)
+		cropped := centerCrop(src, min(width, sw), min(height, sh))
+		return toRGBA(cropped)
+
+	default:
+		scale := 1.0
+		if width > 0 {
+			scale = min(scale, float64(width)/float64(sw))
+		}
+		if height > 0 {
+			scale = min(scale, float64(height)/float64(sh))
+		}
+		if scale == 1 {
+			return src
+		}
+		return resample(src, max(int(math.Round(float64(sw)*scale)), 1), max(int(math.Round(float64(sh)*scale)), 1))
+	}
+}
+
+// defaultSize fills in a missing side of the box from the source dimensions
+func defaultSize(width, height, sw, sh int) (int, int) {
+	switch {
+	case width <= 0 && height <= 0:
+		return sw, sh
+	case width <= 0:
+		return max(sw*height/sh, 1), height
+	case height <= 0:
+		return width, max(sh*width/sw, 1)
+	}
+	return width, height
+}
+
+// toRGBA returns img as an *image.RGBA with its origin at (0, 0)
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+func centerCrop(src *image.RGBA, width, height int) *image.RGBA {
+	b := src.Bounds()
+	x := b.Min.X + (b.Dx()-width)/2
+	y := b.Min.Y + (b.Dy()-height)/2
+	return src.SubImage(image.Rect(x, y, x+width, y+height)).(*image.RGBA)
+}
+
+// contribution lists the source pixels that make up one destination pixel
+type contribution struct {
+	start   int
+	weights []float64
+}
+
+// contributions computes box filter weights for scaling srcLen pixels to dstLen: every
+// destination pixel averages the source pixels it covers, weighted by overlap
+func contributions(srcLen, dstLen int) []contribution {
+	scale := float64(srcLen) / float64(dstLen)
+	result := make([]contribution, dstLen)
+
+	for i := range result {
+		lo := float64(i) * scale
+		hi := lo + scale
+		start := int(lo)
+		end := min(int(math.Ceil(hi)), srcLen)
+		if end <= start {
+			end = start + 1
+		}
+
+		weights := make([]float64, end-start)
+		var sum float64
+		for j := range weights {
+			px := float64(start + j)
+			w := math.Min(hi, px+1) - math.Max(lo, px)
+			if w < 0 {
+				w = 0
+			}
+			weights[j] = w
+			sum += w
+		}
+		for j := range weights {
+			weights[j] /= sum
+		}
+
+		result[i] = contribution{start: start, weights: weights}
+	}
+	return result
+}
+
+// resample scales src to width × height with a separable box filter. It works on
+// premultiplied pixels, so transparent edges don't bleed colour.
+func resample(src *image.RGBA, width, height int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	cols := contributions(sw, width)
+	rows := contributions(sh, height)
+
+	// Horizontal pass into a width × sh buffer
+	tmp := make([]float64, width*sh*4)
+	for y := 0; y < sh; y++ {
+		rowOffset := src.PixOffset(b.Min.X, b.Min.Y+y)
+		for x, c := range cols {
+			var r, g, bl, a float64
+			for j, w := range c.weights {
+				i := rowOffset + (c.start+j)*4
+				r += float64(src.Pix[i]) * w
+				g += float64(src.Pix[i+1]) * w
+				bl += float64(src.Pix[i+2]) * w
+				a += float64(src.Pix[i+3]) * w
+			}
+			t := (y*width + x) * 4
+			tmp[t], tmp[t+1], tmp[t+2], tmp[t+3] = r, g, bl, a
+		}
+	}
+
+	// Vertical pass into the destination
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, c := range rows {
+		for x := 0; x < width; x++ {
+			var px [4]float64
+			for j, w := range c.weights {
+				t := ((c.start+j)*width + x) * 4
+				for k := range px {
+					px[k] += tmp[t+k] * w
+				}
+			}
+			d := dst.PixOffset(x, y)
+			for k := range px {
+				dst.Pix[d+k] = uint8(math.Min(math.Round(px[k]), 255))
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,75 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+
+	tests := []struct {
+		name          string
+		width, height int
+		mode          Mode
+		wantW, wantH  int
+	}{
+		{name: "fit", width: 100, height: 100, mode: ModeFit, wantW: 100, wantH: 50},
+		{name: "fit width only", width: 200, mode: ModeFit, wantW: 200, wantH: 100},
+		{name: "fit never enlarges", width: 800, height: 800, mode: ModeFit, wantW: 400, wantH: 200},
+		{name: "fill", width: 100, height: 100, mode: ModeFill, wantW: 100, wantH: 100},
+		{name: "fill wide box", width: 300, height: 50, mode: ModeFill, wantW: 300, wantH: 50},
+		{name: "crop", width: 50, height: 80, mode: ModeCrop, wantW: 50, wantH: 80},
+		{name: "crop larger than image", width: 500, height: 500, mode: ModeCrop, wantW: 400, wantH: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Resize(src, tt.width, tt.height, tt.mode).Bounds()
+			if got.Dx() != tt.wantW || got.Dy() != tt.wantH || got.Min != (image.Point{}) {
+				t.Errorf("Resize() bounds = %v, want %dx%d at the origin", got, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestResizeAveragesPixels(t *testing.T) {
+	// Alternating black and white columns average to grey
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			if x%2 == 0 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	got := Resize(src, 2, 1, ModeFit).RGBAAt(0, 0)
+	if got.R < 126 || got.R > 129 || got.A != 255 {
+		t.Errorf("pixel = %v, want mid grey", got)
+	}
+}
+
+func TestFillKeepsCentre(t *testing.T) {
+	// A wide image with red on the sides and blue in the middle
+	src := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	for x := 0; x < 300; x++ {
+		c := color.RGBA{R: 255, A: 255}
+		if x >= 100 && x < 200 {
+			c = color.RGBA{B: 255, A: 255}
+		}
+		for y := 0; y < 100; y++ {
+			src.SetRGBA(x, y, c)
+		}
+	}
+
+	got := Resize(src, 10, 10, ModeFill)
+	for _, p := range []image.Point{{0, 0}, {9, 9}, {5, 5}} {
+		if c := got.RGBAAt(p.X, p.Y); c.B != 255 || c.R != 0 {
+			t.Errorf("pixel %v = %v, want blue", p, c)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package uploads
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime/multipart"
+	"os"
+)
+
+// ErrArchiveTooLarge is returned when an archive expands beyond its ArchiveLimits
+var ErrArchiveTooLarge = errors.New("archive expands beyond the allowed limits")
+
+// ImageLimits bounds the dimensions of uploaded images. Only the image header is read,
+// so oversized images are rejected before anything decodes them. Zero means no limit.
+type ImageLimits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64
+}
+
+func (ImageLimits) Name() string {
+	return "image-limits"
+}
+
+// Validate rejects JPEG, PNG and GIF images that exceed the limits. Other files are let through.
+func (l ImageLimits) Validate(file *multipart.FileHeader, content Peeker) error {
+	return checkImageHeader(file, content, l.Check)
+}
+
+// Check reports whether an image of the given size is within the limits
+func (l ImageLimits) Check(width, height int) error {
+	switch {
+	case l.MaxWidth > 0 && width > l.MaxWidth:
+		return fmt.Errorf("%w: width %d exceeds %d", ErrImageTooLarge, width, l.MaxWidth)
+	case l.MaxHeight > 0 && height > l.MaxHeight:
+		return fmt.Errorf("%w: height %d exceeds %d", ErrImageTooLarge, height, l.MaxHeight)
+	case l.MaxPixels > 0 && int64(width)*int64(height) > l.MaxPixels:
+		return fmt.Errorf("%w: %dx%d exceeds %d pixels", ErrImageTooLarge, width, height, l.MaxPixels)
+	}
+	return nil
+}
+
+// checkImageHeader decodes the image header and hands its size to check. Headers that don't
+// fit in the peek window (JPEGs with large EXIF blocks) are read from the whole upload when
+// it's available.
+func checkImageHeader(file *multipart.FileHeader, content Peeker, check func(width, height int) error) error {
+	head, _ := content.Peek(peekSize)
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(head))
+	if errors.Is(err, image.ErrFormat) {
+		return nil
+	}
+	if err != nil && len(head) == peekSize {
+		if src, size, done, ok := wholeContent(file, content); ok {
+			defer done()
+			config, _, err = image.DecodeConfig(bufio.NewReader(io.NewSectionReader(src, 0, size)))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read image header: %w", err)
+	}
+
+	return check(config.Width, config.Height)
+}
+
+// ArchiveLimits bounds what a zip or gzip upload expands to. Zero means no limit.
+type ArchiveLimits struct {
+	// MaxExpandedSize is the total uncompressed size of all entries
+	MaxExpandedSize int64
+	// MaxFiles is the number of entries in a zip or tar.gz archive
+	MaxFiles int
+	// MaxRatio is the largest allowed uncompressed/compressed size ratio. It's only
+	// enforced once the expanded size passes 1 MB, so small, very compressible files pass.
+	MaxRatio float64
+}
+
+func DefaultArchiveLimits() ArchiveLimits {
+	return ArchiveLimits{
+		MaxExpandedSize: 1 << 30, // 1 GB
+		MaxFiles:        10000,
+		MaxRatio:        100,
+	}
+}
+
+func (ArchiveLimits) Name() string {
+	return "archive-limits"
+}
+
+// Validate decompresses zip and gzip uploads, without storing anything, and rejects them
+// once they exceed the limits. Other files are let through.
+//
+// Zip archives keep their index at the end, so they're read from the whole upload. The save
+// functions make it available by spooling streamed archives to a temporary file, except with
+// Encryption set, where nothing is written to disk in the clear. Without the whole upload,
+// gzip files are checked from the peek window, which holds the whole file when it's under
+// 64 KB, and archives that can't be checked completely are rejected with
+// ErrUnsupportedArchive rather than let through unchecked. ExtractArchive enforces the
+// limits again while extracting.
+func (l ArchiveLimits) Validate(file *multipart.FileHeader, content Peeker) error {
+	head, _ := content.Peek(4)
+	format := archiveFormat(head)
+	if format == "" {
+		return nil
+	}
+
+	if src, size, done, ok := wholeContent(file, content); ok {
+		defer done()
+		if format == "zip" {
+			return l.checkZip(src, size)
+		}
+		return l.checkGzip(io.NewSectionReader(src, 0, size), size)
+	}
+
+	switch format {
+	case "zip":
+		return fmt.Errorf("%w: zip archives can only be checked when the whole upload is available", ErrUnsupportedArchive)
+
+	case "gzip":
+		// Only the start of the upload is available. Hitting its end isn't an error, but
+		// going over the ratio or size on the way is.
+		peeked, _ := content.Peek(peekSize)
+		err := l.checkGzip(bytes.NewReader(peeked), int64(len(peeked)))
+		if errors.Is(err, ErrArchiveTooLarge) || len(peeked) < peekSize {
+			return err
+		}
+		return fmt.Errorf("%w: gzip file is too large to check when streamed", ErrUnsupportedArchive)
+	}
+	return nil
+}
+
+func (l ArchiveLimits) checkZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("invalid zip archive: %w", err)
+	}
+
+	budget := newArchiveBudget(l, size)
+
+	// The declared sizes are cheap to check but can lie, so every entry is inflated as well
+	var declared uint64
+	for _, f := range zr.File {
+		declared += f.UncompressedSize64
+	}
+	if l.MaxExpandedSize > 0 && declared > uint64(l.MaxExpandedSize) {
+		return fmt.Errorf("%w: declares %d bytes, limit is %d", ErrArchiveTooLarge, declared, l.MaxExpandedSize)
+	}
+
+	for _, f := range zr.File {
+		if err := budget.addFile(); err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("invalid zip entry %q: %w", f.Name, err)
+		}
+		_, err = io.Copy(io.Discard, budget.reader(rc))
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l ArchiveLimits) checkGzip(r io.Reader, size int64) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("invalid gzip file: %w", err)
+	}
+	defer gz.Close()
+
+	budget := newArchiveBudget(l, size)
+	expanded := bufio.NewReader(budget.reader(gz))
+
+	if !isTar(expanded) {
+		_, err := io.Copy(io.Discard, expanded)
+		return err
+	}
+
+	tr := tar.NewReader(expanded)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := budget.addFile(); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveFormat recognises the archive formats ArchiveLimits knows about
+func archiveFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "gzip"
+	}
+	return ""
+}
+
+// isTar reports whether r starts with a ustar header
+func isTar(r *bufio.Reader) bool {
+	head, _ := r.Peek(512)
+	return len(head) == 512 && bytes.HasPrefix(head[257:], []byte("ustar"))
+}
+
+// wholeContent returns the whole upload when it can be read at random, from the Peeker or
+// else from the form file, along with a function releasing it
+func wholeContent(file *multipart.FileHeader, content Peeker) (io.ReaderAt, int64, func(), bool) {
+	if whole, ok := content.(WholeContent); ok {
+		src, size := whole.Content()
+		return src, size, func() {}, true
+	}
+
+	// Headers built for streamed uploads have nothing to open
+	if file == nil || file.Size <= 0 {
+		return nil, 0, nil, false
+	}
+	src, err := file.Open()
+	if err != nil {
+		return nil, 0, nil, false
+	}
+	ra, ok := src.(io.ReaderAt)
+	if !ok {
+		src.Close()
+		return nil, 0, nil, false
+	}
+	return ra, file.Size, func() { src.Close() }, true
+}
+
+// spoolArchive copies a streamed zip or gzip upload to a temporary file when ArchiveLimits
+// will check it, so it can be read whole. Other uploads are returned as they are.
+func spoolArchive(src io.Reader, opts *FileUploadOptions) (io.Reader, func(), error) {
+	if opts.Encryption != nil || !hasArchiveLimits(opts.Validators) {
+		return src, func() {}, nil
+	}
+	if _, _, ok := randomAccess(src); ok {
+		return src, func() {}, nil
+	}
+
+	buffered := bufio.NewReaderSize(src, peekSize)
+	if head, _ := buffered.Peek(4); archiveFormat(head) == "" {
+		return buffered, func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to spool archive: %w", err)
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	// One byte past MaxSize is enough for the save to reject it as too large
+	if _, err := io.Copy(tmp, io.LimitReader(buffered, opts.MaxSize+1)); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to spool archive: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to spool archive: %w", err)
+	}
+	return tmp, cleanup, nil
+}
+
+func hasArchiveLimits(validators []Validator) bool {
+	for _, v := range validators {
+		switch v.(type) {
+		case ArchiveLimits, *ArchiveLimits:
+			return true
+		}
+	}
+	return false
+}
+
+// archiveBudget tracks how much an archive has expanded against its limits
+type archiveBudget struct {
+	limits     ArchiveLimits
+	compressed int64
+	files      int
+	expanded   int64
+}
+
+// ratioFloor is the expanded size below which MaxRatio isn't enforced
+const ratioFloor = 1 << 20
+
+func newArchiveBudget(limits ArchiveLimits, compressed int64) *archiveBudget {
+	return &archiveBudget{limits: limits, compressed: max(compressed, 1)}
+}
+
+func (b *archiveBudget) addFile() error {
+	b.files++
+	if b.limits.MaxFiles > 0 && b.files > b.limits.MaxFiles {
+		return fmt.Errorf("%w: more than %d files", ErrArchiveTooLarge, b.limits.MaxFiles)
+	}
+	return nil
+}
+
+func (b *archiveBudget) add(n int) error {
+	b.expanded += int64(n)
+
+	if b.limits.MaxExpandedSize > 0 && b.expanded > b.limits.MaxExpandedSize {
+		return fmt.Errorf("%w: expands to more than %d bytes", ErrArchiveTooLarge, b.limits.MaxExpandedSize)
+	}
+
+	if b.limits.MaxRatio > 0 && b.expanded > ratioFloor {
+		if ratio := float64(b.expanded) / float64(b.compressed); ratio > b.limits.MaxRatio {
+			return fmt.Errorf("%w: compression ratio exceeds %.0f", ErrArchiveTooLarge, b.limits.MaxRatio)
+		}
+	}
+	return nil
+}
+
+// reader counts what's read from r against the budget
+func (b *archiveBudget) reader(r io.Reader) io.Reader {
+	return &budgetReader{r: r, budget: b}
+}
+
+type budgetReader struct {
+	r      io.Reader
+	budget *archiveBudget
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if budgetErr := r.budget.add(n); budgetErr != nil {
+		return n, budgetErr
+	}
+	return n, err
+}
@@ -0,0 +1,170 @@
+package uploads
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+func testZip(files map[string][]byte) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		w, _ := zw.Create(name)
+		w.Write(content)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func testTarGz(files map[string][]byte) []byte {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write(content)
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func testGzip(content []byte) []byte {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	gz.Write(content)
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestImageLimits(t *testing.T) {
+	fh := &multipart.FileHeader{Filename: "a.png"}
+
+	tests := []struct {
+		name    string
+		limits  ImageLimits
+		wantErr bool
+	}{
+		{name: "within limits", limits: ImageLimits{MaxWidth: 100, MaxHeight: 50, MaxPixels: 5000}},
+		{name: "too wide", limits: ImageLimits{MaxWidth: 99}, wantErr: true},
+		{name: "too tall", limits: ImageLimits{MaxHeight: 49}, wantErr: true},
+		{name: "too many pixels", limits: ImageLimits{MaxPixels: 4999}, wantErr: true},
+		{name: "no limits", limits: ImageLimits{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.Validate(fh, peekerFor(testPNG(100, 50)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrImageTooLarge) {
+				t.Errorf("Validate() error = %v, want ErrImageTooLarge", err)
+			}
+		})
+	}
+
+	if err := (ImageLimits{MaxWidth: 1}).Validate(fh, peekerFor([]byte("not an image"))); err != nil {
+		t.Errorf("non-image: unexpected error %v", err)
+	}
+}
+
+func TestArchiveLimits(t *testing.T) {
+	many := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		many[fmt.Sprintf("doc%d.txt", i)] = []byte("hello")
+	}
+	zeros := make([]byte, 8<<20)
+
+	tests := []struct {
+		name     string
+		filename string
+		content  []byte
+		limits   ArchiveLimits
+		wantErr  bool
+	}{
+		{name: "small zip", filename: "a.zip", content: testZip(map[string][]byte{"a.txt": []byte("hello")}), limits: DefaultArchiveLimits()},
+		{name: "zip with too many files", filename: "a.zip", content: testZip(many), limits: ArchiveLimits{MaxFiles: 10}, wantErr: true},
+		{name: "zip expanding too far", filename: "a.zip", content: testZip(map[string][]byte{"a.bin": zeros}), limits: ArchiveLimits{MaxExpandedSize: 4 << 20}, wantErr: true},
+		{name: "zip bomb ratio", filename: "a.zip", content: testZip(map[string][]byte{"a.bin": zeros}), limits: DefaultArchiveLimits(), wantErr: true},
+		{name: "gzip bomb ratio", filename: "a.gz", content: testGzip(zeros), limits: DefaultArchiveLimits(), wantErr: true},
+		{name: "small gzip", filename: "a.gz", content: testGzip([]byte("hello")), limits: DefaultArchiveLimits()},
+		{name: "tar.gz with too many files", filename: "a.tar.gz", content: testTarGz(many), limits: ArchiveLimits{MaxFiles: 10}, wantErr: true},
+		{name: "tar.gz within limits", filename: "a.tar.gz", content: testTarGz(many), limits: DefaultArchiveLimits()},
+		{name: "not an archive", filename: "a.txt", content: []byte("hello"), limits: ArchiveLimits{MaxFiles: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fh := createTestFileHeader(tt.filename, tt.content)
+			err := tt.limits.Validate(fh, peekerFor(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrArchiveTooLarge) {
+				t.Errorf("Validate() error = %v, want ErrArchiveTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestArchiveLimitsStreamed(t *testing.T) {
+	opts := &FileUploadOptions{
+		Storage:          NewMemoryStorage(),
+		MaxSize:          1 << 20,
+		AllowedMimeTypes: []string{"application/x-gzip"},
+		Validators:       []Validator{DefaultArchiveLimits()},
+	}
+
+	// Only the peeked start of a streamed upload can be inspected, which is enough to spot a bomb
+	bomb := testGzip(make([]byte, 64<<20))
+	_, err := SaveReader(context.Background(), "bomb.gz", bytes.NewReader(bomb), opts)
+	if !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("SaveReader() error = %v, want ErrArchiveTooLarge", err)
+	}
+
+	if _, err := SaveReader(context.Background(), "ok.gz", bytes.NewReader(testGzip([]byte("hello"))), opts); err != nil {
+		t.Errorf("SaveReader() unexpected error %v", err)
+	}
+
+	// Streamed archives past the peek window are read whole, from the source when it can be
+	// read at random and from a temporary copy otherwise
+	big := testGzip(randomContent(peekSize * 2))
+	if _, err := SaveReader(context.Background(), "big.gz", bytes.NewReader(big), opts); err != nil {
+		t.Errorf("SaveReader() of a gzip past the peek window: %v", err)
+	}
+	if _, err := SaveReader(context.Background(), "big2.gz", io.MultiReader(bytes.NewReader(big)), opts); err != nil {
+		t.Errorf("SaveReader() of a streamed gzip past the peek window: %v", err)
+	}
+	bigBomb := testTarGz(map[string][]byte{"a.bin": randomContent(peekSize * 2), "b.bin": make([]byte, 64<<20)})
+	if _, err := SaveReader(context.Background(), "bomb.tar.gz", io.MultiReader(bytes.NewReader(bigBomb)), opts); !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("SaveReader() of a streamed bomb past the peek window: error = %v, want ErrArchiveTooLarge", err)
+	}
+
+	zipOpts := *opts
+	zipOpts.AllowedMimeTypes = []string{"application/zip"}
+	zipped := testZip(map[string][]byte{"a.txt": []byte("hello")})
+	if _, err := SaveReader(context.Background(), "a.zip", io.MultiReader(bytes.NewReader(zipped)), &zipOpts); err != nil {
+		t.Errorf("SaveReader() of a streamed zip: %v", err)
+	}
+
+	// With encryption nothing is spooled in the clear, so streamed zips can't be checked
+	keys, err := NewStaticKeyProvider("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipOpts.Encryption = keys
+	_, err = SaveReader(context.Background(), "b.zip", io.MultiReader(bytes.NewReader(zipped)), &zipOpts)
+	if !errors.Is(err, ErrUnsupportedArchive) || StatusForError(err) != http.StatusUnsupportedMediaType {
+		t.Errorf("SaveReader() of an encrypted streamed zip: error = %v, status %d, want ErrUnsupportedArchive", err, StatusForError(err))
+	}
+}
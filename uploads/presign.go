@@ -0,0 +1,383 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddddami/bindle/jsonx"
+	"github.com/ddddami/bindle/random"
+)
+
+var (
+	ErrInvalidUploadToken = errors.New("invalid upload token")
+	ErrUploadTokenExpired = errors.New("upload token has expired")
+	ErrUploadTokenUsed    = errors.New("upload token has already been used")
+)
+
+// uploadTokenDomain keeps upload token signatures apart from download link signatures
+const uploadTokenDomain = "bindle-upload-token:"
+
+// UploadToken is what a presigned upload token allows: one upload within its constraints
+type UploadToken struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"exp"`
+	// KeyID is the ID of the URLSigner key that signed the token
+	KeyID            string   `json:"kid"`
+	MaxSize          int64    `json:"max_size"`
+	AllowedExts      []string `json:"exts,omitempty"`
+	AllowedMimeTypes []string `json:"mime,omitempty"`
+	KeyPrefix        string   `json:"prefix,omitempty"`
+	// Owner is the QuotaOwner the upload is counted against
+	Owner string `json:"owner,omitempty"`
+}
+
+// SignUpload mints a token authorizing a single upload, valid for ttl (an hour when zero),
+// with the MaxSize, AllowedExts, AllowedMimeTypes, KeyPrefix and QuotaOwner of opts baked in
+func (s *URLSigner) SignUpload(opts *FileUploadOptions, ttl time.Duration) (string, *UploadToken, error) {
+	if opts == nil {
+		defaultOpts := DefaultOptions()
+		opts = &defaultOpts
+	}
+	if opts.MaxSize <= 0 {
+		return "", nil, errors.New("upload tokens need a positive MaxSize")
+	}
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+
+	id, err := random.Generate(random.Options{Length: 24})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate token ID: %w", err)
+	}
+
+	s.mu.RLock()
+	kid, secret := s.current, s.keys[s.current]
+	now := s.now()
+	s.mu.RUnlock()
+
+	token := &UploadToken{
+		ID:               id,
+		Expires:          now.Add(ttl).Truncate(time.Second),
+		KeyID:            kid,
+		MaxSize:          opts.MaxSize,
+		AllowedExts:      opts.AllowedExts,
+		AllowedMimeTypes: opts.AllowedMimeTypes,
+		KeyPrefix:        opts.KeyPrefix,
+		Owner:            opts.QuotaOwner,
+	}
+
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	signature := base64.RawURLEncoding.EncodeToString(uploadTokenMAC(secret, encoded))
+	return encoded + "." + signature, token, nil
+}
+
+// VerifyUpload checks a token's signature in constant time and its expiry. It doesn't
+// consume the token; see UploadTokenStore.
+func (s *URLSigner) VerifyUpload(value string) (*UploadToken, error) {
+	encoded, encodedSignature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, ErrInvalidUploadToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidUploadToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, ErrInvalidUploadToken
+	}
+
+	var token UploadToken
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&token); err != nil {
+		return nil, ErrInvalidUploadToken
+	}
+
+	s.mu.RLock()
+	secret, ok := s.keys[token.KeyID]
+	now := s.now()
+	s.mu.RUnlock()
+
+	if !ok || !hmac.Equal(signature, uploadTokenMAC(secret, encoded)) {
+		return nil, ErrInvalidUploadToken
+	}
+
+	if !now.Before(token.Expires) {
+		return nil, ErrUploadTokenExpired
+	}
+	return &token, nil
+}
+
+func uploadTokenMAC(secret []byte, payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(uploadTokenDomain + payload))
+	return h.Sum(nil)
+}
+
+// UploadTokenStore remembers which upload tokens have been used.
+//
+// Consume claims a token ID until expires and returns ErrUploadTokenUsed if it's already
+// claimed. Release gives back a token whose upload was rejected, so it can be retried.
+type UploadTokenStore interface {
+	Consume(ctx context.Context, id string, expires time.Time) error
+	Release(ctx context.Context, id string) error
+}
+
+// MemoryUploadTokenStore is an in-process UploadTokenStore. Used token IDs are forgotten
+// once the tokens expire.
+type MemoryUploadTokenStore struct {
+	mu        sync.Mutex
+	used      map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryUploadTokenStore() *MemoryUploadTokenStore {
+	return &MemoryUploadTokenStore{used: make(map[string]time.Time), now: time.Now}
+}
+
+func (s *MemoryUploadTokenStore) Consume(ctx context.Context, id string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	if _, ok := s.used[id]; ok {
+		return ErrUploadTokenUsed
+	}
+	s.used[id] = expires
+	return nil
+}
+
+func (s *MemoryUploadTokenStore) Release(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.used, id)
+	return nil
+}
+
+// sweep drops expired token IDs, at most once per minute
+func (s *MemoryUploadTokenStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for id, expires := range s.used {
+		if !now.Before(expires) {
+			delete(s.used, id)
+		}
+	}
+}
+
+type PresignedUploadOptions struct {
+	// Upload holds the storage and the remaining upload rules. The token's constraints
+	// replace its MaxSize, AllowedExts, AllowedMimeTypes and KeyPrefix, and the token's
+	// owner its QuotaOwner. Progress is recorded under the token's ID and owner.
+	Upload FileUploadOptions
+	// Tokens records consumed tokens. Defaults to a MemoryUploadTokenStore, which only
+	// works with a single server.
+	Tokens UploadTokenStore
+	// FieldName is the multipart field holding the file in POST requests. Defaults to "file".
+	FieldName string
+	// OnUpload is called after a file has been saved
+	OnUpload func(ctx context.Context, token *UploadToken, file *SavedFile)
+}
+
+// PresignedUploadHandler is an http.Handler accepting uploads authorized by tokens from
+// URLSigner.SignUpload, sent as "Authorization: Bearer <token>" or in a "token" query
+// parameter. A PUT request carries the file as its body, named by its Content-Disposition
+// header or a "filename" query parameter; a POST request carries it as a multipart form.
+//
+// Each token is good for one upload. Rejected uploads give the token back so the client
+// can try again before it expires.
+type PresignedUploadHandler struct {
+	signer *URLSigner
+	opts   PresignedUploadOptions
+}
+
+func NewPresignedUploadHandler(signer *URLSigner, opts PresignedUploadOptions) *PresignedUploadHandler {
+	if opts.Tokens == nil {
+		opts.Tokens = NewMemoryUploadTokenStore()
+	}
+	if opts.FieldName == "" {
+		opts.FieldName = "file"
+	}
+	return &PresignedUploadHandler{signer: signer, opts: opts}
+}
+
+func (h *PresignedUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		signedError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := h.signer.VerifyUpload(uploadTokenFromRequest(r))
+	switch {
+	case errors.Is(err, ErrUploadTokenExpired):
+		signedError(w, err.Error(), http.StatusGone)
+		return
+	case err != nil:
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		signedError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if r.ContentLength > token.MaxSize && r.Method == http.MethodPut {
+		signedError(w, ErrFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := h.opts.Tokens.Consume(r.Context(), token.ID, token.Expires); err != nil {
+		if errors.Is(err, ErrUploadTokenUsed) {
+			signedError(w, err.Error(), http.StatusConflict)
+		} else {
+			signedError(w, "failed to check upload token", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	opts := h.opts.Upload
+	opts.MaxSize = token.MaxSize
+	opts.AllowedExts = token.AllowedExts
+	opts.AllowedMimeTypes = token.AllowedMimeTypes
+	opts.KeyPrefix = token.KeyPrefix
+	if token.Owner != "" {
+		opts.QuotaOwner = token.Owner
+	}
+	// Progress is reported under the token's ID, to the owner the token was signed for
+	opts.UploadID, opts.ProgressOwner = token.ID, opts.QuotaOwner
+
+	saved, err := h.saveReserved(r, &opts)
+	if err != nil {
+		h.opts.Tokens.Release(context.WithoutCancel(r.Context()), token.ID)
+		switch status := StatusForError(err); {
+		case errors.Is(err, errUploadRequest):
+			signedError(w, err.Error(), http.StatusBadRequest)
+		case status == http.StatusInternalServerError:
+			signedError(w, "failed to save file", status)
+		default:
+			signedError(w, err.Error(), status)
+		}
+		return
+	}
+
+	if h.opts.OnUpload != nil {
+		h.opts.OnUpload(r.Context(), token, saved)
+	}
+
+	jsonx.RespondWithSuccess(w, PresignedUploadResponse{
+		Name:     saved.SavedName,
+		Size:     saved.Size,
+		MIMEType: saved.MIMEType,
+		Digest:   saved.Digest,
+	}, nil, jsonx.Options{SuccessStatus: http.StatusCreated})
+}
+
+// PresignedUploadResponse describes a saved file to the token holder. Where and how it's
+// stored stays on the server.
+type PresignedUploadResponse struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	MIMEType string `json:"mime"`
+	Digest   string `json:"digest"`
+}
+
+// saveReserved reserves quota before the body is read, for the declared size of a PUT or
+// the token's MaxSize when it isn't known, and counts the saved file against it
+func (h *PresignedUploadHandler) saveReserved(r *http.Request, opts *FileUploadOptions) (*SavedFile, error) {
+	size := int64(0)
+	if r.Method == http.MethodPut {
+		size = r.ContentLength
+	}
+	quota, err := reserveQuota(r.Context(), opts, size)
+	if err != nil {
+		return nil, err
+	}
+	if quota != nil {
+		opts.Quota = nil
+	}
+
+	saved, err := h.save(r, opts)
+	if err == nil {
+		err = quota.commitSaved(r.Context(), saved, opts)
+	}
+	if err != nil {
+		quota.release(context.WithoutCancel(r.Context()))
+		return nil, err
+	}
+	return saved, nil
+}
+
+// errUploadRequest marks requests that don't carry a usable file
+var errUploadRequest = errors.New("invalid upload request")
+
+func (h *PresignedUploadHandler) save(r *http.Request, opts *FileUploadOptions) (*SavedFile, error) {
+	if r.Method == http.MethodPost {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errUploadRequest, err)
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil, fmt.Errorf("%w: no file in field %q", errUploadRequest, h.opts.FieldName)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errUploadRequest, err)
+			}
+			if part.FormName() == h.opts.FieldName && partFilename(part.Header, part.FileName()) != "" {
+				defer part.Close()
+				return saveFilePart(r.Context(), part, opts)
+			}
+			part.Close()
+		}
+	}
+
+	filename := r.URL.Query().Get("filename")
+	if disposition := r.Header.Get("Content-Disposition"); disposition != "" {
+		if _, name, err := ParseContentDisposition(disposition); err == nil && name != "" {
+			filename = name
+		}
+	}
+	filename = cleanFilename(filename)
+	if filename == "" {
+		return nil, fmt.Errorf("%w: missing filename", errUploadRequest)
+	}
+
+	return saveFile(r.Context(), fileSource{
+		filename: filename,
+		size:     max(r.ContentLength, 0),
+		header:   textproto.MIMEHeader(r.Header),
+	}, r.Body, opts)
+}
+
+// uploadTokenFromRequest reads the token from the Authorization header or the query
+func uploadTokenFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return r.URL.Query().Get("token")
+}
@@ -0,0 +1,272 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newPresignTestHandler(t *testing.T) (*URLSigner, *PresignedUploadHandler, *MemoryStorage) {
+	storage := NewMemoryStorage()
+	signer := newTestSigner(t)
+	h := NewPresignedUploadHandler(signer, PresignedUploadOptions{
+		Upload: FileUploadOptions{Storage: storage, OnCollision: CollisionFail},
+	})
+	return signer, h, storage
+}
+
+func signTestUpload(t *testing.T, signer *URLSigner) string {
+	token, _, err := signer.SignUpload(&FileUploadOptions{
+		MaxSize:          16,
+		AllowedExts:      []string{"txt"},
+		AllowedMimeTypes: []string{"text/plain; charset=utf-8"},
+		KeyPrefix:        "inbox/alice",
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func putUpload(h *PresignedUploadHandler, token, filename, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", "/upload?filename="+filename, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestPresignedUploadPut(t *testing.T) {
+	signer, h, storage := newPresignTestHandler(t)
+	token := signTestUpload(t, signer)
+
+	rr := putUpload(h, token, "notes.txt", "hello")
+	if rr.Code != 201 {
+		t.Fatalf("PUT = %d %s", rr.Code, rr.Body.String())
+	}
+	if _, err := storage.Stat(context.Background(), "inbox/alice/notes.txt"); err != nil {
+		t.Errorf("file not stored under the token's prefix: %v", err)
+	}
+
+	var resp struct {
+		Data map[string]any `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	want := map[string]any{
+		"name":   "notes.txt",
+		"size":   float64(5),
+		"mime":   "text/plain; charset=utf-8",
+		"digest": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}
+	if !reflect.DeepEqual(resp.Data, want) {
+		t.Errorf("response data = %v, want only %v", resp.Data, want)
+	}
+
+	rr = putUpload(h, token, "again.txt", "hello")
+	if rr.Code != 409 {
+		t.Errorf("replayed token = %d, want 409", rr.Code)
+	}
+}
+
+func TestPresignedUploadPost(t *testing.T) {
+	signer, h, storage := newPresignTestHandler(t)
+	token := signTestUpload(t, signer)
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	mw.WriteField("comment", "ignored")
+	fw, _ := mw.CreateFormFile("file", "form.txt")
+	fw.Write([]byte("from a form"))
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/upload?token="+token, body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != 201 {
+		t.Fatalf("POST = %d %s", rr.Code, rr.Body.String())
+	}
+	if _, err := storage.Stat(context.Background(), "inbox/alice/form.txt"); err != nil {
+		t.Errorf("file not stored: %v", err)
+	}
+}
+
+func TestPresignedUploadConstraints(t *testing.T) {
+	signer, h, _ := newPresignTestHandler(t)
+	token := signTestUpload(t, signer)
+
+	tests := []struct {
+		name     string
+		filename string
+		body     string
+		want     int
+	}{
+		{"too large", "big.txt", strings.Repeat("a", 17), 413},
+		{"extension", "page.html", "hello", 415},
+		{"mime type", "fake.txt", "%PDF-1.4 x", 415},
+		{"no filename", "", "hello", 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rr := putUpload(h, token, tt.filename, tt.body); rr.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rr.Code, tt.want, rr.Body.String())
+			}
+		})
+	}
+
+	// Rejected uploads don't use up the token
+	if rr := putUpload(h, token, "ok.txt", "hello"); rr.Code != 201 {
+		t.Errorf("valid upload after rejections = %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPresignedUploadQuota(t *testing.T) {
+	ctx := context.Background()
+	signer := newTestSigner(t)
+	quota := NewMemoryQuotaStore(QuotaLimits{MaxBytes: 8})
+	h := NewPresignedUploadHandler(signer, PresignedUploadOptions{
+		Upload: FileUploadOptions{Storage: NewMemoryStorage(), Quota: quota, QuotaOwner: "alice"},
+	})
+	token := signTestUpload(t, signer)
+
+	// The declared size is reserved, not the token's MaxSize
+	if rr := putUpload(h, token, "notes.txt", "hello"); rr.Code != 201 {
+		t.Fatalf("PUT = %d %s", rr.Code, rr.Body.String())
+	}
+	if usage, _ := quota.Usage(ctx, "alice"); usage != (QuotaUsage{Bytes: 5, Files: 1}) {
+		t.Errorf("usage = %+v, want the file counted once", usage)
+	}
+
+	token = signTestUpload(t, signer)
+	if rr := putUpload(h, token, "more.txt", "hello"); rr.Code != 507 {
+		t.Errorf("PUT past the quota = %d, want 507", rr.Code)
+	}
+	if usage, _ := quota.Usage(ctx, "alice"); usage.ReservedBytes != 0 || usage.ReservedFiles != 0 {
+		t.Errorf("usage = %+v, want nothing left reserved", usage)
+	}
+
+	quota.SetUsage("alice", 0, 0)
+	if rr := putUpload(h, token, "more.txt", "hello"); rr.Code != 201 {
+		t.Errorf("token after a full quota = %d, want it given back", rr.Code)
+	}
+}
+
+func TestPresignedUploadQuotaPerOwner(t *testing.T) {
+	ctx := context.Background()
+	signer := newTestSigner(t)
+	quota := NewMemoryQuotaStore(QuotaLimits{MaxBytes: 8})
+	h := NewPresignedUploadHandler(signer, PresignedUploadOptions{
+		Upload: FileUploadOptions{Storage: NewMemoryStorage(), Quota: quota},
+	})
+	sign := func(owner string) string {
+		token, _, err := signer.SignUpload(&FileUploadOptions{MaxSize: 16, KeyPrefix: owner, QuotaOwner: owner}, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	if rr := putUpload(h, sign("alice"), "a.txt", "hello"); rr.Code != 201 {
+		t.Fatalf("alice's first PUT = %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := putUpload(h, sign("alice"), "b.txt", "hello"); rr.Code != 507 {
+		t.Errorf("alice's second PUT = %d, want 507", rr.Code)
+	}
+	if rr := putUpload(h, sign("bob"), "a.txt", "hello"); rr.Code != 201 {
+		t.Errorf("bob's PUT = %d, want his own quota", rr.Code)
+	}
+
+	for owner, want := range map[string]QuotaUsage{"alice": {Bytes: 5, Files: 1}, "bob": {Bytes: 5, Files: 1}} {
+		if usage, _ := quota.Usage(ctx, owner); usage != want {
+			t.Errorf("%s's usage = %+v, want %+v", owner, usage, want)
+		}
+	}
+}
+
+func TestPresignedUploadRejectsBadTokens(t *testing.T) {
+	signer, h, _ := newPresignTestHandler(t)
+	token := signTestUpload(t, signer)
+
+	payload, signature, _ := strings.Cut(token, ".")
+	forged := payload[:len(payload)-2] + "AA." + signature
+
+	for name, token := range map[string]string{"missing": "", "forged": forged, "garbage": "a.b"} {
+		t.Run(name, func(t *testing.T) {
+			if rr := putUpload(h, token, "a.txt", "hello"); rr.Code != 401 {
+				t.Errorf("status = %d, want 401", rr.Code)
+			}
+		})
+	}
+
+	now := time.Now().Add(2 * time.Minute)
+	signer.now = func() time.Time { return now }
+	if rr := putUpload(h, token, "a.txt", "hello"); rr.Code != 410 {
+		t.Errorf("expired token = %d, want 410", rr.Code)
+	}
+}
+
+func TestPresignedUploadConcurrentReplay(t *testing.T) {
+	signer, h, storage := newPresignTestHandler(t)
+	token := signTestUpload(t, signer)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = putUpload(h, token, "race.txt", "hello").Code
+		}()
+	}
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		if code == 201 {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d uploads succeeded with one token, codes %v", created, codes)
+	}
+
+	keys, _ := storage.List(context.Background(), "inbox/")
+	if len(keys) != 1 {
+		t.Errorf("stored %d files, want 1", len(keys))
+	}
+}
+
+func TestMemoryUploadTokenStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUploadTokenStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	if err := store.Consume(ctx, "t1", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Consume(ctx, "t1", now.Add(time.Minute)); !errors.Is(err, ErrUploadTokenUsed) {
+		t.Errorf("second Consume err = %v", err)
+	}
+
+	store.Release(ctx, "t1")
+	if err := store.Consume(ctx, "t1", now.Add(time.Minute)); err != nil {
+		t.Errorf("Consume after Release: %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	store.Consume(ctx, "t2", now.Add(time.Minute))
+	if _, ok := store.used["t1"]; ok {
+		t.Errorf("expired token ID was not swept")
+	}
+}
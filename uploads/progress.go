@@ -0,0 +1,312 @@
+package uploads
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddddami/bindle/jsonx"
+)
+
+// Progress is a snapshot of an upload being stored
+type Progress struct {
+	ID string `json:"id"`
+	// Files names every file saved under the upload ID so far, in the order they started
+	Files []string `json:"files"`
+	// BytesReceived is how much has been read from the client so far. Forms parsed before
+	// saving, as with SaveUploadedFile, have already arrived by then, so for them it counts
+	// the copy from the parsed form to storage.
+	BytesReceived int64 `json:"bytes_received"`
+	// TotalBytes is the expected size, or zero when the client didn't declare it
+	TotalBytes int64 `json:"total_bytes,omitempty"`
+	// Rate is the average speed since the upload started, in bytes per second
+	Rate float64 `json:"bytes_per_second"`
+	// ETA is the estimated time left, zero when it can't be estimated
+	ETA       time.Duration `json:"-"`
+	StartedAt time.Time     `json:"started_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Done      bool          `json:"done"`
+	// Error is set when the upload failed
+	Error string `json:"error,omitempty"`
+}
+
+// Percent returns how much of the upload has arrived, from 0 to 100, or -1 when the total
+// isn't known
+func (p Progress) Percent() float64 {
+	if p.TotalBytes <= 0 {
+		return -1
+	}
+	return min(float64(p.BytesReceived)/float64(p.TotalBytes)*100, 100)
+}
+
+func (p Progress) MarshalJSON() ([]byte, error) {
+	type progress Progress
+	return json.Marshal(struct {
+		progress
+		Percent    float64 `json:"percent"`
+		ETASeconds float64 `json:"eta_seconds,omitempty"`
+	}{progress(p), p.Percent(), p.ETA.Seconds()})
+}
+
+// ProgressRegistry keeps the progress of uploads by owner and upload ID. Set it as
+// FileUploadOptions.Progress along with a FileUploadOptions.UploadID chosen by the client
+// and the ProgressOwner it belongs to, and poll it with Get or a ProgressHandler. Finished
+// uploads are kept for the registry's TTL so clients can see them complete.
+//
+// Several files saved under the same upload ID, as with StreamFormFiles, add up.
+type ProgressRegistry struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[progressKey]*progressEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// progressKey scopes client-chosen upload IDs to their owner, so clients can't read, or
+// add to, each other's progress
+type progressKey struct {
+	owner string
+	id    string
+}
+
+type progressEntry struct {
+	registry *ProgressRegistry
+	progress Progress
+	active   int
+}
+
+// NewProgressRegistry returns a registry keeping finished uploads for ttl, or five minutes
+// when ttl is zero
+func NewProgressRegistry(ttl time.Duration) *ProgressRegistry {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return &ProgressRegistry{
+		ttl:     ttl,
+		entries: make(map[progressKey]*progressEntry),
+		now:     time.Now,
+	}
+}
+
+// Get returns the current progress of owner's upload id
+func (p *ProgressRegistry) Get(owner, id string) (Progress, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sweep(p.now())
+
+	entry, ok := p.entries[progressKey{owner, id}]
+	if !ok {
+		return Progress{}, false
+	}
+	return entry.snapshot(p.now()), true
+}
+
+// start begins tracking a file saved under owner's upload id. A nil registry or an empty id
+// tracks nothing.
+func (p *ProgressRegistry) start(owner, id, filename string, size int64) *progressEntry {
+	if p == nil || id == "" {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.sweep(now)
+
+	key := progressKey{owner, id}
+	entry, ok := p.entries[key]
+	if !ok || (entry.progress.Done && entry.active == 0) {
+		entry = &progressEntry{registry: p, progress: Progress{ID: id, StartedAt: now}}
+		p.entries[key] = entry
+	}
+
+	entry.active++
+	entry.progress.Files = append(entry.progress.Files, filename)
+	entry.progress.TotalBytes += size
+	entry.progress.UpdatedAt = now
+	entry.progress.Done = false
+	return entry
+}
+
+// sweep drops uploads that finished more than ttl ago, at most once per minute
+func (p *ProgressRegistry) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < time.Minute {
+		return
+	}
+	p.lastSweep = now
+
+	for key, entry := range p.entries {
+		if entry.active == 0 && now.Sub(entry.progress.UpdatedAt) > p.ttl {
+			delete(p.entries, key)
+		}
+	}
+}
+
+// reader counts what's read from r as received
+func (e *progressEntry) reader(r io.Reader) io.Reader {
+	if e == nil {
+		return r
+	}
+	return &progressReader{r: r, entry: e}
+}
+
+func (e *progressEntry) add(n int) {
+	e.registry.mu.Lock()
+	defer e.registry.mu.Unlock()
+
+	e.progress.BytesReceived += int64(n)
+	e.progress.UpdatedAt = e.registry.now()
+}
+
+// finish marks a file as stored, or the upload as failed when err is set
+func (e *progressEntry) finish(err error) {
+	if e == nil {
+		return
+	}
+
+	e.registry.mu.Lock()
+	defer e.registry.mu.Unlock()
+
+	e.active--
+	e.progress.UpdatedAt = e.registry.now()
+	if err != nil {
+		e.progress.Error = err.Error()
+	}
+	e.progress.Done = e.active == 0
+}
+
+func (e *progressEntry) snapshot(now time.Time) Progress {
+	p := e.progress
+	p.Files = slices.Clone(p.Files)
+	end := now
+	if p.Done {
+		end = p.UpdatedAt
+	}
+
+	if elapsed := end.Sub(p.StartedAt).Seconds(); elapsed > 0 {
+		p.Rate = float64(p.BytesReceived) / elapsed
+	}
+	if !p.Done && p.Rate > 0 && p.TotalBytes > p.BytesReceived {
+		p.ETA = time.Duration(float64(p.TotalBytes-p.BytesReceived) / p.Rate * float64(time.Second))
+	}
+	return p
+}
+
+type progressReader struct {
+	r     io.Reader
+	entry *progressEntry
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.entry.add(n)
+	}
+	return n, err
+}
+
+type ProgressHandlerOptions struct {
+	// Interval is how often progress is sent to Server-Sent Events clients. Defaults to
+	// half a second.
+	Interval time.Duration
+	// Owner returns who is asking, such as the session's user ID, matched against the
+	// FileUploadOptions.ProgressOwner uploads were saved with. Without it, only uploads
+	// saved without an owner are reported, to anyone who knows their ID.
+	Owner func(r *http.Request) string
+}
+
+// ProgressHandler reports the progress of the requesting owner's upload named by the "id"
+// query parameter. Plain requests get a jsonx success response with the current Progress.
+// Clients that accept text/event-stream get a "progress" event every interval until the
+// upload is done.
+type ProgressHandler struct {
+	registry *ProgressRegistry
+	opts     ProgressHandlerOptions
+}
+
+func NewProgressHandler(registry *ProgressRegistry, opts ProgressHandlerOptions) *ProgressHandler {
+	if opts.Interval <= 0 {
+		opts.Interval = 500 * time.Millisecond
+	}
+	return &ProgressHandler{registry: registry, opts: opts}
+}
+
+func (h *ProgressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		jsonx.RespondWithError(w, "method not allowed", jsonx.Options{ErrorStatus: http.StatusMethodNotAllowed})
+		return
+	}
+
+	var owner string
+	if h.opts.Owner != nil {
+		owner = h.opts.Owner(r)
+	}
+	id := r.URL.Query().Get("id")
+	progress, ok := h.registry.Get(owner, id)
+	if !ok {
+		jsonx.RespondWithError(w, "upload not found", jsonx.Options{ErrorStatus: http.StatusNotFound})
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		w.Header().Set("Cache-Control", "no-store")
+		jsonx.RespondWithSuccess(w, progress, nil)
+		return
+	}
+
+	// The controller finds Flush through middleware wrappers that implement Unwrap. The
+	// first flush sends the headers, or fails before anything is written.
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := controller.Flush(); err != nil {
+		if errors.Is(err, http.ErrNotSupported) {
+			jsonx.RespondWithError(w, "streaming is not supported", jsonx.Options{ErrorStatus: http.StatusNotAcceptable})
+		}
+		return
+	}
+
+	ticker := time.NewTicker(h.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := writeProgressEvent(w, progress); err != nil {
+			return
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+
+		if progress.Done {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		if progress, ok = h.registry.Get(owner, id); !ok {
+			return
+		}
+	}
+}
+
+func writeProgressEvent(w io.Writer, progress Progress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+	return err
+}
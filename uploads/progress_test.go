@@ -0,0 +1,301 @@
+package uploads
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitForProgress(t *testing.T, registry *ProgressRegistry, id string, done func(Progress) bool) Progress {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if p, ok := registry.Get("", id); ok && done(p) {
+			return p
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	p, _ := registry.Get("", id)
+	t.Fatalf("progress never got there: %+v", p)
+	return p
+}
+
+func TestProgressTracksCopy(t *testing.T) {
+	registry := NewProgressRegistry(0)
+	opts := &FileUploadOptions{
+		Storage:  NewMemoryStorage(),
+		MaxSize:  1 << 20,
+		Progress: registry,
+		UploadID: "up-1",
+	}
+
+	pr, pw := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		_, err := SaveReader(context.Background(), "big.txt", pr, opts)
+		result <- err
+	}()
+
+	pw.Write([]byte(strings.Repeat("a", 1000)))
+	p := waitForProgress(t, registry, "up-1", func(p Progress) bool { return p.BytesReceived == 1000 })
+	if p.Done || len(p.Files) != 1 || p.Files[0] != "big.txt" {
+		t.Errorf("mid-upload progress = %+v", p)
+	}
+
+	pw.Write([]byte(strings.Repeat("b", 500)))
+	pw.Close()
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+
+	p, _ = registry.Get("", "up-1")
+	if !p.Done || p.BytesReceived != 1500 || p.Error != "" {
+		t.Errorf("final progress = %+v", p)
+	}
+}
+
+func TestProgressRecordsFailure(t *testing.T) {
+	registry := NewProgressRegistry(0)
+	opts := &FileUploadOptions{
+		Storage:  NewMemoryStorage(),
+		MaxSize:  1000,
+		Progress: registry,
+		UploadID: "up-2",
+	}
+
+	_, err := SaveReader(context.Background(), "big.txt", strings.NewReader(strings.Repeat("a", 2000)), opts)
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("err = %v", err)
+	}
+
+	p, ok := registry.Get("", "up-2")
+	if !ok || !p.Done || p.Error == "" {
+		t.Errorf("progress = %+v", p)
+	}
+}
+
+func TestProgressSnapshot(t *testing.T) {
+	registry := NewProgressRegistry(time.Minute)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	registry.now = func() time.Time { return now }
+
+	entry := registry.start("", "up", "video.mp4", 1000)
+	now = now.Add(2 * time.Second)
+	entry.add(400)
+
+	p, _ := registry.Get("", "up")
+	if p.Rate != 200 || p.ETA != 3*time.Second || p.Percent() != 40 {
+		t.Errorf("rate = %v, eta = %v, percent = %v", p.Rate, p.ETA, p.Percent())
+	}
+
+	entry.add(600)
+	entry.finish(nil)
+	now = now.Add(30 * time.Second)
+	if p, _ = registry.Get("", "up"); !p.Done || p.ETA != 0 || p.Rate != 500 {
+		t.Errorf("finished progress = %+v", p)
+	}
+
+	// Finished uploads are forgotten after the TTL
+	now = now.Add(2 * time.Minute)
+	if _, ok := registry.Get("", "up"); ok {
+		t.Errorf("finished upload was kept past the TTL")
+	}
+
+	if (Progress{BytesReceived: 10}).Percent() != -1 {
+		t.Errorf("Percent() without a total should be -1")
+	}
+}
+
+func TestProgressHandler(t *testing.T) {
+	registry := NewProgressRegistry(0)
+	entry := registry.start("", "up", "a.txt", 100)
+	entry.add(25)
+
+	h := NewProgressHandler(registry, ProgressHandlerOptions{})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/progress?id=up", nil))
+	if rr.Code != 200 {
+		t.Fatalf("status = %d", rr.Code)
+	}
+
+	var resp struct {
+		Success bool           `json:"success"`
+		Data    map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Success || resp.Data["bytes_received"] != float64(25) || resp.Data["percent"] != float64(25) {
+		t.Errorf("response = %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/progress?id=nope", nil))
+	if rr.Code != 404 {
+		t.Errorf("unknown upload = %d, want 404", rr.Code)
+	}
+}
+
+// unwrappingWriter wraps a ResponseWriter the way logging or capturing middleware does
+type unwrappingWriter struct {
+	http.ResponseWriter
+}
+
+func (w unwrappingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestProgressHandlerEvents(t *testing.T) {
+	registry := NewProgressRegistry(0)
+	entry := registry.start("", "up", "a.txt", 100)
+
+	// Middleware wrapping the writer doesn't get in the way of flushing
+	h := NewProgressHandler(registry, ProgressHandlerOptions{Interval: 10 * time.Millisecond})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(unwrappingWriter{w}, r)
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"?id=up", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+
+	entry.add(100)
+	entry.finish(nil)
+
+	// The stream ends with the event reporting the finished upload
+	var last Progress
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			if err := json.Unmarshal([]byte(data), &last); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !last.Done || last.BytesReceived != 100 {
+		t.Errorf("last event = %+v", last)
+	}
+}
+
+func TestProgressHandlerWithoutFlushing(t *testing.T) {
+	registry := NewProgressRegistry(0)
+	registry.start("", "up", "a.txt", 100)
+	h := NewProgressHandler(registry, ProgressHandlerOptions{})
+
+	req := httptest.NewRequest("GET", "/progress?id=up", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(struct{ http.ResponseWriter }{rr}, req)
+	if rr.Code != http.StatusNotAcceptable {
+		t.Errorf("status = %d, want 406", rr.Code)
+	}
+}
+
+func TestProgressOfTusAndPresignedUploads(t *testing.T) {
+	registry := NewProgressRegistry(0)
+
+	h, _ := newTusTestHandler(t, TusOptions{
+		Upload: FileUploadOptions{Progress: registry},
+		Owner:  func(r *http.Request) string { return r.Header.Get("X-User") },
+	})
+	rr := serveTus(h, tusRequest("POST", "/files/", []byte("hello"), map[string]string{
+		"Upload-Length": "5",
+		"Content-Type":  tusOffsetContentType,
+		"X-User":        "alice",
+	}))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create = %d %s", rr.Code, rr.Body.String())
+	}
+	id := strings.TrimPrefix(rr.Header().Get("Location"), "/files/")
+	if p, ok := registry.Get("alice", id); !ok || !p.Done || p.BytesReceived != 5 {
+		t.Errorf("tus progress = %+v, %v, want it under alice and the upload ID", p, ok)
+	}
+	if _, ok := registry.Get("", id); ok {
+		t.Errorf("tus progress visible without an owner")
+	}
+
+	signer := newTestSigner(t)
+	presigned := NewPresignedUploadHandler(signer, PresignedUploadOptions{
+		Upload: FileUploadOptions{Storage: NewMemoryStorage(), Progress: registry},
+	})
+	token, claims, err := signer.SignUpload(&FileUploadOptions{MaxSize: 16, QuotaOwner: "bob"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := putUpload(presigned, token, "a.txt", "hello"); rr.Code != 201 {
+		t.Fatalf("PUT = %d %s", rr.Code, rr.Body.String())
+	}
+	if p, ok := registry.Get("bob", claims.ID); !ok || !p.Done {
+		t.Errorf("presigned progress = %+v, %v, want it under bob and the token ID", p, ok)
+	}
+}
+
+func TestProgressScopedToOwner(t *testing.T) {
+	registry := NewProgressRegistry(0)
+	opts := &FileUploadOptions{
+		Storage:       NewMemoryStorage(),
+		MaxSize:       1 << 20,
+		Progress:      registry,
+		UploadID:      "up",
+		ProgressOwner: "alice",
+	}
+	if _, err := SaveReader(context.Background(), "a.txt", strings.NewReader("content"), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewProgressHandler(registry, ProgressHandlerOptions{
+		Owner: func(r *http.Request) string { return r.Header.Get("X-User") },
+	})
+	get := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/progress?id=up", nil)
+		req.Header.Set("X-User", user)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := get("mallory"); rr.Code != http.StatusNotFound {
+		t.Errorf("another owner's upload = %d, want 404", rr.Code)
+	}
+	if rr := get(""); rr.Code != http.StatusNotFound {
+		t.Errorf("owned upload without an owner = %d, want 404", rr.Code)
+	}
+	if rr := get("alice"); rr.Code != http.StatusOK {
+		t.Errorf("owner's upload = %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestProgressListsEveryFile(t *testing.T) {
+	registry := NewProgressRegistry(0)
+	first := registry.start("", "up", "a.txt", 10)
+	second := registry.start("", "up", "b.txt", 10)
+	first.add(10)
+	first.finish(nil)
+
+	p, _ := registry.Get("", "up")
+	if strings.Join(p.Files, ",") != "a.txt,b.txt" || p.BytesReceived != 10 || p.TotalBytes != 20 || p.Done {
+		t.Errorf("progress = %+v", p)
+	}
+
+	second.finish(nil)
+	if p, _ = registry.Get("", "up"); !p.Done {
+		t.Errorf("progress after every file finished = %+v", p)
+	}
+}
@@ -0,0 +1,248 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQuotaExceeded is returned when an owner has no room for an upload. StatusForError
+	// maps it to 507 Insufficient Storage, or 413 when the file is larger than the whole quota.
+	ErrQuotaExceeded = errors.New("upload quota exceeded")
+	// ErrUploadRateExceeded is returned when an owner starts more uploads than
+	// QuotaLimits.MaxUploads allows within QuotaLimits.Window
+	ErrUploadRateExceeded = errors.New("too many uploads")
+)
+
+// QuotaError describes an upload rejected by a quota. It matches ErrQuotaExceeded.
+type QuotaError struct {
+	Owner string
+	// Files is set when the file count, rather than the size, is over the limit
+	Files     bool
+	Limit     int64
+	Used      int64
+	Requested int64
+}
+
+func (e *QuotaError) Error() string {
+	unit := "bytes"
+	if e.Files {
+		unit = "files"
+	}
+	return fmt.Sprintf("%v: %s uses %d of %d %s, %d more requested", ErrQuotaExceeded, e.Owner, e.Used, e.Limit, unit, e.Requested)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// TooLarge reports whether the upload couldn't fit even in an empty quota
+func (e *QuotaError) TooLarge() bool {
+	return !e.Files && e.Requested > e.Limit
+}
+
+// QuotaLimits bounds what one owner may store. Zero means no limit.
+type QuotaLimits struct {
+	MaxBytes int64
+	MaxFiles int64
+	// MaxUploads is the number of uploads an owner may start per Window
+	MaxUploads int
+	Window     time.Duration
+}
+
+// QuotaUsage is what an owner has stored, and reserved for uploads in progress
+type QuotaUsage struct {
+	Bytes         int64 `json:"bytes"`
+	Files         int64 `json:"files"`
+	ReservedBytes int64 `json:"reserved_bytes"`
+	ReservedFiles int64 `json:"reserved_files"`
+}
+
+// QuotaStore tracks the bytes and files stored per owner.
+//
+// Reserve sets aside bytes and one file for an upload before it's copied, and returns an
+// error matching ErrQuotaExceeded (or ErrUploadRateExceeded) when the owner has no room.
+// Once the upload is stored, Commit turns the reservation into usage of the actual size;
+// if it fails, Release drops the reservation. Free gives back the space of a deleted file.
+type QuotaStore interface {
+	Reserve(ctx context.Context, owner string, bytes int64) error
+	Commit(ctx context.Context, owner string, reserved, actual int64) error
+	Release(ctx context.Context, owner string, reserved int64) error
+	Free(ctx context.Context, owner string, bytes int64) error
+	Usage(ctx context.Context, owner string) (QuotaUsage, error)
+}
+
+// MemoryQuotaStore is an in-process QuotaStore. Usage is lost on restart, so seed it with
+// SetUsage from your database when that matters.
+type MemoryQuotaStore struct {
+	mu      sync.Mutex
+	limits  QuotaLimits
+	custom  map[string]QuotaLimits
+	usage   map[string]*QuotaUsage
+	uploads map[string][]time.Time
+	now     func() time.Time
+}
+
+// NewMemoryQuotaStore returns a store applying limits to every owner without limits of
+// their own
+func NewMemoryQuotaStore(limits QuotaLimits) *MemoryQuotaStore {
+	return &MemoryQuotaStore{
+		limits:  limits,
+		custom:  make(map[string]QuotaLimits),
+		usage:   make(map[string]*QuotaUsage),
+		uploads: make(map[string][]time.Time),
+		now:     time.Now,
+	}
+}
+
+// SetLimits overrides the limits of one owner
+func (s *MemoryQuotaStore) SetLimits(owner string, limits QuotaLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.custom[owner] = limits
+}
+
+// SetUsage replaces what an owner is known to store, keeping reservations in progress
+func (s *MemoryQuotaStore) SetUsage(owner string, bytes, files int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.owner(owner)
+	usage.Bytes, usage.Files = bytes, files
+}
+
+func (s *MemoryQuotaStore) Reserve(ctx context.Context, owner string, bytes int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limits, ok := s.custom[owner]
+	if !ok {
+		limits = s.limits
+	}
+	usage := s.owner(owner)
+
+	if used := usage.Bytes + usage.ReservedBytes; limits.MaxBytes > 0 && used+bytes > limits.MaxBytes {
+		return &QuotaError{Owner: owner, Limit: limits.MaxBytes, Used: used, Requested: bytes}
+	}
+	if used := usage.Files + usage.ReservedFiles; limits.MaxFiles > 0 && used+1 > limits.MaxFiles {
+		return &QuotaError{Owner: owner, Files: true, Limit: limits.MaxFiles, Used: used, Requested: 1}
+	}
+
+	if limits.MaxUploads > 0 && limits.Window > 0 {
+		now := s.now()
+		recent := s.uploads[owner][:0]
+		for _, started := range s.uploads[owner] {
+			if now.Sub(started) < limits.Window {
+				recent = append(recent, started)
+			}
+		}
+		if len(recent) >= limits.MaxUploads {
+			s.uploads[owner] = recent
+			return fmt.Errorf("%w: %d per %v", ErrUploadRateExceeded, limits.MaxUploads, limits.Window)
+		}
+		s.uploads[owner] = append(recent, now)
+	}
+
+	usage.ReservedBytes += bytes
+	usage.ReservedFiles++
+	return nil
+}
+
+func (s *MemoryQuotaStore) Commit(ctx context.Context, owner string, reserved, actual int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.owner(owner)
+	usage.ReservedBytes = max(usage.ReservedBytes-reserved, 0)
+	usage.ReservedFiles = max(usage.ReservedFiles-1, 0)
+	usage.Bytes += actual
+	usage.Files++
+	return nil
+}
+
+func (s *MemoryQuotaStore) Release(ctx context.Context, owner string, reserved int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.owner(owner)
+	usage.ReservedBytes = max(usage.ReservedBytes-reserved, 0)
+	usage.ReservedFiles = max(usage.ReservedFiles-1, 0)
+	return nil
+}
+
+func (s *MemoryQuotaStore) Free(ctx context.Context, owner string, bytes int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.owner(owner)
+	usage.Bytes = max(usage.Bytes-bytes, 0)
+	usage.Files = max(usage.Files-1, 0)
+	return nil
+}
+
+func (s *MemoryQuotaStore) Usage(ctx context.Context, owner string) (QuotaUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return *s.owner(owner), nil
+}
+
+func (s *MemoryQuotaStore) owner(owner string) *QuotaUsage {
+	usage, ok := s.usage[owner]
+	if !ok {
+		usage = &QuotaUsage{}
+		s.usage[owner] = usage
+	}
+	return usage
+}
+
+// quotaReservation is the space reserved for one upload. A nil reservation tracks nothing.
+type quotaReservation struct {
+	store QuotaStore
+	owner string
+	bytes int64
+}
+
+// reserveQuota reserves room for an upload of size bytes, or MaxSize when the size isn't
+// known yet
+func reserveQuota(ctx context.Context, opts *FileUploadOptions, size int64) (*quotaReservation, error) {
+	if opts.Quota == nil || opts.QuotaOwner == "" {
+		return nil, nil
+	}
+
+	if size <= 0 {
+		size = opts.MaxSize
+	}
+	if err := opts.Quota.Reserve(ctx, opts.QuotaOwner, size); err != nil {
+		return nil, err
+	}
+	return &quotaReservation{store: opts.Quota, owner: opts.QuotaOwner, bytes: size}, nil
+}
+
+func (r *quotaReservation) commit(ctx context.Context, actual int64) error {
+	if r == nil {
+		return nil
+	}
+	return r.store.Commit(ctx, r.owner, r.bytes, actual)
+}
+
+func (r *quotaReservation) release(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	r.store.Release(ctx, r.owner, r.bytes)
+}
+
+// commitSaved counts a file saved without Quota against the reservation made for it. If
+// that fails, the file is deleted; the reservation is left for the caller to release.
+func (r *quotaReservation) commitSaved(ctx context.Context, file *SavedFile, opts *FileUploadOptions) error {
+	if err := r.commit(ctx, file.Size); err != nil {
+		DeleteSavedFile(context.WithoutCancel(ctx), file, opts)
+		return fmt.Errorf("failed to record quota usage: %w", err)
+	}
+	return nil
+}
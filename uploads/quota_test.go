@@ -0,0 +1,145 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryQuotaStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryQuotaStore(QuotaLimits{MaxBytes: 100, MaxFiles: 3})
+
+	if err := store.Reserve(ctx, "alice", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reserve(ctx, "alice", 50); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("reserving past the limit: err = %v", err)
+	}
+
+	// Other owners have their own quota
+	if err := store.Reserve(ctx, "bob", 50); err != nil {
+		t.Errorf("bob: %v", err)
+	}
+
+	store.Commit(ctx, "alice", 60, 40)
+	usage, _ := store.Usage(ctx, "alice")
+	if usage != (QuotaUsage{Bytes: 40, Files: 1}) {
+		t.Errorf("usage after commit = %+v", usage)
+	}
+
+	store.Reserve(ctx, "alice", 60)
+	store.Release(ctx, "alice", 60)
+	store.Reserve(ctx, "alice", 10)
+	store.Commit(ctx, "alice", 10, 10)
+	store.Reserve(ctx, "alice", 10)
+	store.Commit(ctx, "alice", 10, 10)
+
+	err := store.Reserve(ctx, "alice", 1)
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) || !quotaErr.Files {
+		t.Errorf("file count limit: err = %v", err)
+	}
+
+	store.Free(ctx, "alice", 10)
+	if err := store.Reserve(ctx, "alice", 1); err != nil {
+		t.Errorf("reserve after Free: %v", err)
+	}
+
+	store.SetLimits("carol", QuotaLimits{MaxBytes: 10})
+	if err := store.Reserve(ctx, "carol", 50); !errors.As(err, &quotaErr) || !quotaErr.TooLarge() {
+		t.Errorf("custom limits: err = %v", err)
+	}
+}
+
+func TestMemoryQuotaStoreRateLimit(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryQuotaStore(QuotaLimits{MaxUploads: 2, Window: time.Minute})
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	store.Reserve(ctx, "alice", 1)
+	store.Reserve(ctx, "alice", 1)
+	if err := store.Reserve(ctx, "alice", 1); !errors.Is(err, ErrUploadRateExceeded) {
+		t.Errorf("third upload in the window: err = %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := store.Reserve(ctx, "alice", 1); err != nil {
+		t.Errorf("upload after the window: %v", err)
+	}
+}
+
+func TestSaveWithQuota(t *testing.T) {
+	ctx := context.Background()
+	quota := NewMemoryQuotaStore(QuotaLimits{MaxBytes: 20})
+	opts := &FileUploadOptions{
+		Storage:    NewMemoryStorage(),
+		MaxSize:    15,
+		Quota:      quota,
+		QuotaOwner: "alice",
+	}
+
+	// The size of a streamed upload isn't known, so MaxSize is reserved until it's stored
+	saved, err := SaveReader(ctx, "a.txt", strings.NewReader("12345678"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ := quota.Usage(ctx, "alice"); usage != (QuotaUsage{Bytes: 8, Files: 1}) {
+		t.Errorf("usage = %+v", usage)
+	}
+
+	_, err = SaveUploadedFile(createTestFileHeader("b.txt", []byte("0123456789abc")), opts)
+	if !errors.Is(err, ErrQuotaExceeded) || StatusForError(err) != http.StatusInsufficientStorage {
+		t.Errorf("over quota: err = %v, status %d", err, StatusForError(err))
+	}
+
+	small := NewMemoryQuotaStore(QuotaLimits{MaxBytes: 4})
+	tooLarge := *opts
+	tooLarge.Quota = small
+	_, err = SaveUploadedFile(createTestFileHeader("c.txt", []byte("12345")), &tooLarge)
+	if StatusForError(err) != http.StatusRequestEntityTooLarge {
+		t.Errorf("file larger than the whole quota: status %d", StatusForError(err))
+	}
+
+	if err := DeleteSavedFile(ctx, saved, opts); err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ := quota.Usage(ctx, "alice"); usage != (QuotaUsage{}) {
+		t.Errorf("usage after delete = %+v", usage)
+	}
+
+	// Failed uploads give their reservation back
+	if _, err := SaveReader(ctx, "big.txt", strings.NewReader(strings.Repeat("x", 16)), opts); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("err = %v", err)
+	}
+	if usage, _ := quota.Usage(ctx, "alice"); usage != (QuotaUsage{}) {
+		t.Errorf("usage after a failed upload = %+v", usage)
+	}
+}
+
+func TestSaveFilesQuotaRollback(t *testing.T) {
+	ctx := context.Background()
+	quota := NewMemoryQuotaStore(QuotaLimits{MaxFiles: 2})
+	opts := batchTestOptions(NewMemoryStorage())
+	opts.Quota = quota
+	opts.QuotaOwner = "alice"
+
+	files := []*multipart.FileHeader{
+		createTestFileHeader("a.txt", []byte("one")),
+		createTestFileHeader("b.txt", []byte("two")),
+		createTestFileHeader("c.txt", []byte("three")),
+	}
+
+	_, err := SaveFiles(ctx, files, opts)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("err = %v", err)
+	}
+	if usage, _ := quota.Usage(ctx, "alice"); usage != (QuotaUsage{}) {
+		t.Errorf("usage after rollback = %+v", usage)
+	}
+}
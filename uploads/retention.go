@@ -0,0 +1,384 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddddami/bindle/random"
+)
+
+// retentionPrefix holds a marker object for every file saved with a TTL or retention class,
+// under "<prefix>/<key>/<retention ID>.json". Uploads sharing content-addressed content each
+// have their own marker.
+const retentionPrefix = ".retention"
+
+// retentionRecord is the content of a retention marker
+type retentionRecord struct {
+	Key       string    `json:"key"`
+	SavedAt   time.Time `json:"saved_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Class     string    `json:"class,omitempty"`
+	Size      int64     `json:"size"`
+	Digest    string    `json:"digest,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+}
+
+func retentionMarkerKey(key, id string) string {
+	return path.Join(retentionPrefix, key, id) + ".json"
+}
+
+// recordRetention stores the retention marker of a saved file, if its options ask for one.
+// Markers of a file it overwrote are dropped first, so they don't expire the new one.
+func recordRetention(ctx context.Context, storage Storage, saved *SavedFile, opts *FileUploadOptions) error {
+	if !opts.ContentAddressed && opts.OnCollision == CollisionOverwrite {
+		if err := clearRetention(ctx, storage, saved.Key); err != nil {
+			return err
+		}
+	}
+	return writeRetention(ctx, storage, saved, opts)
+}
+
+// writeRetention stores the retention marker of a saved file, if its options ask for one
+func writeRetention(ctx context.Context, storage Storage, saved *SavedFile, opts *FileUploadOptions) error {
+	if opts.TTL <= 0 && opts.RetentionClass == "" {
+		return nil
+	}
+
+	id, err := random.Generate(random.Options{Length: 16})
+	if err != nil {
+		return fmt.Errorf("failed to generate random string: %w", err)
+	}
+
+	record := retentionRecord{
+		Key:     saved.Key,
+		SavedAt: time.Now().UTC(),
+		Class:   opts.RetentionClass,
+		Size:    saved.Size,
+		Digest:  saved.Digest,
+		Owner:   opts.QuotaOwner,
+	}
+	if opts.TTL > 0 {
+		record.ExpiresAt = record.SavedAt.Add(opts.TTL)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := storage.Put(ctx, retentionMarkerKey(saved.Key, id), bytes.NewReader(data), PutOptions{ContentType: "application/json", Size: int64(len(data))}); err != nil {
+		return fmt.Errorf("failed to record retention: %w", err)
+	}
+
+	saved.ExpiresAt = record.ExpiresAt
+	saved.RetentionClass = record.Class
+	saved.RetentionID = id
+	return nil
+}
+
+// clearRetention deletes every retention marker of key except the ones in keep
+func clearRetention(ctx context.Context, storage Storage, key string, keep ...string) error {
+	dir := path.Join(retentionPrefix, key) + "/"
+	markers, err := storage.List(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("failed to list retention markers: %w", err)
+	}
+
+	for _, marker := range markers {
+		// Markers of keys nested under this one, which some storages allow, aren't its own
+		name := strings.TrimPrefix(marker.Key, dir)
+		if strings.Contains(name, "/") || slices.Contains(keep, strings.TrimSuffix(name, ".json")) {
+			continue
+		}
+		if err := storage.Delete(ctx, marker.Key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletion reports a file removed, or one that would be removed in dry-run mode, by a Sweeper
+type Deletion struct {
+	Key    string
+	Reason DeletionReason
+	// Class is the file's retention class, if it has one
+	Class     string
+	SavedAt   time.Time
+	ExpiresAt time.Time
+	Size      int64
+	DryRun    bool
+	// Err is set when the file couldn't be deleted
+	Err error
+}
+
+type DeletionReason string
+
+const (
+	// DeletionExpired is a file past its TTL or retention class
+	DeletionExpired DeletionReason = "expired"
+	// DeletionOrphanedTemp is a temporary file left behind by an interrupted upload
+	DeletionOrphanedTemp DeletionReason = "orphaned temp file"
+)
+
+type SweeperOptions struct {
+	// Upload holds the storage and the options files were saved with, so content-addressed
+	// references and quotas are released as DeleteSavedFile would
+	Upload FileUploadOptions
+	// Interval is the time between sweeps once Start has been called. Defaults to 10 minutes.
+	Interval time.Duration
+	// Classes maps retention classes to how long their files are kept. Files of classes
+	// missing from it are kept.
+	Classes map[string]time.Duration
+	// TempMaxAge is how old temporary files must be before they're treated as leftovers of
+	// interrupted uploads. Defaults to 24 hours.
+	TempMaxAge time.Duration
+	// DryRun reports what would be deleted without deleting anything
+	DryRun bool
+	// OnDelete is called for every file deleted, or that would be in dry-run mode
+	OnDelete func(ctx context.Context, deletion Deletion)
+	// OnError is called when a sweep run by Start fails
+	OnError func(err error)
+}
+
+// Sweeper deletes files saved with FileUploadOptions.TTL or RetentionClass once they
+// expire, and reclaims temporary files left behind by interrupted uploads: keys under ".tmp/"
+// from staged and content-addressed saves, and half-written ".tmp-" files in a LocalStorage.
+type Sweeper struct {
+	opts SweeperOptions
+	now  func() time.Time
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewSweeper(opts SweeperOptions) *Sweeper {
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Minute
+	}
+	if opts.TempMaxAge <= 0 {
+		opts.TempMaxAge = 24 * time.Hour
+	}
+	return &Sweeper{opts: opts, now: time.Now}
+}
+
+// Start sweeps every Interval in a goroutine until Stop is called or ctx is done
+func (s *Sweeper) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		return
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := s.Sweep(ctx); err != nil && ctx.Err() == nil && s.opts.OnError != nil {
+				s.opts.OnError(err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends the goroutine started by Start and waits for the sweep in progress
+func (s *Sweeper) Stop() {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel, s.done = nil, nil
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// Sweep makes a single pass, returning what it deleted, or would delete in dry-run mode.
+// Files that fail to delete are reported with their error and retried on the next pass.
+func (s *Sweeper) Sweep(ctx context.Context) ([]Deletion, error) {
+	storage := s.opts.Upload.storage()
+
+	expired, expiredErr := s.sweepExpired(ctx, storage)
+	if ctx.Err() != nil {
+		return expired, expiredErr
+	}
+
+	temps, err := s.sweepTemp(ctx, storage)
+	return append(expired, temps...), errors.Join(expiredErr, err)
+}
+
+func (s *Sweeper) sweepExpired(ctx context.Context, storage Storage) ([]Deletion, error) {
+	markers, err := storage.List(ctx, retentionPrefix+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list retention markers: %w", err)
+	}
+
+	now := s.now()
+	var deletions []Deletion
+	var firstErr error
+	for _, marker := range markers {
+		if err := ctx.Err(); err != nil {
+			return deletions, err
+		}
+
+		record, err := readRetentionRecord(ctx, storage, marker.Key)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			// Keep going so one bad marker doesn't hold up every other file
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		expiresAt := record.ExpiresAt
+		if ttl, ok := s.opts.Classes[record.Class]; record.Class != "" && ok {
+			if classExpiry := record.SavedAt.Add(ttl); expiresAt.IsZero() || classExpiry.Before(expiresAt) {
+				expiresAt = classExpiry
+			}
+		}
+		if expiresAt.IsZero() || now.Before(expiresAt) {
+			continue
+		}
+
+		deletion := Deletion{
+			Key:       record.Key,
+			Reason:    DeletionExpired,
+			Class:     record.Class,
+			SavedAt:   record.SavedAt,
+			ExpiresAt: expiresAt,
+			Size:      record.Size,
+			DryRun:    s.opts.DryRun,
+		}
+		if !s.opts.DryRun {
+			opts := s.opts.Upload
+			opts.QuotaOwner = record.Owner
+			file := &SavedFile{
+				Key:         record.Key,
+				Size:        record.Size,
+				Digest:      record.Digest,
+				RetentionID: strings.TrimSuffix(path.Base(marker.Key), ".json"),
+			}
+			deletion.Err = DeleteSavedFile(ctx, file, &opts)
+		}
+		deletions = append(deletions, s.report(ctx, deletion))
+	}
+	return deletions, firstErr
+}
+
+func (s *Sweeper) sweepTemp(ctx context.Context, storage Storage) ([]Deletion, error) {
+	objects, err := storage.List(ctx, tempPrefix+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list temporary files: %w", err)
+	}
+
+	cutoff := s.now().Add(-s.opts.TempMaxAge)
+	var deletions []Deletion
+	for _, obj := range objects {
+		if obj.ModTime.After(cutoff) {
+			continue
+		}
+
+		deletion := Deletion{Key: obj.Key, Reason: DeletionOrphanedTemp, SavedAt: obj.ModTime, Size: obj.Size, DryRun: s.opts.DryRun}
+		if !s.opts.DryRun {
+			deletion.Err = storage.Delete(ctx, obj.Key)
+		}
+		deletions = append(deletions, s.report(ctx, deletion))
+	}
+
+	if local, ok := localStorage(storage); ok {
+		localTemps, err := s.sweepLocalTemp(ctx, local, cutoff)
+		deletions = append(deletions, localTemps...)
+		if err != nil {
+			return deletions, err
+		}
+	}
+	return deletions, nil
+}
+
+// sweepLocalTemp removes files a LocalStorage was writing when the process died. List
+// doesn't return them, so they're found by walking the root.
+func (s *Sweeper) sweepLocalTemp(ctx context.Context, storage *LocalStorage, cutoff time.Time) ([]Deletion, error) {
+	var deletions []Deletion
+	err := filepath.WalkDir(storage.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), localTempPrefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil || fi.ModTime().After(cutoff) {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(storage.Root, p)
+		deletion := Deletion{Key: filepath.ToSlash(rel), Reason: DeletionOrphanedTemp, SavedAt: fi.ModTime(), Size: fi.Size(), DryRun: s.opts.DryRun}
+		if !s.opts.DryRun {
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				deletion.Err = err
+			}
+		}
+		deletions = append(deletions, s.report(ctx, deletion))
+		return nil
+	})
+	if err != nil {
+		return deletions, fmt.Errorf("failed to walk %s: %w", storage.Root, err)
+	}
+	return deletions, nil
+}
+
+func (s *Sweeper) report(ctx context.Context, deletion Deletion) Deletion {
+	if s.opts.OnDelete != nil {
+		s.opts.OnDelete(ctx, deletion)
+	}
+	return deletion
+}
+
+func readRetentionRecord(ctx context.Context, storage Storage, key string) (*retentionRecord, error) {
+	r, _, err := storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var record retentionRecord
+	if err := json.NewDecoder(io.LimitReader(r, 64<<10)).Decode(&record); err != nil {
+		return nil, fmt.Errorf("invalid retention marker %s: %w", key, err)
+	}
+	return &record, nil
+}
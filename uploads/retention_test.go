@@ -0,0 +1,338 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSweeperExpiresTTL(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	quota := NewMemoryQuotaStore(QuotaLimits{})
+	opts := &FileUploadOptions{
+		Storage:    storage,
+		KeyPrefix:  "exports",
+		MaxSize:    1024,
+		TTL:        time.Hour,
+		Quota:      quota,
+		QuotaOwner: "alice",
+	}
+
+	saved, err := SaveReader(ctx, "export.csv", strings.NewReader("a,b,c"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.ExpiresAt.IsZero() {
+		t.Errorf("ExpiresAt not set")
+	}
+
+	kept := *opts
+	kept.TTL = 0
+	if _, err := SaveReader(ctx, "keep.csv", strings.NewReader("x,y"), &kept); err != nil {
+		t.Fatal(err)
+	}
+
+	var reported []Deletion
+	sweeper := NewSweeper(SweeperOptions{
+		Upload:   FileUploadOptions{Storage: storage, Quota: quota},
+		DryRun:   true,
+		OnDelete: func(ctx context.Context, d Deletion) { reported = append(reported, d) },
+	})
+
+	if deletions, err := sweeper.Sweep(ctx); err != nil || len(deletions) != 0 {
+		t.Fatalf("fresh files: deletions = %v, err = %v", deletions, err)
+	}
+
+	sweeper.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	deletions, err := sweeper.Sweep(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deletions) != 1 || deletions[0].Key != saved.Key || !deletions[0].DryRun || deletions[0].Reason != DeletionExpired {
+		t.Fatalf("dry run deletions = %+v", deletions)
+	}
+	if _, err := storage.Stat(ctx, saved.Key); err != nil {
+		t.Errorf("dry run deleted the file: %v", err)
+	}
+
+	sweeper.opts.DryRun = false
+	if deletions, err = sweeper.Sweep(ctx); err != nil || len(deletions) != 1 || deletions[0].Err != nil {
+		t.Fatalf("deletions = %+v, err = %v", deletions, err)
+	}
+	if _, err := storage.Stat(ctx, saved.Key); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expired file still stored: %v", err)
+	}
+	if _, err := storage.Stat(ctx, "exports/keep.csv"); err != nil {
+		t.Errorf("file without a TTL was deleted: %v", err)
+	}
+	if usage, _ := quota.Usage(ctx, "alice"); usage.Files != 1 || usage.Bytes != 3 {
+		t.Errorf("quota after sweep = %+v", usage)
+	}
+	if len(reported) != 2 {
+		t.Errorf("OnDelete called %d times, want 2", len(reported))
+	}
+
+	// The marker went with the file
+	if deletions, _ = sweeper.Sweep(ctx); len(deletions) != 0 {
+		t.Errorf("second sweep = %+v", deletions)
+	}
+}
+
+func TestSweeperRetentionClasses(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+
+	save := func(name, class string) *SavedFile {
+		saved, err := SaveReader(ctx, name, strings.NewReader("content"), &FileUploadOptions{
+			Storage:        storage,
+			MaxSize:        1024,
+			RetentionClass: class,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved
+	}
+
+	pending := save("avatar.png", "pending-crop")
+	unknown := save("other.png", "unknown")
+	if pending.RetentionClass != "pending-crop" || !pending.ExpiresAt.IsZero() {
+		t.Errorf("saved = %+v", pending)
+	}
+
+	sweeper := NewSweeper(SweeperOptions{
+		Upload:  FileUploadOptions{Storage: storage},
+		Classes: map[string]time.Duration{"pending-crop": 10 * time.Minute},
+	})
+	sweeper.now = func() time.Time { return time.Now().Add(time.Hour) }
+
+	deletions, err := sweeper.Sweep(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deletions) != 1 || deletions[0].Key != pending.Key || deletions[0].Class != "pending-crop" {
+		t.Errorf("deletions = %+v", deletions)
+	}
+	if _, err := storage.Stat(ctx, unknown.Key); err != nil {
+		t.Errorf("file of an unknown class was deleted: %v", err)
+	}
+}
+
+func TestSweeperKeepsSharedContent(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	opts := &FileUploadOptions{Storage: storage, MaxSize: 1024, ContentAddressed: true}
+
+	kept, err := SaveReader(ctx, "a.txt", strings.NewReader("same"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	temporary := *opts
+	temporary.TTL = time.Minute
+	if _, err := SaveReader(ctx, "b.txt", strings.NewReader("same"), &temporary); err != nil {
+		t.Fatal(err)
+	}
+
+	sweeper := NewSweeper(SweeperOptions{Upload: *opts})
+	sweeper.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if deletions, err := sweeper.Sweep(ctx); err != nil || len(deletions) != 1 {
+		t.Fatalf("deletions = %+v, err = %v", deletions, err)
+	}
+
+	if _, err := storage.Stat(ctx, kept.Key); err != nil {
+		t.Errorf("content still referenced by another upload was deleted: %v", err)
+	}
+}
+
+func TestSweeperSharedContentMarkers(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	quota := NewMemoryQuotaStore(QuotaLimits{})
+	opts := &FileUploadOptions{
+		Storage:          storage,
+		MaxSize:          1024,
+		ContentAddressed: true,
+		TTL:              time.Minute,
+		Quota:            quota,
+		QuotaOwner:       "alice",
+	}
+
+	first, err := SaveReader(ctx, "a.txt", strings.NewReader("same"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SaveReader(ctx, "b.txt", strings.NewReader("same"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.RetentionID == "" || first.RetentionID == second.RetentionID {
+		t.Fatalf("retention IDs = %q, %q, want one per upload", first.RetentionID, second.RetentionID)
+	}
+
+	permanent := *opts
+	permanent.TTL = 0
+	kept, err := SaveReader(ctx, "c.txt", strings.NewReader("same"), &permanent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deleting the permanent upload leaves the others' TTLs alone
+	if err := DeleteSavedFile(ctx, kept, &permanent); err != nil {
+		t.Fatal(err)
+	}
+
+	sweeper := NewSweeper(SweeperOptions{Upload: FileUploadOptions{Storage: storage, ContentAddressed: true, Quota: quota}})
+	sweeper.now = func() time.Time { return time.Now().Add(time.Hour) }
+	deletions, err := sweeper.Sweep(ctx)
+	if err != nil || len(deletions) != 2 {
+		t.Fatalf("deletions = %+v, err = %v, want both expired uploads", deletions, err)
+	}
+
+	if _, err := storage.Stat(ctx, first.Key); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("content of expired uploads still stored: %v", err)
+	}
+	if usage, _ := quota.Usage(ctx, "alice"); usage != (QuotaUsage{}) {
+		t.Errorf("quota after sweep = %+v, want everything given back", usage)
+	}
+	if objects, _ := storage.List(ctx, ""); len(objects) != 0 {
+		t.Errorf("objects left = %v", objects)
+	}
+}
+
+func TestSweeperKeepsOverwrittenFile(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	opts := &FileUploadOptions{Storage: storage, MaxSize: 1024, TTL: time.Minute, OnCollision: CollisionOverwrite}
+
+	if _, err := SaveReader(ctx, "report.txt", strings.NewReader("draft"), opts); err != nil {
+		t.Fatal(err)
+	}
+	permanent := *opts
+	permanent.TTL = 0
+	final, err := SaveReader(ctx, "report.txt", strings.NewReader("final"), &permanent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sweeper := NewSweeper(SweeperOptions{Upload: FileUploadOptions{Storage: storage}})
+	sweeper.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if deletions, err := sweeper.Sweep(ctx); err != nil || len(deletions) != 0 {
+		t.Fatalf("deletions = %+v, err = %v, want the replaced file's TTL gone with it", deletions, err)
+	}
+	if _, err := storage.Stat(ctx, final.Key); err != nil {
+		t.Errorf("permanent file deleted: %v", err)
+	}
+}
+
+func TestSweeperReclaimsTempFiles(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	storage := NewLocalStorage(root)
+
+	for _, key := range []string{".tmp/abc.jpg", ".tmp/docs/def.pdf", "docs/report.pdf"} {
+		storage.Put(ctx, key, strings.NewReader("data"), PutOptions{})
+	}
+	// A file LocalStorage.Put was writing when the process died
+	os.WriteFile(filepath.Join(root, "docs", ".tmp-report.pdf-123"), []byte("half"), 0o644)
+
+	sweeper := NewSweeper(SweeperOptions{Upload: FileUploadOptions{Storage: storage}, TempMaxAge: time.Hour})
+
+	if deletions, _ := sweeper.Sweep(ctx); len(deletions) != 0 {
+		t.Errorf("fresh temp files were reclaimed: %+v", deletions)
+	}
+
+	sweeper.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	deletions, err := sweeper.Sweep(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]bool{}
+	for _, d := range deletions {
+		if d.Reason != DeletionOrphanedTemp || d.Err != nil {
+			t.Errorf("deletion = %+v", d)
+		}
+		got[d.Key] = true
+	}
+	for _, key := range []string{".tmp/abc.jpg", ".tmp/docs/def.pdf", "docs/.tmp-report.pdf-123"} {
+		if !got[key] {
+			t.Errorf("%s was not reclaimed, got %v", key, got)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "docs", ".tmp-report.pdf-123")); !os.IsNotExist(err) {
+		t.Errorf("partial file still on disk")
+	}
+	if _, err := storage.Stat(ctx, "docs/report.pdf"); err != nil {
+		t.Errorf("regular file was deleted: %v", err)
+	}
+}
+
+// listRecordingStorage records the prefixes listed, to catch listings of the whole storage
+type listRecordingStorage struct {
+	*MemoryStorage
+	prefixes []string
+}
+
+func (s *listRecordingStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	s.prefixes = append(s.prefixes, prefix)
+	return s.MemoryStorage.List(ctx, prefix)
+}
+
+func TestSweeperListsOnlyItsPrefixes(t *testing.T) {
+	ctx := context.Background()
+	storage := &listRecordingStorage{MemoryStorage: NewMemoryStorage()}
+	staged, err := tempKey("docs", "pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Put(ctx, staged, strings.NewReader("data"), PutOptions{})
+	storage.Put(ctx, "docs/report.pdf", strings.NewReader("data"), PutOptions{})
+
+	sweeper := NewSweeper(SweeperOptions{Upload: FileUploadOptions{Storage: storage}, TempMaxAge: time.Hour})
+	sweeper.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	deletions, err := sweeper.Sweep(ctx)
+	if err != nil || len(deletions) != 1 || deletions[0].Key != staged {
+		t.Fatalf("deletions = %+v, err = %v, want only the staged file", deletions, err)
+	}
+
+	for _, prefix := range storage.prefixes {
+		if prefix == "" {
+			t.Errorf("sweep listed the whole storage: %q", storage.prefixes)
+		}
+	}
+}
+
+func TestSweeperStartStop(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	saved, err := SaveReader(ctx, "a.txt", strings.NewReader("a"), &FileUploadOptions{Storage: storage, MaxSize: 10, TTL: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := make(chan Deletion, 1)
+	sweeper := NewSweeper(SweeperOptions{
+		Upload:   FileUploadOptions{Storage: storage},
+		Interval: 10 * time.Millisecond,
+		OnDelete: func(ctx context.Context, d Deletion) { deleted <- d },
+	})
+	sweeper.Start(ctx)
+	defer sweeper.Stop()
+
+	select {
+	case d := <-deleted:
+		if d.Key != saved.Key {
+			t.Errorf("deleted %s", d.Key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("sweeper never deleted the expired file")
+	}
+
+	sweeper.Stop()
+	sweeper.Stop()
+}
@@ -0,0 +1,299 @@
+package uploads
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInfected = errors.New("file is infected")
+	// ErrScanFailed is returned when the scanner couldn't scan an upload and
+	// FileUploadOptions.ScanFailOpen isn't set
+	ErrScanFailed = errors.New("malware scan failed")
+)
+
+// Scanner checks uploads for malware. Scan reads r to the end, or until it fails, and
+// returns ScanClean or ScanInfected. Errors mean the content couldn't be scanned.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (ScanResult, error)
+}
+
+type ScanVerdict string
+
+const (
+	ScanClean    ScanVerdict = "clean"
+	ScanInfected ScanVerdict = "infected"
+	// ScanFailed is recorded on files accepted with ScanFailOpen when the scanner failed
+	ScanFailed ScanVerdict = "failed"
+)
+
+// ScanResult is the outcome of scanning an upload. It's recorded in SavedFile.Scan, where
+// the zero value means the file wasn't scanned.
+type ScanResult struct {
+	Verdict ScanVerdict
+	// Threat names the signature that matched, for infected files
+	Threat    string
+	ScannedAt time.Time
+	// Error is why the scan failed, for files accepted with ScanFailOpen. It's a string so
+	// the result can be stored as JSON.
+	Error string
+}
+
+// InfectedError is returned for uploads the scanner found malware in
+type InfectedError struct {
+	Threat string
+	// QuarantineKey is where the file was moved, empty when it was deleted
+	QuarantineKey string
+}
+
+func (e *InfectedError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrInfected, e.Threat)
+}
+
+func (e *InfectedError) Is(target error) bool {
+	return target == ErrInfected
+}
+
+// scanJob scans a file in a goroutine while it's copied to storage
+type scanJob struct {
+	pw     *io.PipeWriter
+	done   chan struct{}
+	result ScanResult
+	err    error
+}
+
+// startScan returns a reader passing r through to the scanner as it's read
+func startScan(ctx context.Context, scanner Scanner, r io.Reader) (io.Reader, *scanJob) {
+	pr, pw := io.Pipe()
+	job := &scanJob{pw: pw, done: make(chan struct{})}
+
+	go func() {
+		defer close(job.done)
+		job.result, job.err = scanner.Scan(ctx, pr)
+		// Keep the copy going when the scanner stops early
+		io.Copy(io.Discard, pr)
+	}()
+
+	return io.TeeReader(r, pw), job
+}
+
+// wait ends the stream and returns the scan's outcome. A copy that failed with copyErr
+// stops the scan. wait is nil-safe so unscanned uploads don't need checks.
+func (j *scanJob) wait(copyErr error) (ScanResult, error) {
+	if j == nil {
+		return ScanResult{}, nil
+	}
+
+	j.pw.CloseWithError(copyErr)
+	<-j.done
+	return j.result, j.err
+}
+
+// checkScan applies opts' policy to the scan of the file stored under key, quarantining or
+// deleting it when it's rejected
+func checkScan(ctx context.Context, storage Storage, key, name string, result ScanResult, scanErr error, opts *FileUploadOptions) (ScanResult, error) {
+	if opts.Scanner == nil {
+		return result, nil
+	}
+
+	if scanErr != nil {
+		if opts.ScanFailOpen {
+			return ScanResult{Verdict: ScanFailed, ScannedAt: time.Now().UTC(), Error: scanErr.Error()}, nil
+		}
+		storage.Delete(context.WithoutCancel(ctx), key)
+		return result, fmt.Errorf("%w: %v", ErrScanFailed, scanErr)
+	}
+
+	switch result.Verdict {
+	case ScanClean:
+	case ScanInfected:
+		infected := &InfectedError{Threat: result.Threat}
+		var err error
+		infected.QuarantineKey, err = quarantine(context.WithoutCancel(ctx), storage, key, name, opts)
+		if err != nil {
+			return result, errors.Join(infected, fmt.Errorf("failed to quarantine file: %w", err))
+		}
+		return result, infected
+	default:
+		storage.Delete(context.WithoutCancel(ctx), key)
+		return result, fmt.Errorf("%w: unknown verdict %q", ErrScanFailed, result.Verdict)
+	}
+
+	if result.ScannedAt.IsZero() {
+		result.ScannedAt = time.Now().UTC()
+	}
+	return result, nil
+}
+
+// quarantine moves an infected file under opts.QuarantinePrefix, or deletes it when none is
+// set
+func quarantine(ctx context.Context, storage Storage, key, name string, opts *FileUploadOptions) (string, error) {
+	if opts.QuarantinePrefix == "" {
+		return "", storage.Delete(ctx, key)
+	}
+
+	dst, err := CleanKey(path.Join(opts.QuarantinePrefix, opts.KeyPrefix, name))
+	if err != nil {
+		storage.Delete(ctx, key)
+		return "", err
+	}
+	if dst, err = resolveCollision(ctx, storage, dst, CollisionSuffix); err != nil {
+		storage.Delete(ctx, key)
+		return "", err
+	}
+	if err := MoveObject(ctx, storage, key, dst); err != nil {
+		storage.Delete(ctx, key)
+		return "", err
+	}
+	return dst, nil
+}
+
+type ClamdOptions struct {
+	// Network is "tcp" or "unix". Defaults to "tcp".
+	Network string
+	// Address is the daemon's host:port, e.g. "localhost:3310", or socket path, e.g.
+	// "/run/clamav/clamd.ctl"
+	Address string
+	// Timeout bounds connecting and each read or write. Defaults to 30 seconds.
+	Timeout time.Duration
+	// ChunkSize is how much is sent in each INSTREAM chunk. Defaults to 64 KB.
+	ChunkSize int
+}
+
+// ClamdScanner scans uploads with a ClamAV daemon using the INSTREAM command. clamd
+// rejects streams over its StreamMaxLength, which then fail the scan.
+type ClamdScanner struct {
+	opts ClamdOptions
+}
+
+func NewClamdScanner(opts ClamdOptions) *ClamdScanner {
+	if opts.Network == "" {
+		opts.Network = "tcp"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 64 << 10
+	}
+	return &ClamdScanner{opts: opts}
+}
+
+// Ping checks the daemon is reachable
+func (s *ClamdScanner) Ping(ctx context.Context) error {
+	reply, err := s.command(ctx, "PING", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+	return nil
+}
+
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	reply, err := s.command(ctx, "INSTREAM", r)
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return ScanResult{Verdict: ScanClean, ScannedAt: time.Now().UTC()}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Verdict: ScanInfected, Threat: strings.TrimSuffix(reply, " FOUND"), ScannedAt: time.Now().UTC()}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd: %s", strings.TrimSuffix(reply, " ERROR"))
+	}
+}
+
+// command sends a null-terminated command, streams body in INSTREAM chunks when it's set,
+// and returns the daemon's reply
+func (s *ClamdScanner) command(ctx context.Context, name string, body io.Reader) (string, error) {
+	dialer := net.Dialer{Timeout: s.opts.Timeout}
+	conn, err := dialer.DialContext(ctx, s.opts.Network, s.opts.Address)
+	if err != nil {
+		return "", fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+
+	// Unblock reads and writes when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	if _, err := io.WriteString(conn, "z"+name+"\x00"); err != nil {
+		return "", s.connError(ctx, err)
+	}
+
+	if body != nil {
+		readErr, writeErr := s.stream(conn, body)
+		if readErr != nil {
+			return "", readErr
+		}
+		if writeErr != nil {
+			// clamd closes the connection after rejecting a stream, so its reply explains more
+			// than the write error
+			if reply, err := readClamdReply(conn); err == nil {
+				return reply, nil
+			}
+			return "", s.connError(ctx, writeErr)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return "", s.connError(ctx, err)
+	}
+	return reply, nil
+}
+
+// stream sends body as length-prefixed chunks followed by an empty one, returning errors
+// reading body apart from errors writing to the daemon
+func (s *ClamdScanner) stream(conn net.Conn, body io.Reader) (readErr, writeErr error) {
+	buf := make([]byte, 4+s.opts.ChunkSize)
+	for {
+		n, err := io.ReadFull(body, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return nil, err
+}
+
+func (s *ClamdScanner) connError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return fmt.Errorf("clamd: %w", err)
+}
+
+func readClamdReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
@@ -0,0 +1,258 @@
+package uploads
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers PING and INSTREAM like clamd, flagging streams containing the EICAR
+// test string. Streams over maxStream are rejected.
+func fakeClamd(t *testing.T, network string, maxStream int) string {
+	t.Helper()
+
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "clamd.sock")
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeClamd(conn, maxStream)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveFakeClamd(conn net.Conn, maxStream int) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch command {
+	case "zPING\x00":
+		io.WriteString(conn, "PONG\x00")
+	case "zINSTREAM\x00":
+		var stream []byte
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if len(stream)+int(size) > maxStream {
+				io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+				return
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			stream = append(stream, chunk...)
+		}
+
+		if bytes.Contains(stream, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+			io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+		} else {
+			io.WriteString(conn, "stream: OK\x00")
+		}
+	default:
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+	}
+}
+
+func TestClamdScanner(t *testing.T) {
+	ctx := context.Background()
+
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			scanner := NewClamdScanner(ClamdOptions{Network: network, Address: fakeClamd(t, network, 1<<20), ChunkSize: 10})
+
+			if err := scanner.Ping(ctx); err != nil {
+				t.Fatalf("Ping: %v", err)
+			}
+
+			result, err := scanner.Scan(ctx, strings.NewReader("nothing to see here, just a longer text"))
+			if err != nil || result.Verdict != ScanClean {
+				t.Errorf("clean file: %+v, %v", result, err)
+			}
+
+			result, err = scanner.Scan(ctx, strings.NewReader("prefix "+eicar))
+			if err != nil || result.Verdict != ScanInfected || result.Threat != "Eicar-Test-Signature" {
+				t.Errorf("infected file: %+v, %v", result, err)
+			}
+		})
+	}
+
+	limited := NewClamdScanner(ClamdOptions{Address: fakeClamd(t, "tcp", 16), ChunkSize: 8})
+	if _, err := limited.Scan(ctx, strings.NewReader(strings.Repeat("x", 100))); err == nil || !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Errorf("stream over the limit: err = %v", err)
+	}
+
+	down := NewClamdScanner(ClamdOptions{Address: "127.0.0.1:1", Timeout: time.Second})
+	if _, err := down.Scan(ctx, strings.NewReader("x")); err == nil {
+		t.Errorf("unreachable daemon: no error")
+	}
+}
+
+func TestSaveWithScanner(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	opts := &FileUploadOptions{
+		Storage:          storage,
+		KeyPrefix:        "docs",
+		MaxSize:          1024,
+		OnCollision:      CollisionOverwrite,
+		Scanner:          NewClamdScanner(ClamdOptions{Address: fakeClamd(t, "tcp", 1<<20)}),
+		QuarantinePrefix: "quarantine",
+	}
+
+	saved, err := SaveReader(ctx, "notes.txt", strings.NewReader("clean notes"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Key != "docs/notes.txt" || saved.Scan.Verdict != ScanClean || saved.Scan.ScannedAt.IsZero() {
+		t.Errorf("saved = %+v", saved)
+	}
+
+	_, err = SaveUploadedFile(createTestFileHeader("notes.txt", []byte(eicar)), opts)
+	var infected *InfectedError
+	if !errors.As(err, &infected) || StatusForError(err) != http.StatusUnprocessableEntity {
+		t.Fatalf("infected upload: err = %v, status %d", err, StatusForError(err))
+	}
+	if infected.Threat != "Eicar-Test-Signature" || infected.QuarantineKey != "quarantine/docs/notes.txt" {
+		t.Errorf("infected = %+v", infected)
+	}
+
+	// The infected upload didn't replace the clean file it was named after
+	rc, _, err := storage.Get(ctx, "docs/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "clean notes" {
+		t.Errorf("docs/notes.txt = %q", data)
+	}
+
+	objects, _ := storage.List(ctx, "")
+	if len(objects) != 2 {
+		t.Errorf("stored objects = %+v, want the clean file and the quarantined one", objects)
+	}
+
+	deleted := *opts
+	deleted.QuarantinePrefix = ""
+	if _, err := SaveReader(ctx, "other.txt", strings.NewReader(eicar), &deleted); !errors.Is(err, ErrInfected) {
+		t.Fatalf("err = %v", err)
+	}
+	if objects, _ := storage.List(ctx, ""); len(objects) != 2 {
+		t.Errorf("infected file without a quarantine wasn't deleted: %+v", objects)
+	}
+}
+
+func TestSaveScannerFailure(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	quota := NewMemoryQuotaStore(QuotaLimits{})
+	opts := &FileUploadOptions{
+		Storage:    storage,
+		MaxSize:    1024,
+		Scanner:    NewClamdScanner(ClamdOptions{Address: fakeClamd(t, "tcp", 4)}),
+		Quota:      quota,
+		QuotaOwner: "alice",
+	}
+
+	_, err := SaveReader(ctx, "big.txt", strings.NewReader("over the daemon's limit"), opts)
+	if !errors.Is(err, ErrScanFailed) || StatusForError(err) != http.StatusServiceUnavailable {
+		t.Fatalf("fail closed: err = %v, status %d", err, StatusForError(err))
+	}
+	if objects, _ := storage.List(ctx, ""); len(objects) != 0 {
+		t.Errorf("unscanned file kept: %+v", objects)
+	}
+	if usage, _ := quota.Usage(ctx, "alice"); usage != (QuotaUsage{}) {
+		t.Errorf("usage after a rejected upload = %+v", usage)
+	}
+
+	opts.ScanFailOpen = true
+	saved, err := SaveReader(ctx, "big.txt", strings.NewReader("over the daemon's limit"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Scan.Verdict != ScanFailed || saved.Scan.Error == "" {
+		t.Errorf("fail open: scan = %+v", saved.Scan)
+	}
+	if _, err := storage.Stat(ctx, "big.txt"); err != nil {
+		t.Errorf("file accepted with a failed scan isn't stored: %v", err)
+	}
+
+	encoded, _ := json.Marshal(saved.Scan)
+	if !strings.Contains(string(encoded), "size limit exceeded") {
+		t.Errorf("scan result as JSON = %s, want the failure reason", encoded)
+	}
+
+	// Uploads that fail while being copied stop the scan too
+	opts.MaxSize = 5
+	if _, err := SaveReader(ctx, "huge.txt", strings.NewReader(strings.Repeat("x", 100)), opts); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestSaveWithScannerKeepsNoClobber(t *testing.T) {
+	storage := racingStorage{MemoryStorage: NewMemoryStorage(), raceKey: "docs/notes.txt"}
+	opts := &FileUploadOptions{
+		Storage:     storage,
+		KeyPrefix:   "docs",
+		MaxSize:     1024,
+		OnCollision: CollisionSuffix,
+		Scanner:     NewClamdScanner(ClamdOptions{Address: fakeClamd(t, "tcp", 1<<20)}),
+	}
+
+	// The name is taken while the file is scanned, so it moves to the next free one
+	saved, err := SaveReader(context.Background(), "notes.txt", strings.NewReader("clean notes"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Key != "docs/notes_1.txt" || saved.SavedName != "notes_1.txt" {
+		t.Errorf("saved = %+v", saved)
+	}
+
+	rc, _, _ := storage.Get(context.Background(), "docs/notes.txt")
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "competing" {
+		t.Errorf("docs/notes.txt = %q, want the competing file", data)
+	}
+
+	opts.OnCollision = CollisionFail
+	storage.Delete(context.Background(), "docs/notes.txt")
+	if _, err := SaveReader(context.Background(), "notes.txt", strings.NewReader("clean notes"), opts); !errors.Is(err, ErrObjectExists) {
+		t.Errorf("CollisionFail: err = %v, want ErrObjectExists", err)
+	}
+}
@@ -0,0 +1,333 @@
+package uploads
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddddami/bindle/jsonx"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid download link signature")
+	ErrLinkExpired      = errors.New("download link has expired")
+	// ErrClientMismatch is returned for links bound to another client's IP address
+	ErrClientMismatch = errors.New("download link was issued to another client")
+)
+
+// minSigningKeySize is the shortest HMAC key URLSigner accepts
+const minSigningKeySize = 32
+
+// Query parameters of a signed link
+const (
+	signedKeyParam         = "key"
+	signedExpiresParam     = "expires"
+	signedIPParam          = "ip"
+	signedDispositionParam = "disposition"
+	signedFilenameParam    = "filename"
+	signedKeyIDParam       = "kid"
+	signedSignatureParam   = "signature"
+)
+
+// URLSigner signs download links with HMAC-SHA256. Every link records the ID of the key
+// that signed it, so keys can be rotated: new links are signed with the current key, and
+// links signed with any key that hasn't been retired keep working until they expire.
+type URLSigner struct {
+	mu      sync.RWMutex
+	keys    map[string][]byte
+	current string
+	now     func() time.Time
+}
+
+// NewURLSigner returns a signer that signs with keys[current]. Keys must be at least 32
+// bytes long.
+func NewURLSigner(current string, keys map[string][]byte) (*URLSigner, error) {
+	s := &URLSigner{keys: make(map[string][]byte, len(keys)), now: time.Now}
+	for id, key := range keys {
+		if err := s.addKey(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := s.keys[current]; !ok {
+		return nil, fmt.Errorf("signing key %q is not among the keys", current)
+	}
+	s.current = current
+	return s, nil
+}
+
+// Rotate adds a key and signs new links with it. Links signed with the previous keys stay
+// valid until those keys are retired.
+func (s *URLSigner) Rotate(id string, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.addKey(id, key); err != nil {
+		return err
+	}
+	s.current = id
+	return nil
+}
+
+// Retire removes a key, invalidating every link it signed. The current key can't be retired.
+func (s *URLSigner) Retire(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == s.current {
+		return fmt.Errorf("signing key %q is in use", id)
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+func (s *URLSigner) addKey(id string, key []byte) error {
+	if id == "" {
+		return errors.New("signing key ID is empty")
+	}
+	if len(key) < minSigningKeySize {
+		return fmt.Errorf("signing key %q is shorter than %d bytes", id, minSigningKeySize)
+	}
+	s.keys[id] = append([]byte(nil), key...)
+	return nil
+}
+
+type SignOptions struct {
+	// TTL is how long the link stays valid. Defaults to an hour.
+	TTL time.Duration
+	// ClientIP binds the link to one client address. Empty lets anyone with the link use it.
+	ClientIP string
+	// ForceDownload sends the file as an attachment instead of inline
+	ForceDownload bool
+	// Filename is the suggested download name. Defaults to the last element of the key.
+	Filename string
+}
+
+// SignedLink is what a verified link grants access to
+type SignedLink struct {
+	Key           string
+	Expires       time.Time
+	ClientIP      string
+	ForceDownload bool
+	Filename      string
+	// KeyID is the ID of the key that signed the link
+	KeyID string
+}
+
+// Sign returns baseURL with the signed query parameters for downloading key appended.
+// Query parameters already in baseURL are kept but aren't covered by the signature.
+func (s *URLSigner) Sign(baseURL, key string, opts SignOptions) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL: %w", err)
+	}
+
+	key, err = CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	if opts.ClientIP != "" {
+		ip := net.ParseIP(opts.ClientIP)
+		if ip == nil {
+			return "", fmt.Errorf("invalid client IP %q", opts.ClientIP)
+		}
+		opts.ClientIP = ip.String()
+	}
+
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+
+	s.mu.RLock()
+	kid, secret := s.current, s.keys[s.current]
+	now := s.now()
+	s.mu.RUnlock()
+
+	link := SignedLink{
+		Key:           key,
+		Expires:       now.Add(ttl).Truncate(time.Second),
+		ClientIP:      opts.ClientIP,
+		ForceDownload: opts.ForceDownload,
+		Filename:      cleanFilename(opts.Filename),
+		KeyID:         kid,
+	}
+
+	query := u.Query()
+	for name, value := range link.params() {
+		if value == "" {
+			query.Del(name)
+		} else {
+			query.Set(name, value)
+		}
+	}
+	query.Set(signedSignatureParam, base64.RawURLEncoding.EncodeToString(link.mac(secret)))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Verify checks the signature of a link's query parameters in constant time, then its
+// expiry and, for links bound to a client, that clientIP is that client.
+func (s *URLSigner) Verify(query url.Values, clientIP string) (*SignedLink, error) {
+	expires, err := strconv.ParseInt(query.Get(signedExpiresParam), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	link := &SignedLink{
+		Key:           query.Get(signedKeyParam),
+		Expires:       time.Unix(expires, 0),
+		ClientIP:      query.Get(signedIPParam),
+		ForceDownload: query.Get(signedDispositionParam) == "attachment",
+		Filename:      query.Get(signedFilenameParam),
+		KeyID:         query.Get(signedKeyIDParam),
+	}
+	if disposition := query.Get(signedDispositionParam); disposition != "attachment" && disposition != "inline" {
+		return nil, ErrInvalidSignature
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get(signedSignatureParam))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	s.mu.RLock()
+	secret, ok := s.keys[link.KeyID]
+	now := s.now()
+	s.mu.RUnlock()
+
+	if !ok || !hmac.Equal(signature, link.mac(secret)) {
+		return nil, ErrInvalidSignature
+	}
+
+	if !now.Before(link.Expires) {
+		return nil, ErrLinkExpired
+	}
+
+	if link.ClientIP != "" {
+		ip := net.ParseIP(clientIP)
+		if ip == nil || !ip.Equal(net.ParseIP(link.ClientIP)) {
+			return nil, ErrClientMismatch
+		}
+	}
+
+	return link, nil
+}
+
+func (l *SignedLink) params() map[string]string {
+	disposition := "inline"
+	if l.ForceDownload {
+		disposition = "attachment"
+	}
+	return map[string]string{
+		signedKeyParam:         l.Key,
+		signedExpiresParam:     strconv.FormatInt(l.Expires.Unix(), 10),
+		signedIPParam:          l.ClientIP,
+		signedDispositionParam: disposition,
+		signedFilenameParam:    l.Filename,
+		signedKeyIDParam:       l.KeyID,
+	}
+}
+
+// mac signs the link's fields, each prefixed with its length so no two links share a
+// payload
+func (l *SignedLink) mac(secret []byte) []byte {
+	params := l.params()
+
+	h := hmac.New(sha256.New, secret)
+	for _, name := range []string{signedKeyIDParam, signedKeyParam, signedExpiresParam, signedIPParam, signedDispositionParam, signedFilenameParam} {
+		fmt.Fprintf(h, "%d:%s;", len(params[name]), params[name])
+	}
+	return h.Sum(nil)
+}
+
+type SignedDownloadOptions struct {
+	// Storage holds the files the links point to
+	Storage Storage
+	// Download holds the headers sent with every file. The link decides the disposition and
+	// the suggested filename.
+	Download DownloadOptions
+	// ClientIP returns the address of the client, for links bound to one. Defaults to the
+	// host of r.RemoteAddr; set it when the server runs behind a proxy.
+	ClientIP func(r *http.Request) string
+}
+
+// SignedDownloadHandler is an http.Handler serving files from links made by a URLSigner,
+// without any session. Invalid and tampered links get a 403, expired ones a 410.
+type SignedDownloadHandler struct {
+	signer *URLSigner
+	opts   SignedDownloadOptions
+}
+
+func NewSignedDownloadHandler(signer *URLSigner, opts SignedDownloadOptions) *SignedDownloadHandler {
+	if opts.Storage == nil {
+		opts.Storage = NewLocalStorage(DefaultOptions().DestinationDir)
+	}
+	if opts.ClientIP == nil {
+		opts.ClientIP = remoteIP
+	}
+	return &SignedDownloadHandler{signer: signer, opts: opts}
+}
+
+func (h *SignedDownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		signedError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	link, err := h.signer.Verify(r.URL.Query(), h.opts.ClientIP(r))
+	switch {
+	case errors.Is(err, ErrLinkExpired):
+		signedError(w, err.Error(), http.StatusGone)
+		return
+	case err != nil:
+		signedError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	opts := h.opts.Download
+	opts.ForceDownload = link.ForceDownload
+	opts.SuggestedFilename = link.Filename
+
+	if local, ok := h.opts.Storage.(*LocalStorage); ok {
+		var filePath string
+		if filePath, err = local.Path(link.Key); err == nil {
+			err = ServeFileForDownload(w, r, filePath, opts)
+		}
+	} else {
+		err = ServeStoredFile(w, r, h.opts.Storage, link.Key, opts)
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrObjectNotFound), errors.Is(err, fs.ErrNotExist):
+		signedError(w, "file not found", http.StatusNotFound)
+	default:
+		signedError(w, "failed to serve file", http.StatusInternalServerError)
+	}
+}
+
+func signedError(w http.ResponseWriter, message string, status int) {
+	jsonx.RespondWithError(w, message, jsonx.Options{ErrorStatus: status})
+}
+
+// remoteIP returns the host part of r.RemoteAddr
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return strings.Trim(r.RemoteAddr, "[]")
+	}
+	return host
+}
@@ -0,0 +1,207 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T) *URLSigner {
+	signer, err := NewURLSigner("v1", map[string][]byte{"v1": bytes.Repeat([]byte("a"), 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestNewURLSigner(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+
+	if _, err := NewURLSigner("v2", map[string][]byte{"v1": key}); err == nil {
+		t.Errorf("expected an error for a missing current key")
+	}
+	if _, err := NewURLSigner("v1", map[string][]byte{"v1": key[:16]}); err == nil {
+		t.Errorf("expected an error for a short key")
+	}
+	if _, err := NewURLSigner("", map[string][]byte{"": key}); err == nil {
+		t.Errorf("expected an error for an empty key ID")
+	}
+}
+
+func TestSignedDownloadHandler(t *testing.T) {
+	storages := map[string]Storage{
+		"local":  NewLocalStorage(t.TempDir()),
+		"memory": NewMemoryStorage(),
+	}
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			if _, err := storage.Put(context.Background(), "docs/report.txt", strings.NewReader("quarterly"), PutOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			signer := newTestSigner(t)
+			h := NewSignedDownloadHandler(signer, SignedDownloadOptions{Storage: storage, Download: DefaultDownloadOptions()})
+
+			link, err := signer.Sign("https://example.com/dl?tracking=1", "docs/report.txt", SignOptions{ForceDownload: true, Filename: "Q3 report.txt"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", link, nil))
+			if rr.Code != 200 || rr.Body.String() != "quarterly" {
+				t.Fatalf("GET = %d %q", rr.Code, rr.Body.String())
+			}
+			if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="Q3 report.txt"` {
+				t.Errorf("Content-Disposition = %q", got)
+			}
+
+			missing, _ := signer.Sign("/dl", "docs/missing.txt", SignOptions{})
+			rr = httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", missing, nil))
+			if rr.Code != 404 {
+				t.Errorf("missing file = %d, want 404", rr.Code)
+			}
+		})
+	}
+}
+
+func TestSignedDownloadHandlerRejectsTampering(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Put(context.Background(), "secret.txt", strings.NewReader("secret"), PutOptions{})
+	storage.Put(context.Background(), "other.txt", strings.NewReader("other"), PutOptions{})
+
+	signer := newTestSigner(t)
+	h := NewSignedDownloadHandler(signer, SignedDownloadOptions{Storage: storage})
+
+	link, err := signer.Sign("/dl", "secret.txt", SignOptions{TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(link)
+
+	tamper := map[string]func(url.Values){
+		"key":         func(q url.Values) { q.Set("key", "other.txt") },
+		"expires":     func(q url.Values) { q.Set("expires", "99999999999") },
+		"disposition": func(q url.Values) { q.Set("disposition", "attachment") },
+		"filename":    func(q url.Values) { q.Set("filename", "evil.html") },
+		"kid":         func(q url.Values) { q.Set("kid", "v0") },
+		"signature":   func(q url.Values) { q.Set("signature", "AAAA") },
+		"unsigned":    func(q url.Values) { q.Del("signature") },
+	}
+
+	for name, change := range tamper {
+		t.Run(name, func(t *testing.T) {
+			q := u.Query()
+			change(q)
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/dl?"+q.Encode(), nil))
+			if rr.Code != 403 {
+				t.Errorf("status = %d, want 403", rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), `"success":false`) {
+				t.Errorf("expected a jsonx error, got %q", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestSignedDownloadHandlerExpiry(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Put(context.Background(), "a.txt", strings.NewReader("a"), PutOptions{})
+
+	now := time.Now()
+	signer := newTestSigner(t)
+	signer.now = func() time.Time { return now }
+	h := NewSignedDownloadHandler(signer, SignedDownloadOptions{Storage: storage})
+
+	link, _ := signer.Sign("/dl", "a.txt", SignOptions{TTL: time.Minute})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", link, nil))
+	if rr.Code != 200 {
+		t.Fatalf("fresh link = %d", rr.Code)
+	}
+
+	now = now.Add(2 * time.Minute)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", link, nil))
+	if rr.Code != 410 {
+		t.Errorf("expired link = %d, want 410", rr.Code)
+	}
+}
+
+func TestSignedDownloadHandlerClientIP(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Put(context.Background(), "a.txt", strings.NewReader("a"), PutOptions{})
+
+	signer := newTestSigner(t)
+	h := NewSignedDownloadHandler(signer, SignedDownloadOptions{Storage: storage})
+
+	link, err := signer.Sign("/dl", "a.txt", SignOptions{ClientIP: "203.0.113.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", link, nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Errorf("bound client = %d, want 200", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", link, nil)
+	req.RemoteAddr = "198.51.100.1:51234"
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != 403 {
+		t.Errorf("other client = %d, want 403", rr.Code)
+	}
+
+	if _, err := signer.Sign("/dl", "a.txt", SignOptions{ClientIP: "not-an-ip"}); err == nil {
+		t.Errorf("expected an error for an invalid client IP")
+	}
+}
+
+func TestURLSignerRotation(t *testing.T) {
+	signer := newTestSigner(t)
+
+	old, _ := signer.Sign("/dl", "a.txt", SignOptions{})
+	if err := signer.Rotate("v2", bytes.Repeat([]byte("b"), 32)); err != nil {
+		t.Fatal(err)
+	}
+	fresh, _ := signer.Sign("/dl", "a.txt", SignOptions{})
+
+	verify := func(link string) (*SignedLink, error) {
+		u, _ := url.Parse(link)
+		return signer.Verify(u.Query(), "")
+	}
+
+	if link, err := verify(old); err != nil || link.KeyID != "v1" {
+		t.Errorf("old link = %+v, %v", link, err)
+	}
+	if link, err := verify(fresh); err != nil || link.KeyID != "v2" {
+		t.Errorf("fresh link = %+v, %v", link, err)
+	}
+
+	if err := signer.Retire("v2"); err == nil {
+		t.Errorf("expected an error when retiring the current key")
+	}
+	if err := signer.Retire("v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(old); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("link signed with a retired key: err = %v", err)
+	}
+	if _, err := verify(fresh); err != nil {
+		t.Errorf("fresh link after retiring v1: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrObjectNotFound = errors.New("object not found")
+	ErrInvalidKey     = errors.New("invalid storage key")
+	// ErrObjectExists is returned by Put when PutOptions.IfNotExists is set and the key is taken
+	ErrObjectExists = errors.New("object already exists")
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+	ETag        string
+}
+
+type PutOptions struct {
+	ContentType string
+	// Size is the content length when known. Zero means unknown.
+	Size int64
+	// IfNotExists makes Put fail with ErrObjectExists instead of replacing an existing object
+	IfNotExists bool
+}
+
+// Storage is where uploaded files end up. Keys are slash-separated relative paths
+// such as "avatars/dami.png".
+type Storage interface {
+	// Put stores the contents of r under key. A failed Put must not leave a partial object
+	// behind or damage the object it was going to replace.
+	Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (ObjectInfo, error)
+	// Get opens an object for reading. The caller must close the returned reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// List returns every object whose key starts with prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// Mover is implemented by storages that can rename an object without copying it through the caller
+type Mover interface {
+	Move(ctx context.Context, srcKey, dstKey string) error
+}
+
+// MoveObject renames srcKey to dstKey, using the storage's Mover when it has one and falling
+// back to copy and delete otherwise.
+func MoveObject(ctx context.Context, storage Storage, srcKey, dstKey string) error {
+	if mover, ok := storage.(Mover); ok {
+		return mover.Move(ctx, srcKey, dstKey)
+	}
+
+	rc, info, err := storage.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if _, err := storage.Put(ctx, dstKey, rc, PutOptions{ContentType: info.ContentType, Size: info.Size}); err != nil {
+		return err
+	}
+	return storage.Delete(ctx, srcKey)
+}
+
+// NoClobberMover is implemented by storages that can rename an object only when the
+// destination key is free, as one atomic step
+type NoClobberMover interface {
+	// MoveIfNotExists fails with ErrObjectExists when dstKey is taken
+	MoveIfNotExists(ctx context.Context, srcKey, dstKey string) error
+}
+
+// MoveObjectIfNotExists renames srcKey to dstKey unless dstKey exists, in which case it fails
+// with ErrObjectExists and leaves both objects alone. Storages without a NoClobberMover are
+// copied with Put's IfNotExists and the source deleted.
+func MoveObjectIfNotExists(ctx context.Context, storage Storage, srcKey, dstKey string) error {
+	if mover, ok := storage.(NoClobberMover); ok {
+		return mover.MoveIfNotExists(ctx, srcKey, dstKey)
+	}
+
+	rc, info, err := storage.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if _, err := storage.Put(ctx, dstKey, rc, PutOptions{ContentType: info.ContentType, Size: info.Size, IfNotExists: true}); err != nil {
+		return err
+	}
+	return storage.Delete(ctx, srcKey)
+}
+
+// RangeGetter is implemented by storages that can read part of an object without fetching
+// the rest of it
+type RangeGetter interface {
+	// GetRange opens up to length bytes of an object starting at offset
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// GetObjectRange opens up to length bytes of key starting at offset, using the storage's
+// RangeGetter when it has one and skipping through a full Get otherwise.
+func GetObjectRange(ctx context.Context, storage Storage, key string, offset, length int64) (io.ReadCloser, error) {
+	if getter, ok := storage.(RangeGetter); ok {
+		return getter.GetRange(ctx, key, offset, length)
+	}
+
+	rc, _, err := storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, rc, offset); err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	return limitedReadCloser{io.LimitReader(rc, length), rc}, nil
+}
+
+// limitedReadCloser reads part of a reader and closes the whole of it
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// CleanKey normalizes a storage key and rejects keys that are empty, absolute
+// or that would escape the storage root.
+func CleanKey(key string) (string, error) {
+	key = strings.ReplaceAll(key, "\\", "/")
+	if key == "" || strings.HasPrefix(key, "/") {
+		return "", ErrInvalidKey
+	}
+
+	cleaned := path.Clean(key)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", ErrInvalidKey
+	}
+
+	return cleaned, nil
+}
+
+// readSeekCloser adds a no-op Close to readers that don't need closing
+type readSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekCloser) Close() error {
+	return nil
+}
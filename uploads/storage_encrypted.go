@@ -0,0 +1,575 @@
+package uploads
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	// ErrDecryptionFailed is returned when a stored object isn't encrypted, was encrypted
+	// with an unknown key, or has been tampered with
+	ErrDecryptionFailed = errors.New("failed to decrypt stored file")
+	ErrUnknownKey       = errors.New("unknown encryption key")
+)
+
+// KeyProvider wraps the per-file data keys of an EncryptedStorage with a key encryption
+// key, typically held by a KMS or an HSM
+type KeyProvider interface {
+	// WrapKey encrypts a data key, returning the ID of the key used to encrypt it
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped by the key keyID
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// StaticKeyProvider wraps data keys with AES-256-GCM under keys held in memory. New data
+// keys are wrapped with the current key; files wrapped with older keys stay readable as
+// long as those keys are kept.
+type StaticKeyProvider struct {
+	mu      sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+// NewStaticKeyProvider returns a provider wrapping with keys[current]. Keys must be 32
+// bytes long.
+func NewStaticKeyProvider(current string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	p := &StaticKeyProvider{keys: make(map[string][]byte, len(keys))}
+	for id, key := range keys {
+		if err := p.addKey(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := p.keys[current]; !ok {
+		return nil, fmt.Errorf("encryption key %q is not among the keys", current)
+	}
+	p.current = current
+	return p, nil
+}
+
+// Rotate adds a key and wraps new data keys with it
+func (p *StaticKeyProvider) Rotate(id string, key []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.addKey(id, key); err != nil {
+		return err
+	}
+	p.current = id
+	return nil
+}
+
+func (p *StaticKeyProvider) addKey(id string, key []byte) error {
+	if id == "" {
+		return errors.New("encryption key ID is empty")
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("encryption key %q must be 32 bytes long", id)
+	}
+	p.keys[id] = append([]byte(nil), key...)
+	return nil
+}
+
+func (p *StaticKeyProvider) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	p.mu.RLock()
+	id, key := p.current, p.keys[p.current]
+	p.mu.RUnlock()
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return id, aead.Seal(nonce, nonce, dataKey, []byte(id)), nil
+}
+
+func (p *StaticKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	p.mu.RLock()
+	key, ok := p.keys[keyID]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return dataKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypted objects start with a header holding the wrapped data key, followed by the
+// content in chunks sealed with AES-256-GCM:
+//
+//	magic (8) | chunk size (4) | key ID length (2) | key ID | wrapped key length (2) | wrapped key
+//	chunk 0 | chunk 1 | … | final chunk
+//
+// Each chunk's nonce is its index with a flag marking the final chunk, and the header is
+// authenticated with every chunk, so chunks can't be reordered, dropped or moved to
+// another file.
+const (
+	encryptionMagic    = "BNDLENC\x01"
+	encryptionChunk    = 64 << 10
+	encryptionOverhead = 16 // GCM tag
+)
+
+// EncryptedStorage encrypts objects at rest with envelope encryption: every object gets
+// its own random data key, wrapped by the KeyProvider and stored in the object's header.
+// Content is encrypted in 64 KB chunks as it streams in, and Get returns a reader that
+// decrypts only the chunks it reads, so range requests stay cheap.
+//
+// Sizes in ObjectInfo from Put, Get and Stat are plaintext sizes; Stat reads only the
+// header. List reports the size stored in the underlying storage.
+type EncryptedStorage struct {
+	Storage Storage
+	Keys    KeyProvider
+}
+
+func NewEncryptedStorage(storage Storage, keys KeyProvider) *EncryptedStorage {
+	return &EncryptedStorage{Storage: storage, Keys: keys}
+}
+
+func (s *EncryptedStorage) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (ObjectInfo, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	keyID, wrapped, err := s.Keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	header, err := encryptionHeader(keyID, wrapped, encryptionChunk)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	if opts.Size > 0 {
+		opts.Size = ciphertextSize(int64(len(header)), opts.Size, encryptionChunk)
+	}
+
+	info, err := s.Storage.Put(ctx, key, &encryptReader{
+		aead:   aead,
+		header: header,
+		src:    bufio.NewReader(r),
+		chunk:  make([]byte, encryptionChunk),
+		out:    header,
+	}, opts)
+	if err != nil {
+		return info, err
+	}
+
+	info.Size = plaintextSize(int64(len(header)), info.Size, encryptionChunk)
+	return info, nil
+}
+
+func (s *EncryptedStorage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	rc, info, err := s.Storage.Get(ctx, key)
+	if err != nil {
+		return nil, info, err
+	}
+
+	d, err := s.decrypter(ctx, rc, info.Size)
+	if err != nil {
+		rc.Close()
+		return nil, info, fmt.Errorf("%s: %w", key, err)
+	}
+
+	info.Size = d.size
+	if seeker, ok := rc.(io.ReadSeeker); ok {
+		return &seekableDecryptReader{decryptReader: d, seeker: seeker}, info, nil
+	}
+	return d, info, nil
+}
+
+// Stat reads only the object's header to work out its plaintext size, without fetching the
+// content or unwrapping the data key
+func (s *EncryptedStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.Storage.Stat(ctx, key)
+	if err != nil {
+		return info, err
+	}
+
+	h, err := s.statHeader(ctx, key, info.Size)
+	if err != nil {
+		return info, fmt.Errorf("%s: %w", key, err)
+	}
+	size := plaintextSize(int64(len(h.raw)), info.Size, h.chunkSize)
+	if size < 0 {
+		return info, fmt.Errorf("%s: %w: truncated object", key, ErrDecryptionFailed)
+	}
+	info.Size = size
+	return info, nil
+}
+
+func (s *EncryptedStorage) Delete(ctx context.Context, key string) error {
+	return s.Storage.Delete(ctx, key)
+}
+
+// List reports the sizes stored in the underlying storage, which include the header and
+// the tag of every chunk. Working out plaintext sizes would take a read per object; Stat
+// the keys that need them.
+func (s *EncryptedStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return s.Storage.List(ctx, prefix)
+}
+
+// Move renames objects in the underlying storage. Ciphertext doesn't depend on the key,
+// so objects stay readable under their new name.
+func (s *EncryptedStorage) Move(ctx context.Context, srcKey, dstKey string) error {
+	return MoveObject(ctx, s.Storage, srcKey, dstKey)
+}
+
+func (s *EncryptedStorage) MoveIfNotExists(ctx context.Context, srcKey, dstKey string) error {
+	return MoveObjectIfNotExists(ctx, s.Storage, srcKey, dstKey)
+}
+
+// encryptedStorage wraps storage in an EncryptedStorage when keys is set and it isn't
+// encrypted already
+func encryptedStorage(storage Storage, keys KeyProvider) Storage {
+	if _, ok := storage.(*EncryptedStorage); ok || keys == nil {
+		return storage
+	}
+	return NewEncryptedStorage(storage, keys)
+}
+
+// localStorage returns the LocalStorage holding storage's files, if there is one
+func localStorage(storage Storage) (*LocalStorage, bool) {
+	if encrypted, ok := storage.(*EncryptedStorage); ok {
+		storage = encrypted.Storage
+	}
+	local, ok := storage.(*LocalStorage)
+	return local, ok
+}
+
+// decrypter reads the header of an encrypted object and unwraps its data key
+func (s *EncryptedStorage) decrypter(ctx context.Context, r io.ReadCloser, storedSize int64) (*decryptReader, error) {
+	h, err := readEncryptionHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := s.Keys.UnwrapKey(ctx, h.keyID, h.wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	headerSize := int64(len(h.raw))
+	size := plaintextSize(headerSize, storedSize, h.chunkSize)
+	if size < 0 {
+		return nil, fmt.Errorf("%w: truncated object", ErrDecryptionFailed)
+	}
+
+	return &decryptReader{
+		src:        r,
+		aead:       aead,
+		header:     h.raw,
+		headerSize: headerSize,
+		chunkSize:  h.chunkSize,
+		size:       size,
+		lastChunk:  max(size-1, 0) / h.chunkSize,
+		current:    -1,
+	}, nil
+}
+
+// encryptedHeader is the parsed header of an encrypted object
+type encryptedHeader struct {
+	raw       []byte
+	keyID     string
+	wrapped   []byte
+	chunkSize int64
+}
+
+// statHeaderSize is how much of an object Stat fetches first, enough for the headers of
+// common key providers. Larger headers take a second read.
+const statHeaderSize = 4 << 10
+
+// maxEncryptionHeader is the size of the largest possible header
+const maxEncryptionHeader = len(encryptionMagic) + 4 + 2 + 0xFFFF + 2 + 0xFFFF
+
+// readEncryptionHeader parses the header at the start of r without unwrapping the data key
+func readEncryptionHeader(r io.Reader) (*encryptedHeader, error) {
+	fixed := make([]byte, len(encryptionMagic)+4+2)
+	if _, err := io.ReadFull(r, fixed); err != nil || string(fixed[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, fmt.Errorf("%w: not an encrypted object", ErrDecryptionFailed)
+	}
+
+	chunkSize := int64(binary.BigEndian.Uint32(fixed[len(encryptionMagic):]))
+	if chunkSize == 0 || chunkSize > 16<<20 {
+		return nil, fmt.Errorf("%w: invalid chunk size", ErrDecryptionFailed)
+	}
+
+	keyID := make([]byte, binary.BigEndian.Uint16(fixed[len(fixed)-2:]))
+	lenWrapped := make([]byte, 2)
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	if _, err := io.ReadFull(r, lenWrapped); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint16(lenWrapped))
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+
+	return &encryptedHeader{
+		raw:       bytes.Join([][]byte{fixed, keyID, lenWrapped, wrapped}, nil),
+		keyID:     string(keyID),
+		wrapped:   wrapped,
+		chunkSize: chunkSize,
+	}, nil
+}
+
+// statHeader reads only the header of an object stored with size bytes
+func (s *EncryptedStorage) statHeader(ctx context.Context, key string, size int64) (*encryptedHeader, error) {
+	length := min(size, statHeaderSize)
+	for {
+		rc, err := GetObjectRange(ctx, s.Storage, key, 0, length)
+		if err != nil {
+			return nil, err
+		}
+		h, err := readEncryptionHeader(rc)
+		rc.Close()
+
+		// A header cut short by the first read is read again in full
+		truncated := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if truncated && length < min(size, int64(maxEncryptionHeader)) {
+			length = min(size, int64(maxEncryptionHeader))
+			continue
+		}
+		return h, err
+	}
+}
+
+func encryptionHeader(keyID string, wrapped []byte, chunkSize int) ([]byte, error) {
+	if len(keyID) > 0xFFFF || len(wrapped) > 0xFFFF {
+		return nil, errors.New("wrapped data key is too large")
+	}
+
+	header := []byte(encryptionMagic)
+	header = binary.BigEndian.AppendUint32(header, uint32(chunkSize))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(keyID)))
+	header = append(header, keyID...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	return append(header, wrapped...), nil
+}
+
+// chunkNonce is the nonce of chunk index, flagged when it's the last one
+func chunkNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(index))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// ciphertextSize is the stored size of size bytes of content. Empty content still gets
+// one (empty) final chunk.
+func ciphertextSize(headerSize, size, chunkSize int64) int64 {
+	chunks := max((size+chunkSize-1)/chunkSize, 1)
+	return headerSize + size + chunks*encryptionOverhead
+}
+
+// plaintextSize reverses ciphertextSize, returning -1 for impossible sizes
+func plaintextSize(headerSize, storedSize, chunkSize int64) int64 {
+	body := storedSize - headerSize
+	sealed := chunkSize + encryptionOverhead
+	full, rest := body/sealed, body%sealed
+
+	switch {
+	case body < encryptionOverhead:
+		return -1
+	case rest == 0:
+		return full * chunkSize
+	case rest < encryptionOverhead:
+		return -1
+	}
+	return full*chunkSize + rest - encryptionOverhead
+}
+
+// encryptReader streams the header followed by the sealed chunks of src
+type encryptReader struct {
+	aead   cipher.AEAD
+	header []byte
+	src    *bufio.Reader
+	chunk  []byte
+	index  int64
+	sealed []byte
+	// out holds what's left to read of the header or the last sealed chunk
+	out  []byte
+	done bool
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *encryptReader) sealNext() error {
+	n, err := io.ReadFull(r.src, r.chunk)
+	switch err {
+	case nil:
+		// A full chunk is the last one only if nothing follows it
+		if _, peekErr := r.src.Peek(1); peekErr == io.EOF {
+			r.done = true
+		} else if peekErr != nil {
+			return peekErr
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		r.done = true
+	default:
+		return err
+	}
+
+	r.out = r.aead.Seal(r.sealed[:0], chunkNonce(r.index, r.done), r.chunk[:n], r.header)
+	r.sealed = r.out
+	r.index++
+	return nil
+}
+
+// decryptReader decrypts an encrypted object chunk by chunk
+type decryptReader struct {
+	src        io.ReadCloser
+	aead       cipher.AEAD
+	header     []byte
+	headerSize int64
+	chunkSize  int64
+	// size is the plaintext size
+	size      int64
+	lastChunk int64
+	// current is the index of the decrypted chunk in plain, -1 before the first
+	current int64
+	plain   []byte
+	sealed  []byte
+	offset  int64
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		if r.current < 0 && r.size == 0 {
+			// Check the empty final chunk so a truncated object doesn't pass as empty
+			if err := r.load(0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+
+	index := r.offset / r.chunkSize
+	if index != r.current {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain[r.offset-index*r.chunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// load decrypts chunk index, which the source must be positioned at
+func (r *decryptReader) load(index int64) error {
+	if r.sealed == nil {
+		r.sealed = make([]byte, r.chunkSize+encryptionOverhead)
+	}
+
+	n, err := io.ReadFull(r.src, r.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return fmt.Errorf("%w: truncated object", ErrDecryptionFailed)
+		}
+		return err
+	}
+
+	plain, err := r.aead.Open(r.plain[:0], chunkNonce(index, index == r.lastChunk), r.sealed[:n], r.header)
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+	r.plain = plain
+	r.current = index
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.src.Close()
+}
+
+// seekableDecryptReader seeks within the plaintext, reading only the chunks it needs
+type seekableDecryptReader struct {
+	*decryptReader
+	seeker io.Seeker
+}
+
+func (r *seekableDecryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	// Position the source at the chunk holding offset, unless it's already decrypted
+	if index := offset / r.chunkSize; offset < r.size && index != r.current {
+		if _, err := r.seeker.Seek(r.headerSize+index*(r.chunkSize+encryptionOverhead), io.SeekStart); err != nil {
+			return 0, err
+		}
+		r.current = -1
+	}
+
+	r.offset = offset
+	return offset, nil
+}
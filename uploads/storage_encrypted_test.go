@@ -0,0 +1,294 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testKeyProvider(t *testing.T) *StaticKeyProvider {
+	t.Helper()
+	keys, err := NewStaticKeyProvider("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func randomContent(n int) []byte {
+	content := make([]byte, n)
+	rand.Read(content)
+	return content
+}
+
+func TestEncryptedStorageRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryStorage()
+	storage := NewEncryptedStorage(inner, testKeyProvider(t))
+
+	for _, size := range []int{0, 1, encryptionChunk - 1, encryptionChunk, encryptionChunk + 1, 3*encryptionChunk + 100} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			content := randomContent(size)
+			key := fmt.Sprintf("file-%d", size)
+
+			info, err := storage.Put(ctx, key, bytes.NewReader(content), PutOptions{Size: int64(size)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size != int64(size) {
+				t.Errorf("Put size = %d", info.Size)
+			}
+
+			stored, _ := inner.Stat(ctx, key)
+			if stored.Size <= int64(size) {
+				t.Errorf("stored size = %d, want more than the content", stored.Size)
+			}
+
+			rc, got, err := storage.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			data, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, content) || got.Size != int64(size) {
+				t.Errorf("decrypted %d bytes, size %d", len(data), got.Size)
+			}
+
+			if stat, err := storage.Stat(ctx, key); err != nil || stat.Size != int64(size) {
+				t.Errorf("Stat = %+v, %v", stat, err)
+			}
+		})
+	}
+}
+
+func TestEncryptedStorageDetectsTampering(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryStorage()
+	storage := NewEncryptedStorage(inner, testKeyProvider(t))
+
+	content := randomContent(2*encryptionChunk + 10)
+	storage.Put(ctx, "file", bytes.NewReader(content), PutOptions{})
+	rc, _, _ := inner.Get(ctx, "file")
+	sealed, _ := io.ReadAll(rc)
+	rc.Close()
+
+	read := func(data []byte) error {
+		inner.Put(ctx, "tampered", bytes.NewReader(data), PutOptions{})
+		rc, _, err := storage.Get(ctx, "tampered")
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.ReadAll(rc)
+		return err
+	}
+
+	// The content fills two chunks and 10 bytes of a third
+	chunk := encryptionChunk + encryptionOverhead
+	header := sealed[:len(sealed)-2*chunk-10-encryptionOverhead]
+	chunks := [][]byte{
+		sealed[len(header) : len(header)+chunk],
+		sealed[len(header)+chunk : len(header)+2*chunk],
+		sealed[len(header)+2*chunk:],
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[len(header)+chunk+100] ^= 1
+
+	for name, data := range map[string][]byte{
+		"flipped bit":        flipped,
+		"truncated":          sealed[:len(sealed)-5],
+		"last chunk dropped": bytes.Join([][]byte{header, chunks[0], chunks[1]}, nil),
+		"chunks swapped":     bytes.Join([][]byte{header, chunks[1], chunks[0], chunks[2]}, nil),
+		"header only":        header,
+		"not encrypted":      []byte("plain text"),
+	} {
+		if err := read(data); !errors.Is(err, ErrDecryptionFailed) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+
+	if err := read(sealed); err != nil {
+		t.Errorf("untouched copy: %v", err)
+	}
+}
+
+// countingKeys counts the data keys a KeyProvider unwraps
+type countingKeys struct {
+	KeyProvider
+	unwraps int
+}
+
+func (k *countingKeys) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	k.unwraps++
+	return k.KeyProvider.UnwrapKey(ctx, keyID, wrapped)
+}
+
+func TestEncryptedStorageStatReadsOnlyTheHeader(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeS3{bucket: "test-bucket", objects: make(map[string]fakeS3Object)}
+	var ranges []string
+	server := httptest.NewServer(fake.verify(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+		fake.serve(w, r)
+	})))
+	defer server.Close()
+	keys := &countingKeys{KeyProvider: testKeyProvider(t)}
+	storage := NewEncryptedStorage(newTestS3Storage(t, server.URL), keys)
+
+	content := randomContent(3*encryptionChunk + 100)
+	if _, err := storage.Put(ctx, "video.bin", bytes.NewReader(content), PutOptions{Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := storage.Stat(ctx, "video.bin")
+	if err != nil || info.Size != int64(len(content)) {
+		t.Fatalf("Stat() = %+v, %v", info, err)
+	}
+	if keys.unwraps != 0 {
+		t.Errorf("Stat() unwrapped %d data keys, want none", keys.unwraps)
+	}
+	if len(ranges) != 1 || ranges[0] != fmt.Sprintf("bytes=0-%d", statHeaderSize-1) {
+		t.Errorf("Stat() GETs with ranges %q, want one for the header", ranges)
+	}
+
+	// Headers past the first read are read again in full
+	long, err := NewStaticKeyProvider(strings.Repeat("k", 2*statHeaderSize), map[string][]byte{strings.Repeat("k", 2*statHeaderSize): bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := NewEncryptedStorage(NewMemoryStorage(), long)
+	memory.Put(ctx, "a.txt", strings.NewReader("hello"), PutOptions{})
+	if info, err := memory.Stat(ctx, "a.txt"); err != nil || info.Size != 5 {
+		t.Errorf("Stat() with a long header = %+v, %v", info, err)
+	}
+
+	// Objects that aren't encrypted still fail
+	memory.Storage.Put(ctx, "plain.txt", strings.NewReader("plain text"), PutOptions{})
+	if _, err := memory.Stat(ctx, "plain.txt"); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Stat() of a plain object = %v, want ErrDecryptionFailed", err)
+	}
+}
+
+func TestStaticKeyProviderRotation(t *testing.T) {
+	ctx := context.Background()
+	keys := testKeyProvider(t)
+	storage := NewEncryptedStorage(NewMemoryStorage(), keys)
+
+	storage.Put(ctx, "old", strings.NewReader("old content"), PutOptions{})
+	if err := keys.Rotate("k2", bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	storage.Put(ctx, "new", strings.NewReader("new content"), PutOptions{})
+
+	for key, want := range map[string]string{"old": "old content", "new": "new content"} {
+		rc, _, err := storage.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != want {
+			t.Errorf("%s = %q", key, data)
+		}
+	}
+
+	// Without the old key, only the new file can be read
+	retired, _ := NewStaticKeyProvider("k2", map[string][]byte{"k2": bytes.Repeat([]byte{2}, 32)})
+	storage.Keys = retired
+	if _, _, err := storage.Get(ctx, "old"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("old file without its key: err = %v", err)
+	}
+	if rc, _, err := storage.Get(ctx, "new"); err != nil {
+		t.Errorf("new file: %v", err)
+	} else {
+		rc.Close()
+	}
+
+	if _, err := NewStaticKeyProvider("k1", map[string][]byte{"k1": []byte("short")}); err == nil {
+		t.Errorf("short key accepted")
+	}
+}
+
+func TestSaveAndServeEncrypted(t *testing.T) {
+	keys := testKeyProvider(t)
+	opts := &FileUploadOptions{
+		DestinationDir:   t.TempDir(),
+		MaxSize:          1 << 20,
+		AllowedMimeTypes: []string{"application/octet-stream"},
+		Encryption:       keys,
+	}
+
+	content := randomContent(3*encryptionChunk + 500)
+	saved, err := SaveUploadedFile(createTestFileHeader("data.bin", content), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Size != int64(len(content)) || saved.SavedPath == "" {
+		t.Fatalf("saved = %+v", saved)
+	}
+
+	onDisk, _ := os.ReadFile(saved.SavedPath)
+	if bytes.Contains(onDisk, content[:64]) {
+		t.Errorf("file stored in plain text")
+	}
+
+	serve := func(rangeHeader string, opts DownloadOptions) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/download", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rr := httptest.NewRecorder()
+		if err := ServeFileForDownload(rr, req, saved.SavedPath, opts); err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+
+	rr := serve("", DownloadOptions{Encryption: keys})
+	if !bytes.Equal(rr.Body.Bytes(), content) || rr.Header().Get("Content-Length") != fmt.Sprint(len(content)) {
+		t.Errorf("full download: %d bytes, Content-Length %s", rr.Body.Len(), rr.Header().Get("Content-Length"))
+	}
+
+	for _, r := range [][2]int{
+		{0, 9},
+		{encryptionChunk - 5, encryptionChunk + 5},
+		{encryptionChunk, 2*encryptionChunk - 1},
+		{encryptionChunk + 10, 3*encryptionChunk + 20},
+		{len(content) - 10, len(content) - 1},
+	} {
+		rr := serve(fmt.Sprintf("bytes=%d-%d", r[0], r[1]), DownloadOptions{Encryption: keys})
+		if rr.Code != http.StatusPartialContent || !bytes.Equal(rr.Body.Bytes(), content[r[0]:r[1]+1]) {
+			t.Errorf("range %v: status %d, %d bytes", r, rr.Code, rr.Body.Len())
+		}
+	}
+
+	rr = serve("bytes=0-9,150000-150009", DownloadOptions{Encryption: keys})
+	if rr.Code != http.StatusPartialContent || !bytes.Contains(rr.Body.Bytes(), content[150000:150010]) || !bytes.Contains(rr.Body.Bytes(), content[:10]) {
+		t.Errorf("multipart range: status %d", rr.Code)
+	}
+
+	if rr := serve("", DownloadOptions{}); bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("served decrypted content without a key provider")
+	}
+
+	if err := DeleteSavedFile(context.Background(), saved, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(saved.SavedPath); !os.IsNotExist(err) {
+		t.Errorf("file still on disk after delete")
+	}
+}
@@ -0,0 +1,302 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStorage stores objects as files under a root directory
+type LocalStorage struct {
+	Root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+// Path returns the filesystem path for key
+func (s *LocalStorage) Path(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+// localTempPrefix marks files that are still being written. List skips them.
+const localTempPrefix = ".tmp-"
+
+// Put writes to a temporary file next to the destination, syncs it and renames it into
+// place, so readers never see a half-written file and a failed write leaves nothing behind.
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (ObjectInfo, error) {
+	p, err := s.Path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, localTempPrefix+filepath.Base(p)+"-*")
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to create destination file: %w", err)
+	}
+
+	// Removing the temp file is a no-op once it's been renamed
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, contextReader{ctx: ctx, r: r}); err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to sync destination file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to close destination file: %w", err)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to set file permissions: %w", err)
+	}
+
+	if opts.IfNotExists {
+		err = linkNoClobber(tmp.Name(), p)
+		if errors.Is(err, fs.ErrExist) {
+			return ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectExists, key)
+		}
+	} else {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to move file into place: %w", err)
+	}
+
+	syncDir(dir)
+
+	return s.Stat(ctx, key)
+}
+
+// linkNoClobber puts src at dst unless dst exists. Hard links fail atomically when dst
+// exists; filesystems without them fall back to a check before renaming.
+func linkNoClobber(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil || errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	if _, statErr := os.Lstat(dst); statErr == nil {
+		return fs.ErrExist
+	}
+	return os.Rename(src, dst)
+}
+
+// syncDir flushes a directory entry so a rename survives a crash. Not every platform
+// supports it, so errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	p, _ := s.Path(key)
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	return file, info, nil
+}
+
+func (s *LocalStorage) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	rc, _, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	file := rc.(*os.File)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek file: %w", err)
+	}
+	return limitedReadCloser{io.LimitReader(file, length), file}, nil
+}
+
+func (s *LocalStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := s.Path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+		}
+		return ObjectInfo{}, fmt.Errorf("error accessing file: %w", err)
+	}
+
+	if fi.IsDir() {
+		return ObjectInfo{}, fmt.Errorf("%w: %s is a directory", ErrObjectNotFound, key)
+	}
+
+	cleaned, _ := CleanKey(key)
+	return localObjectInfo(cleaned, fi), nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	p, err := s.Path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) Move(ctx context.Context, srcKey, dstKey string) error {
+	src, err := s.Path(srcKey)
+	if err != nil {
+		return err
+	}
+	dst, err := s.Path(dstKey)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %s", ErrObjectNotFound, srcKey)
+		}
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) MoveIfNotExists(ctx context.Context, srcKey, dstKey string) error {
+	src, err := s.Path(srcKey)
+	if err != nil {
+		return err
+	}
+	dst, err := s.Path(dstKey)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	if err := linkNoClobber(src, dst); err != nil {
+		switch {
+		case errors.Is(err, fs.ErrExist):
+			return fmt.Errorf("%w: %s", ErrObjectExists, dstKey)
+		case errors.Is(err, fs.ErrNotExist):
+			return fmt.Errorf("%w: %s", ErrObjectNotFound, srcKey)
+		}
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	// A hard link leaves the source in place, a rename doesn't
+	if err := os.Remove(src); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove moved file: %w", err)
+	}
+
+	syncDir(filepath.Dir(dst))
+	return nil
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(s.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			// Skip directories that can't contain matching keys
+			if key != "." && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasPrefix(key, prefix) || strings.HasPrefix(d.Name(), localTempPrefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, localObjectInfo(key, fi))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func localObjectInfo(key string, fi fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:         key,
+		Size:        fi.Size(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+		ModTime:     fi.ModTime(),
+		ETag:        fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()),
+	}
+}
+
+// contextReader stops reading once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
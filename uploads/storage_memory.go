@@ -0,0 +1,164 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps objects in memory. It's meant for tests.
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: make(map[string]memoryObject)}
+}
+
+func (s *MemoryStorage) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	data, err := io.ReadAll(contextReader{ctx: ctx, r: r})
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	sum := md5.Sum(data)
+	info := ObjectInfo{
+		Key:         key,
+		Size:        int64(len(data)),
+		ContentType: opts.ContentType,
+		ModTime:     time.Now(),
+		ETag:        `"` + hex.EncodeToString(sum[:]) + `"`,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.objects[key]; exists && opts.IfNotExists {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectExists, key)
+	}
+	s.objects[key] = memoryObject{data: data, info: info}
+
+	return info, nil
+}
+
+func (s *MemoryStorage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	obj, err := s.lookup(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return readSeekCloser{bytes.NewReader(obj.data)}, obj.info, nil
+}
+
+func (s *MemoryStorage) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	obj, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	start := min(max(offset, 0), int64(len(obj.data)))
+	end := min(start+max(length, 0), int64(len(obj.data)))
+	return io.NopCloser(bytes.NewReader(obj.data[start:end])), nil
+}
+
+func (s *MemoryStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	obj, err := s.lookup(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return obj.info, nil
+}
+
+func (s *MemoryStorage) Delete(ctx context.Context, key string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.objects, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStorage) Move(ctx context.Context, srcKey, dstKey string) error {
+	return s.move(srcKey, dstKey, false)
+}
+
+func (s *MemoryStorage) MoveIfNotExists(ctx context.Context, srcKey, dstKey string) error {
+	return s.move(srcKey, dstKey, true)
+}
+
+func (s *MemoryStorage) move(srcKey, dstKey string, noClobber bool) error {
+	srcKey, err := CleanKey(srcKey)
+	if err != nil {
+		return err
+	}
+	dstKey, err = CleanKey(dstKey)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[srcKey]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, srcKey)
+	}
+	if _, exists := s.objects[dstKey]; exists && noClobber {
+		return fmt.Errorf("%w: %s", ErrObjectExists, dstKey)
+	}
+
+	obj.info.Key = dstKey
+	delete(s.objects, srcKey)
+	s.objects[dstKey] = obj
+	return nil
+}
+
+func (s *MemoryStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var objects []ObjectInfo
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, obj.info)
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *MemoryStorage) lookup(key string) (memoryObject, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return memoryObject{}, err
+	}
+
+	s.mu.RLock()
+	obj, ok := s.objects[key]
+	s.mu.RUnlock()
+
+	if !ok {
+		return memoryObject{}, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return obj, nil
+}
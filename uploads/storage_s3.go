@@ -0,0 +1,589 @@
+package uploads
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+type S3Options struct {
+	// Endpoint is the service URL, e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// VirtualHostStyle addresses the bucket as a subdomain instead of the first path segment
+	VirtualHostStyle bool
+	Client           *http.Client
+}
+
+// S3Storage stores objects in an S3-compatible bucket using plain HTTP requests signed
+// with AWS Signature Version 4.
+type S3Storage struct {
+	opts     S3Options
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+func NewS3Storage(opts S3Options) (*S3Storage, error) {
+	if opts.Bucket == "" {
+		return nil, errors.New("s3: bucket is required")
+	}
+
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", opts.Endpoint)
+	}
+
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &S3Storage{opts: opts, endpoint: endpoint, client: client, now: time.Now}, nil
+}
+
+// S3Error is an error response returned by the service
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	size := opts.Size
+	if size <= 0 {
+		// S3 needs a content length up front, so spool unknown-length bodies to disk
+		tmp, err := os.CreateTemp("", "bindle-s3-*")
+		if err != nil {
+			return ObjectInfo{}, fmt.Errorf("failed to create temp file: %w", err)
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if size, err = io.Copy(tmp, contextReader{ctx: ctx, r: r}); err != nil {
+			return ObjectInfo{}, fmt.Errorf("failed to buffer file: %w", err)
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return ObjectInfo{}, fmt.Errorf("failed to rewind temp file: %w", err)
+		}
+		r = tmp
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, io.LimitReader(r, size))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	req.ContentLength = size
+	if opts.ContentType != "" {
+		req.Header.Set("Content-Type", opts.ContentType)
+	}
+	if opts.IfNotExists {
+		req.Header.Set("If-None-Match", "*")
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		var s3Err *S3Error
+		if opts.IfNotExists && errors.As(err, &s3Err) &&
+			(s3Err.StatusCode == http.StatusPreconditionFailed || s3Err.StatusCode == http.StatusConflict) {
+			return ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectExists, key)
+		}
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+
+	return ObjectInfo{
+		Key:         key,
+		Size:        size,
+		ContentType: opts.ContentType,
+		ModTime:     s.now(),
+		ETag:        resp.Header.Get("ETag"),
+	}, nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	info := s3ObjectInfo(key, resp)
+	return &s3ObjectReader{ctx: ctx, storage: s, info: info, body: resp.Body}, info, nil
+}
+
+// s3ObjectReader reads an object and supports seeking by reopening it with a ranged GET
+// at the new offset, so Range requests only fetch the bytes they need
+type s3ObjectReader struct {
+	ctx     context.Context
+	storage *S3Storage
+	info    ObjectInfo
+	body    io.ReadCloser
+	// bodyPos is the offset body is at, pos the offset the next Read should start from
+	bodyPos int64
+	pos     int64
+}
+
+func (r *s3ObjectReader) Read(p []byte) (int, error) {
+	if r.pos >= r.info.Size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil || r.bodyPos != r.pos {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	r.bodyPos = r.pos
+	return n, err
+}
+
+func (r *s3ObjectReader) open() error {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+
+	req, err := r.storage.newRequest(r.ctx, http.MethodGet, r.info.Key, nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.pos))
+	if r.info.ETag != "" {
+		// Don't stitch together bytes from two versions of the object
+		req.Header.Set("If-Match", r.info.ETag)
+	}
+
+	resp, err := r.storage.do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent && r.pos != 0 {
+		resp.Body.Close()
+		return fmt.Errorf("s3: range request for %s returned %d", r.info.Key, resp.StatusCode)
+	}
+
+	r.body = resp.Body
+	r.bodyPos = r.pos
+	return nil
+}
+
+func (r *s3ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.info.Size
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *s3ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// GetRange fetches only the requested bytes with a ranged GET
+func (s *S3Storage) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if length <= 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: range request for %s returned %d", key, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+
+	return s3ObjectInfo(key, resp), nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Move copies the object server-side and deletes the original
+func (s *S3Storage) Move(ctx context.Context, srcKey, dstKey string) error {
+	return s.move(ctx, srcKey, dstKey, false)
+}
+
+// MoveIfNotExists copies the object server-side with If-None-Match, so the copy fails
+// rather than replacing an existing object, and deletes the original
+func (s *S3Storage) MoveIfNotExists(ctx context.Context, srcKey, dstKey string) error {
+	return s.move(ctx, srcKey, dstKey, true)
+}
+
+func (s *S3Storage) move(ctx context.Context, srcKey, dstKey string, noClobber bool) error {
+	srcKey, err := CleanKey(srcKey)
+	if err != nil {
+		return err
+	}
+	dstKey, err = CleanKey(dstKey)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPut, dstKey, nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Amz-Copy-Source", s3EscapePath("/"+s.opts.Bucket+"/"+srcKey))
+	if noClobber {
+		req.Header.Set("If-None-Match", "*")
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		var s3Err *S3Error
+		if noClobber && errors.As(err, &s3Err) &&
+			(s3Err.StatusCode == http.StatusPreconditionFailed || s3Err.StatusCode == http.StatusConflict) {
+			return fmt.Errorf("%w: %s", ErrObjectExists, dstKey)
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	return s.Delete(ctx, srcKey)
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: failed to decode list response: %w", err)
+		}
+
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     c.Key,
+				Size:    c.Size,
+				ModTime: c.LastModified,
+				ETag:    c.ETag,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *S3Storage) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	objectPath := strings.TrimSuffix(u.Path, "/")
+	if s.opts.VirtualHostStyle {
+		u.Host = s.opts.Bucket + "." + u.Host
+		objectPath += "/" + key
+	} else {
+		objectPath += "/" + s.opts.Bucket + "/" + key
+		if key == "" {
+			objectPath = strings.TrimSuffix(objectPath, "/")
+		}
+	}
+	// Keep our own escaping of the path so it matches what gets signed
+	u.Path = objectPath
+	u.RawPath = s3EscapePath(objectPath)
+	u.RawQuery = ""
+	if query != nil {
+		u.RawQuery = s3CanonicalQuery(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("s3: failed to build request: %w", err)
+	}
+	return req, nil
+}
+
+func (s *S3Storage) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: request failed: %w", err)
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, req.URL.Path)
+	}
+
+	s3Err := &S3Error{StatusCode: resp.StatusCode}
+	if req.Method != http.MethodHead {
+		xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(s3Err)
+	}
+	if s3Err.Code == "" {
+		s3Err.Code = http.StatusText(resp.StatusCode)
+	}
+	return nil, s3Err
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+func (s *S3Storage) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "content-md5" || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalPath := req.URL.EscapedPath()
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := date + "/" + s.opts.Region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := s3HMAC([]byte("AWS4"+s.opts.SecretAccessKey), date)
+	key = s3HMAC(key, s.opts.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opts.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func s3ObjectInfo(key string, resp *http.Response) ObjectInfo {
+	info := ObjectInfo{
+		Key:         key,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+	}
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		info.Size = size
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything except the unreserved characters, as SigV4 requires
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
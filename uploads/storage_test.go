@@ -0,0 +1,219 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testStorage runs the behaviour every Storage implementation must share
+func testStorage(t *testing.T, storage Storage) {
+	ctx := context.Background()
+
+	info, err := storage.Put(ctx, "docs/report.txt", strings.NewReader("hello world"), PutOptions{ContentType: "text/plain"})
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if info.Key != "docs/report.txt" || info.Size != 11 {
+		t.Errorf("Put() info = %+v", info)
+	}
+
+	if _, err := storage.Put(ctx, "docs/a/b.txt", strings.NewReader("b"), PutOptions{Size: 1}); err != nil {
+		t.Fatalf("Put() nested error = %v", err)
+	}
+	if _, err := storage.Put(ctx, "other.txt", strings.NewReader("o"), PutOptions{}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	rc, info, err := storage.Get(ctx, "docs/report.txt")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "hello world" || info.Size != 11 {
+		t.Errorf("Get() = %q, %+v", data, info)
+	}
+
+	if info, err := storage.Stat(ctx, "docs/report.txt"); err != nil || info.Size != 11 || info.ETag == "" {
+		t.Errorf("Stat() = %+v, %v", info, err)
+	}
+
+	objects, err := storage.List(ctx, "docs/")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(objects) != 2 || objects[0].Key != "docs/a/b.txt" || objects[1].Key != "docs/report.txt" {
+		t.Errorf("List() = %+v", objects)
+	}
+
+	if err := MoveObject(ctx, storage, "other.txt", "moved/other.txt"); err != nil {
+		t.Fatalf("MoveObject() error = %v", err)
+	}
+	if _, err := storage.Stat(ctx, "other.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Stat() of moved source = %v, want ErrObjectNotFound", err)
+	}
+	if info, err := storage.Stat(ctx, "moved/other.txt"); err != nil || info.Size != 1 {
+		t.Errorf("Stat() of move destination = %+v, %v", info, err)
+	}
+
+	storage.Put(ctx, "other.txt", strings.NewReader("other"), PutOptions{})
+	if err := MoveObjectIfNotExists(ctx, storage, "other.txt", "moved/other.txt"); !errors.Is(err, ErrObjectExists) {
+		t.Errorf("MoveObjectIfNotExists() onto existing object = %v, want ErrObjectExists", err)
+	}
+	if info, _ := storage.Stat(ctx, "moved/other.txt"); info.Size != 1 {
+		t.Errorf("MoveObjectIfNotExists() replaced the existing object: %+v", info)
+	}
+	if err := MoveObjectIfNotExists(ctx, storage, "other.txt", "moved/again.txt"); err != nil {
+		t.Fatalf("MoveObjectIfNotExists() error = %v", err)
+	}
+	if _, err := storage.Stat(ctx, "other.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Stat() of source moved without clobbering = %v, want ErrObjectNotFound", err)
+	}
+	if info, err := storage.Stat(ctx, "moved/again.txt"); err != nil || info.Size != 5 {
+		t.Errorf("Stat() of no-clobber move destination = %+v, %v", info, err)
+	}
+
+	if _, err := storage.Put(ctx, "docs/a/b.txt", strings.NewReader("new"), PutOptions{Size: 3, IfNotExists: true}); !errors.Is(err, ErrObjectExists) {
+		t.Errorf("Put() IfNotExists over existing object = %v, want ErrObjectExists", err)
+	}
+	if info, _ := storage.Stat(ctx, "docs/a/b.txt"); info.Size != 1 {
+		t.Errorf("Put() IfNotExists replaced the existing object: %+v", info)
+	}
+	if _, err := storage.Put(ctx, "docs/new.txt", strings.NewReader("new"), PutOptions{Size: 3, IfNotExists: true}); err != nil {
+		t.Errorf("Put() IfNotExists on free key = %v", err)
+	}
+
+	if err := storage.Delete(ctx, "docs/report.txt"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := storage.Stat(ctx, "docs/report.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Stat() after Delete = %v, want ErrObjectNotFound", err)
+	}
+	if err := storage.Delete(ctx, "docs/report.txt"); err != nil {
+		t.Errorf("Delete() of missing object = %v, want nil", err)
+	}
+
+	if _, err := storage.Put(ctx, "../escape.txt", strings.NewReader("x"), PutOptions{}); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Put() with escaping key = %v, want ErrInvalidKey", err)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	testStorage(t, NewLocalStorage(t.TempDir()))
+}
+
+// failingReader returns some data and then an error, like a dropped connection
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestLocalStorageAtomicPut(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	storage := NewLocalStorage(root)
+
+	if _, err := storage.Put(ctx, "report.pdf", strings.NewReader("original"), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := storage.Put(ctx, "report.pdf", &failingReader{data: []byte("half")}, PutOptions{}); err == nil {
+		t.Fatal("Put() with failing reader succeeded")
+	}
+
+	p, _ := storage.Path("report.pdf")
+	if data, _ := os.ReadFile(p); string(data) != "original" {
+		t.Errorf("file after failed Put = %q, want the original untouched", data)
+	}
+
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d entries after failed Put, want no temp files left", len(entries))
+	}
+
+	if fi, _ := os.Stat(p); fi.Mode().Perm() != 0o644 {
+		t.Errorf("file mode = %v, want 0644", fi.Mode().Perm())
+	}
+
+	// Files still being written don't show up in listings
+	os.WriteFile(filepath.Join(root, localTempPrefix+"report.pdf-123"), []byte("x"), 0o644)
+	if objects, _ := storage.List(ctx, ""); len(objects) != 1 {
+		t.Errorf("List() = %+v, want temp files skipped", objects)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryStorage())
+}
+
+func TestCleanKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "a/b.txt", want: "a/b.txt"},
+		{key: "a/./c/../b.txt", want: "a/b.txt"},
+		{key: `a\b.txt`, want: "a/b.txt"},
+		{key: "", wantErr: true},
+		{key: "/etc/passwd", wantErr: true},
+		{key: "../x", wantErr: true},
+		{key: "a/../../x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := CleanKey(tt.key)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("CleanKey(%q) = %q, %v; want %q, err %v", tt.key, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGetObjectRange(t *testing.T) {
+	ctx := context.Background()
+	local := NewLocalStorage(t.TempDir())
+	memory := NewMemoryStorage()
+	// Storages without a RangeGetter are read through Get
+	plain := struct{ Storage }{NewMemoryStorage()}
+
+	for name, storage := range map[string]Storage{"local": local, "memory": memory, "plain": plain} {
+		storage.Put(ctx, "a.txt", strings.NewReader("0123456789"), PutOptions{})
+
+		rc, err := GetObjectRange(ctx, storage, "a.txt", 3, 4)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != "3456" {
+			t.Errorf("%s: range = %q, want 3456", name, data)
+		}
+
+		rc, err = GetObjectRange(ctx, storage, "a.txt", 8, 10)
+		if err != nil {
+			t.Fatalf("%s: range past the end: %v", name, err)
+		}
+		data, _ = io.ReadAll(rc)
+		rc.Close()
+		if string(data) != "89" {
+			t.Errorf("%s: range past the end = %q, want 89", name, data)
+		}
+
+		if _, err := GetObjectRange(ctx, storage, "missing.txt", 0, 1); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("%s: missing object = %v, want ErrObjectNotFound", name, err)
+		}
+	}
+}
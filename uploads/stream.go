@@ -0,0 +1,99 @@
+package uploads
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+// StreamSingleFormFile saves the first file sent under fieldName, reading the multipart body
+// as it arrives instead of buffering it with ParseMultipartForm. Parts before it are skipped
+// and the rest of the body is left unread.
+func StreamSingleFormFile(r *http.Request, fieldName string, opts *FileUploadOptions) (*SavedFile, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read multipart form: %w", err)
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no file uploaded with field name '%s'", fieldName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read multipart form: %w", err)
+		}
+
+		if part.FormName() != fieldName || partFilename(part.Header, part.FileName()) == "" {
+			part.Close()
+			continue
+		}
+
+		savedFile, err := saveFilePart(r.Context(), part, opts)
+		part.Close()
+		return savedFile, err
+	}
+}
+
+// StreamFormFiles saves every file sent under fieldName while reading the multipart body.
+// Each file is validated from its first bytes and written straight to storage, so oversized
+// or disallowed files are rejected without spooling the whole request to disk first.
+// If any file fails, the files already saved are removed.
+func StreamFormFiles(r *http.Request, fieldName string, opts *FileUploadOptions) ([]*SavedFile, error) {
+	if opts == nil {
+		defaultOpts := DefaultOptions()
+		opts = &defaultOpts
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read multipart form: %w", err)
+	}
+
+	var savedFiles []*SavedFile
+	rollback := func() {
+		for _, saved := range savedFiles {
+			DeleteSavedFile(context.WithoutCancel(r.Context()), saved, opts)
+		}
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("failed to read multipart form: %w", err)
+		}
+
+		if part.FormName() != fieldName || partFilename(part.Header, part.FileName()) == "" {
+			part.Close()
+			continue
+		}
+
+		savedFile, err := saveFilePart(r.Context(), part, opts)
+		part.Close()
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("failed to save %q: %w", part.FileName(), err)
+		}
+
+		savedFiles = append(savedFiles, savedFile)
+	}
+
+	if len(savedFiles) == 0 {
+		return nil, fmt.Errorf("no files uploaded with the given field name '%s'", fieldName)
+	}
+
+	return savedFiles, nil
+}
+
+func saveFilePart(ctx context.Context, part *multipart.Part, opts *FileUploadOptions) (*SavedFile, error) {
+	return saveFile(ctx, fileSource{
+		filename: partFilename(part.Header, part.FileName()),
+		header:   part.Header,
+	}, part, opts)
+}
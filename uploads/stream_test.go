@@ -0,0 +1,131 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testPart struct {
+	field    string
+	filename string
+	content  []byte
+}
+
+func newMultipartRequest(parts ...testPart) *http.Request {
+	buf := new(bytes.Buffer)
+	writer := multipart.NewWriter(buf)
+	for _, p := range parts {
+		if p.filename == "" {
+			writer.WriteField(p.field, string(p.content))
+			continue
+		}
+		part, _ := writer.CreateFormFile(p.field, p.filename)
+		part.Write(p.content)
+	}
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestStreamFormFiles(t *testing.T) {
+	storage := NewMemoryStorage()
+	opts := &FileUploadOptions{Storage: storage, MaxSize: 1024}
+
+	req := newMultipartRequest(
+		testPart{field: "title", content: []byte("holiday")},
+		testPart{field: "files", filename: "a.txt", content: []byte("first file")},
+		testPart{field: "other", filename: "skip.txt", content: []byte("skipped")},
+		testPart{field: "files", filename: "b.txt", content: []byte("second file!")},
+	)
+
+	savedFiles, err := StreamFormFiles(req, "files", opts)
+	if err != nil {
+		t.Fatalf("StreamFormFiles() error = %v", err)
+	}
+
+	if len(savedFiles) != 2 || savedFiles[0].Size != 10 || savedFiles[1].Size != 12 {
+		t.Fatalf("unexpected saved files: %+v %+v", savedFiles[0], savedFiles[1])
+	}
+
+	objects, _ := storage.List(req.Context(), "")
+	if len(objects) != 2 {
+		t.Errorf("expected 2 stored objects, got %d", len(objects))
+	}
+}
+
+func TestStreamFormFilesAbortsEarly(t *testing.T) {
+	storage := NewMemoryStorage()
+	opts := &FileUploadOptions{Storage: storage, MaxSize: 1024}
+
+	req := newMultipartRequest(
+		testPart{field: "files", filename: "ok.txt", content: []byte("fine")},
+		testPart{field: "files", filename: "big.txt", content: bytes.Repeat([]byte("x"), 4096)},
+	)
+
+	_, err := StreamFormFiles(req, "files", opts)
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("StreamFormFiles() error = %v, want ErrFileTooLarge", err)
+	}
+
+	if objects, _ := storage.List(req.Context(), ""); len(objects) != 0 {
+		t.Errorf("expected rollback to remove saved files, found %d", len(objects))
+	}
+}
+
+func TestStreamSingleFormFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		parts   []testPart
+		opts    FileUploadOptions
+		wantErr error
+	}{
+		{
+			name:  "saves first matching file",
+			parts: []testPart{{field: "file", filename: "notes.txt", content: []byte("notes")}},
+			opts:  FileUploadOptions{MaxSize: 1024},
+		},
+		{
+			name:    "rejects extension before reading content",
+			parts:   []testPart{{field: "file", filename: "run.exe", content: []byte("MZ")}},
+			opts:    FileUploadOptions{MaxSize: 1024, AllowedExts: []string{"txt"}},
+			wantErr: ErrInvalidFileType,
+		},
+		{
+			name:    "rejects empty file",
+			parts:   []testPart{{field: "file", filename: "empty.txt"}},
+			opts:    FileUploadOptions{MaxSize: 1024},
+			wantErr: ErrEmptyFile,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Storage = NewMemoryStorage()
+
+			savedFile, err := StreamSingleFormFile(newMultipartRequest(tt.parts...), "file", &tt.opts)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			rc, _, _ := tt.opts.Storage.Get(context.Background(), savedFile.Key)
+			data, _ := io.ReadAll(rc)
+			if !bytes.Equal(data, tt.parts[0].content) {
+				t.Errorf("stored %q, want %q", data, tt.parts[0].content)
+			}
+		})
+	}
+}
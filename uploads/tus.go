@@ -0,0 +1,604 @@
+package uploads
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddddami/bindle/jsonx"
+	"github.com/ddddami/bindle/random"
+)
+
+// TusVersion is the tus protocol version implemented by TusHandler
+const TusVersion = "1.0.0"
+
+const tusOffsetContentType = "application/offset+octet-stream"
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrUploadExpired  = errors.New("upload has expired")
+	ErrOffsetMismatch = errors.New("upload offset does not match")
+	// ErrTusEncryptionUnsupported is returned by NewTusHandler when Upload.Encryption is set,
+	// since incomplete uploads would sit unencrypted in PartialDir
+	ErrTusEncryptionUnsupported = errors.New("tus uploads can't be encrypted at rest")
+)
+
+// TusUpload is the state of a resumable upload
+type TusUpload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"offset"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at,omitempty"`
+	// Sniffed is set once the content type of the first bytes has been checked
+	Sniffed bool `json:"sniffed"`
+	// QuotaOwner and Reserved record who created the upload and the quota set aside for it
+	QuotaOwner string `json:"quota_owner,omitempty"`
+	Reserved   int64  `json:"reserved,omitempty"`
+}
+
+// Filename returns the "filename" (or "name") metadata sent by the client
+func (u *TusUpload) Filename() string {
+	if name := u.Metadata["filename"]; name != "" {
+		return name
+	}
+	return u.Metadata["name"]
+}
+
+type TusOptions struct {
+	// BasePath is the URL path the handler is mounted at, e.g. "/files/"
+	BasePath string
+	// Upload holds the validation and destination rules. Completed uploads are saved through
+	// it, with Progress recorded under the tus upload ID and owner.
+	Upload FileUploadOptions
+	// PartialDir holds incomplete uploads. Defaults to a ".tus" directory inside Upload.DestinationDir.
+	// Chunks are kept there as they arrive, unencrypted, so Upload.Encryption isn't supported.
+	PartialDir string
+	// Expiration is how long an incomplete upload is kept after its last chunk. Zero keeps it forever.
+	Expiration time.Duration
+	// Owner returns the QuotaOwner an upload is counted against, such as the session's user
+	// ID, in place of Upload.QuotaOwner. Only requests from the same owner can resume or
+	// terminate the upload.
+	Owner func(r *http.Request) string
+	// OnComplete is called once the final chunk has arrived and the file has been saved
+	OnComplete func(ctx context.Context, upload *TusUpload, file *SavedFile)
+}
+
+// TusHandler is an http.Handler implementing the tus 1.0 resumable upload protocol with the
+// creation, creation-with-upload, termination and expiration extensions.
+type TusHandler struct {
+	opts  TusOptions
+	locks keyedMutex // serializes requests for one upload
+	now   func() time.Time
+}
+
+func NewTusHandler(opts TusOptions) (*TusHandler, error) {
+	if opts.Upload.Encryption != nil {
+		return nil, ErrTusEncryptionUnsupported
+	}
+
+	if opts.BasePath == "" {
+		opts.BasePath = "/"
+	}
+	if !strings.HasSuffix(opts.BasePath, "/") {
+		opts.BasePath += "/"
+	}
+
+	if opts.PartialDir == "" {
+		opts.PartialDir = filepath.Join(opts.Upload.DestinationDir, ".tus")
+	}
+
+	if err := os.MkdirAll(opts.PartialDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create partial upload directory: %w", err)
+	}
+
+	return &TusHandler{opts: opts, locks: keyedMutex{locks: make(map[string]*keyedLock)}, now: time.Now}, nil
+}
+
+func (h *TusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", TusVersion)
+		w.Header().Set("Tus-Extension", h.extensions())
+		if h.opts.Upload.MaxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.opts.Upload.MaxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		tusError(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, h.opts.BasePath), "/")
+
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		h.create(w, r)
+	case id == "" || !validUploadID(id):
+		tusError(w, ErrUploadNotFound.Error(), http.StatusNotFound)
+	case r.Method == http.MethodHead:
+		h.head(w, r, id)
+	case r.Method == http.MethodPatch:
+		h.patch(w, r, id)
+	case r.Method == http.MethodDelete:
+		h.terminate(w, r, id)
+	default:
+		tusError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *TusHandler) extensions() string {
+	extensions := "creation,creation-with-upload,termination"
+	if h.opts.Expiration > 0 {
+		extensions += ",expiration"
+	}
+	return extensions
+}
+
+func (h *TusHandler) create(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		tusError(w, "deferred upload length is not supported", http.StatusBadRequest)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		tusError(w, "invalid Upload-Length header", http.StatusBadRequest)
+		return
+	}
+
+	if length == 0 {
+		tusError(w, ErrEmptyFile.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if length > h.opts.Upload.MaxSize {
+		tusError(w, ErrFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		tusError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := random.Generate(random.Options{Length: 24})
+	if err != nil {
+		tusError(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	upload := &TusUpload{
+		ID:        id,
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: h.now(),
+	}
+
+	if _, err := checkExtension(upload.Filename(), &h.opts.Upload); err != nil {
+		tusError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	h.touch(upload)
+
+	// Room for the whole upload is reserved now, so a client can't send more than its
+	// quota allows before finding out
+	opts := h.opts.Upload
+	opts.QuotaOwner = h.owner(r)
+	upload.QuotaOwner = opts.QuotaOwner
+	quota, err := reserveQuota(r.Context(), &opts, length)
+	if err != nil {
+		tusError(w, err.Error(), StatusForError(err))
+		return
+	}
+	if quota != nil {
+		upload.Reserved = quota.bytes
+	}
+
+	if err := os.WriteFile(h.dataPath(id), nil, 0o644); err != nil {
+		quota.release(context.WithoutCancel(r.Context()))
+		tusError(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if err := h.saveInfo(upload); err != nil {
+		os.Remove(h.dataPath(id))
+		quota.release(context.WithoutCancel(r.Context()))
+		tusError(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", h.opts.BasePath+id)
+
+	if r.Header.Get("Content-Type") == tusOffsetContentType {
+		unlock := h.lock(id)
+		defer unlock()
+
+		if status, err := h.appendChunk(r, upload); err != nil {
+			tusError(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	}
+
+	h.setExpiresHeader(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *TusHandler) head(w http.ResponseWriter, r *http.Request, id string) {
+	unlock := h.lock(id)
+	defer unlock()
+
+	upload, err := h.loadOwnUpload(r, id)
+	if err != nil {
+		tusLoadError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if len(upload.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatTusMetadata(upload.Metadata))
+	}
+	h.setExpiresHeader(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *TusHandler) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != tusOffsetContentType {
+		tusError(w, "content type must be "+tusOffsetContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	unlock := h.lock(id)
+	defer unlock()
+
+	upload, err := h.loadOwnUpload(r, id)
+	if err != nil {
+		tusLoadError(w, err)
+		return
+	}
+
+	status, err := h.appendChunk(r, upload)
+	if err != nil {
+		tusError(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	h.setExpiresHeader(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TusHandler) terminate(w http.ResponseWriter, r *http.Request, id string) {
+	unlock := h.lock(id)
+	defer unlock()
+
+	upload, err := h.loadOwnUpload(r, id)
+	if err != nil && !errors.Is(err, ErrUploadExpired) {
+		tusLoadError(w, err)
+		return
+	}
+
+	h.discard(r.Context(), upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// appendChunk writes the request body at the upload's offset and finishes the upload when
+// the last byte arrives. It returns the HTTP status to use on error.
+func (h *TusHandler) appendChunk(r *http.Request, upload *TusUpload) (int, error) {
+	if header := r.Header.Get("Upload-Offset"); header != "" {
+		offset, err := strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			return http.StatusBadRequest, errors.New("invalid Upload-Offset header")
+		}
+		if offset != upload.Offset {
+			return http.StatusConflict, ErrOffsetMismatch
+		}
+	} else if r.Method == http.MethodPatch {
+		return http.StatusBadRequest, errors.New("missing Upload-Offset header")
+	}
+
+	file, err := os.OpenFile(h.dataPath(upload.ID), os.O_WRONLY, 0o644)
+	if err != nil {
+		return http.StatusInternalServerError, errors.New("failed to open upload")
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(upload.Offset, io.SeekStart); err != nil {
+		return http.StatusInternalServerError, errors.New("failed to open upload")
+	}
+
+	remaining := upload.Length - upload.Offset
+	if r.ContentLength > remaining {
+		return http.StatusRequestEntityTooLarge, errors.New("chunk extends past Upload-Length")
+	}
+
+	// Keep whatever arrived even if the connection drops halfway, so the client can resume
+	start := upload.Offset
+	n, copyErr := io.Copy(file, io.LimitReader(r.Body, remaining))
+	if copyErr == nil {
+		// Bodies without a Content-Length are only known to be too long once they're read
+		if extra, _ := r.Body.Read(make([]byte, 1)); extra > 0 {
+			file.Truncate(start)
+			return http.StatusRequestEntityTooLarge, errors.New("chunk extends past Upload-Length")
+		}
+	}
+	upload.Offset += n
+	h.touch(upload)
+
+	if err := file.Close(); err != nil {
+		return http.StatusInternalServerError, errors.New("failed to write upload")
+	}
+
+	if !upload.Sniffed && upload.Offset >= min(upload.Length, 512) {
+		if err := h.sniff(upload); err != nil {
+			h.discard(r.Context(), upload)
+			return http.StatusUnsupportedMediaType, err
+		}
+	}
+
+	if err := h.saveInfo(upload); err != nil {
+		return http.StatusInternalServerError, errors.New("failed to save upload state")
+	}
+
+	if copyErr != nil {
+		return http.StatusBadRequest, fmt.Errorf("failed to read chunk: %w", copyErr)
+	}
+
+	if upload.Offset == upload.Length {
+		if err := h.complete(r.Context(), upload); err != nil {
+			return StatusForError(err), err
+		}
+	}
+
+	return 0, nil
+}
+
+// sniff checks the first bytes of the upload against the allowed MIME types
+func (h *TusHandler) sniff(upload *TusUpload) error {
+	file, err := os.Open(h.dataPath(upload.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open upload: %w", err)
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read file header: %w", err)
+	}
+
+	if err := checkMimeType(http.DetectContentType(head[:n]), &h.opts.Upload); err != nil {
+		return err
+	}
+	upload.Sniffed = true
+	return nil
+}
+
+// complete saves the finished upload through the regular save path and removes the partial
+// data, counting the file against the quota reserved at creation. When saving fails for a
+// reason that may pass, such as a storage error or an unavailable scanner, the data and the
+// reservation are kept so the client can retry with an empty PATCH at the final offset.
+func (h *TusHandler) complete(ctx context.Context, upload *TusUpload) error {
+	file, err := os.Open(h.dataPath(upload.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open upload: %w", err)
+	}
+
+	// Saving the upload is reported under its tus ID, to the owner who created it
+	opts := h.opts.Upload
+	opts.UploadID, opts.ProgressOwner = upload.ID, upload.QuotaOwner
+	if upload.QuotaOwner != "" {
+		opts.QuotaOwner = upload.QuotaOwner
+	}
+	quota := h.reservation(upload)
+	if quota != nil {
+		opts.Quota = nil
+	}
+	savedFile, err := saveFile(ctx, fileSource{
+		filename: upload.Filename(),
+		size:     upload.Length,
+	}, file, &opts)
+	file.Close()
+	if err == nil {
+		err = quota.commitSaved(ctx, savedFile, &opts)
+	}
+	if err != nil {
+		if isRejection(err) {
+			h.discard(ctx, upload)
+		}
+		return err
+	}
+	h.remove(upload.ID)
+
+	if h.opts.OnComplete != nil {
+		h.opts.OnComplete(ctx, upload, savedFile)
+	}
+	return nil
+}
+
+// CleanupExpired removes incomplete uploads whose expiration has passed and returns how many were removed
+func (h *TusHandler) CleanupExpired() (int, error) {
+	entries, err := os.ReadDir(h.opts.PartialDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read partial upload directory: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok || !validUploadID(id) {
+			continue
+		}
+
+		unlock := h.lock(id)
+		if upload, err := h.loadUpload(id); errors.Is(err, ErrUploadExpired) {
+			h.discard(context.Background(), upload)
+			removed++
+		}
+		unlock()
+	}
+	return removed, nil
+}
+
+func (h *TusHandler) touch(upload *TusUpload) {
+	if h.opts.Expiration > 0 {
+		upload.ExpiresAt = h.now().Add(h.opts.Expiration)
+	}
+}
+
+func (h *TusHandler) setExpiresHeader(w http.ResponseWriter, upload *TusUpload) {
+	if !upload.ExpiresAt.IsZero() {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+func (h *TusHandler) lock(id string) func() {
+	return h.locks.lock(id)
+}
+
+func (h *TusHandler) dataPath(id string) string {
+	return filepath.Join(h.opts.PartialDir, id+".bin")
+}
+
+func (h *TusHandler) infoPath(id string) string {
+	return filepath.Join(h.opts.PartialDir, id+".info")
+}
+
+func (h *TusHandler) loadUpload(id string) (*TusUpload, error) {
+	data, err := os.ReadFile(h.infoPath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, fmt.Errorf("failed to read upload state: %w", err)
+	}
+
+	var upload TusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, fmt.Errorf("failed to read upload state: %w", err)
+	}
+
+	if !upload.ExpiresAt.IsZero() && !h.now().Before(upload.ExpiresAt) {
+		return &upload, ErrUploadExpired
+	}
+	return &upload, nil
+}
+
+// loadOwnUpload loads an upload for a request, hiding uploads of other owners
+func (h *TusHandler) loadOwnUpload(r *http.Request, id string) (*TusUpload, error) {
+	upload, err := h.loadUpload(id)
+	if upload != nil && h.opts.Owner != nil && upload.QuotaOwner != h.owner(r) {
+		return nil, ErrUploadNotFound
+	}
+	return upload, err
+}
+
+// owner returns who a request uploads for
+func (h *TusHandler) owner(r *http.Request) string {
+	if h.opts.Owner != nil {
+		return h.opts.Owner(r)
+	}
+	return h.opts.Upload.QuotaOwner
+}
+
+func (h *TusHandler) saveInfo(upload *TusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(h.infoPath(upload.ID), data, 0o644)
+}
+
+func (h *TusHandler) remove(id string) {
+	os.Remove(h.dataPath(id))
+	os.Remove(h.infoPath(id))
+}
+
+// discard removes an upload that won't be saved and releases the quota reserved for it
+func (h *TusHandler) discard(ctx context.Context, upload *TusUpload) {
+	h.remove(upload.ID)
+	h.reservation(upload).release(context.WithoutCancel(ctx))
+}
+
+// reservation returns the quota reserved when the upload was created, if any
+func (h *TusHandler) reservation(upload *TusUpload) *quotaReservation {
+	if upload.Reserved == 0 || h.opts.Upload.Quota == nil {
+		return nil
+	}
+	return &quotaReservation{store: h.opts.Upload.Quota, owner: upload.QuotaOwner, bytes: upload.Reserved}
+}
+
+func validUploadID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2"
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata header")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func formatTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for k, v := range metadata {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func tusError(w http.ResponseWriter, message string, status int) {
+	jsonx.RespondWithError(w, message, jsonx.Options{ErrorStatus: status})
+}
+
+func tusLoadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUploadNotFound):
+		tusError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrUploadExpired):
+		tusError(w, err.Error(), http.StatusGone)
+	default:
+		tusError(w, "failed to load upload", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,418 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTusTestHandler(t *testing.T, opts TusOptions) (*TusHandler, *MemoryStorage) {
+	storage := NewMemoryStorage()
+	opts.BasePath = "/files/"
+	opts.PartialDir = t.TempDir()
+	opts.Upload.Storage = storage
+	if opts.Upload.MaxSize == 0 {
+		opts.Upload.MaxSize = 1024
+	}
+
+	h, err := NewTusHandler(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, storage
+}
+
+func tusRequest(method, target string, body []byte, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", TusVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func serveTus(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func createTusUpload(t *testing.T, h http.Handler, length int, filename string) string {
+	t.Helper()
+
+	rr := serveTus(h, tusRequest("POST", "/files/", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)),
+	}))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rr.Code, rr.Body.String())
+	}
+	return rr.Header().Get("Location")
+}
+
+func TestTusUpload(t *testing.T) {
+	var completed *SavedFile
+	h, storage := newTusTestHandler(t, TusOptions{
+		OnComplete: func(ctx context.Context, upload *TusUpload, file *SavedFile) {
+			completed = file
+		},
+	})
+
+	content := []byte("hello resumable world")
+	location := createTusUpload(t, h, len(content), "greeting.txt")
+
+	rr := serveTus(h, tusRequest("PATCH", location, content[:5], map[string]string{
+		"Content-Type":  tusOffsetContentType,
+		"Upload-Offset": "0",
+	}))
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first PATCH = %d offset %s", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	rr = serveTus(h, tusRequest("HEAD", location, nil, nil))
+	if rr.Header().Get("Upload-Offset") != "5" || rr.Header().Get("Upload-Length") != strconv.Itoa(len(content)) {
+		t.Errorf("HEAD headers = %v", rr.Header())
+	}
+
+	rr = serveTus(h, tusRequest("PATCH", location, content[5:], map[string]string{
+		"Content-Type":  tusOffsetContentType,
+		"Upload-Offset": "3",
+	}))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("PATCH with wrong offset = %d, want 409", rr.Code)
+	}
+
+	rr = serveTus(h, tusRequest("PATCH", location, content[5:], map[string]string{
+		"Content-Type":  tusOffsetContentType,
+		"Upload-Offset": "5",
+	}))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("final PATCH = %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if completed == nil || completed.OriginalName != "greeting.txt" || completed.Size != int64(len(content)) {
+		t.Fatalf("OnComplete got %+v", completed)
+	}
+
+	rc, _, err := storage.Get(context.Background(), completed.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(rc)
+	if !bytes.Equal(data, content) {
+		t.Errorf("stored %q, want %q", data, content)
+	}
+
+	if rr := serveTus(h, tusRequest("HEAD", location, nil, nil)); rr.Code != http.StatusNotFound {
+		t.Errorf("HEAD after completion = %d, want 404", rr.Code)
+	}
+}
+
+func TestTusCreationWithUpload(t *testing.T) {
+	h, _ := newTusTestHandler(t, TusOptions{})
+
+	rr := serveTus(h, tusRequest("POST", "/files/", []byte("abc"), map[string]string{
+		"Upload-Length":   "6",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("abc.txt")),
+		"Content-Type":    tusOffsetContentType,
+	}))
+	if rr.Code != http.StatusCreated || rr.Header().Get("Upload-Offset") != "3" {
+		t.Errorf("create with upload = %d offset %q", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+}
+
+func TestTusValidation(t *testing.T) {
+	h, _ := newTusTestHandler(t, TusOptions{
+		Upload: FileUploadOptions{MaxSize: 1000, AllowedExts: []string{"txt", "png"}, AllowedMimeTypes: []string{"text/plain"}},
+	})
+
+	req := tusRequest("POST", "/files/", nil, map[string]string{"Upload-Length": "10"})
+	req.Header.Del("Tus-Resumable")
+	if rr := serveTus(h, req); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("missing Tus-Resumable = %d, want 412", rr.Code)
+	}
+
+	rr := serveTus(h, tusRequest("POST", "/files/", nil, map[string]string{"Upload-Length": "2000"}))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized upload = %d, want 413", rr.Code)
+	}
+
+	rr = serveTus(h, tusRequest("POST", "/files/", nil, map[string]string{
+		"Upload-Length":   "10",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("run.exe")),
+	}))
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("disallowed extension = %d, want 415", rr.Code)
+	}
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 600)...)
+	location := createTusUpload(t, h, len(png)+10, "image.png")
+	rr = serveTus(h, tusRequest("PATCH", location, png, map[string]string{
+		"Content-Type":  tusOffsetContentType,
+		"Upload-Offset": "0",
+	}))
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("disallowed content = %d, want 415", rr.Code)
+	}
+}
+
+func TestTusRefusesEncryption(t *testing.T) {
+	_, err := NewTusHandler(TusOptions{
+		PartialDir: t.TempDir(),
+		Upload:     FileUploadOptions{Storage: NewMemoryStorage(), Encryption: testKeyProvider(t)},
+	})
+	if !errors.Is(err, ErrTusEncryptionUnsupported) {
+		t.Errorf("NewTusHandler() with encryption = %v, want ErrTusEncryptionUnsupported", err)
+	}
+}
+
+func TestTusTerminationAndExpiration(t *testing.T) {
+	h, _ := newTusTestHandler(t, TusOptions{Expiration: time.Hour})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	rr := serveTus(h, tusRequest("OPTIONS", "/files/", nil, nil))
+	if rr.Header().Get("Tus-Extension") != "creation,creation-with-upload,termination,expiration" {
+		t.Errorf("Tus-Extension = %q", rr.Header().Get("Tus-Extension"))
+	}
+
+	location := createTusUpload(t, h, 10, "a.txt")
+	if rr := serveTus(h, tusRequest("DELETE", location, nil, nil)); rr.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d, want 204", rr.Code)
+	}
+	if rr := serveTus(h, tusRequest("HEAD", location, nil, nil)); rr.Code != http.StatusNotFound {
+		t.Errorf("HEAD after DELETE = %d, want 404", rr.Code)
+	}
+
+	location = createTusUpload(t, h, 10, "b.txt")
+	now = now.Add(2 * time.Hour)
+	if rr := serveTus(h, tusRequest("HEAD", location, nil, nil)); rr.Code != http.StatusGone {
+		t.Errorf("HEAD after expiry = %d, want 410", rr.Code)
+	}
+
+	if removed, err := h.CleanupExpired(); err != nil || removed != 1 {
+		t.Errorf("CleanupExpired() = %d, %v; want 1", removed, err)
+	}
+}
+
+func TestTusRejectsChunksPastLength(t *testing.T) {
+	h, _ := newTusTestHandler(t, TusOptions{})
+	location := createTusUpload(t, h, 5, "short.txt")
+
+	rr := serveTus(h, tusRequest("PATCH", location, []byte("too long"), map[string]string{
+		"Content-Type":  tusOffsetContentType,
+		"Upload-Offset": "0",
+	}))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PATCH past Upload-Length = %d, want 413", rr.Code)
+	}
+
+	// Without a Content-Length the extra bytes are found while reading
+	req := tusRequest("PATCH", location, nil, map[string]string{
+		"Content-Type":  tusOffsetContentType,
+		"Upload-Offset": "0",
+	})
+	req.Body = io.NopCloser(bytes.NewReader([]byte("too long")))
+	req.ContentLength = -1
+	if rr := serveTus(h, req); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked PATCH past Upload-Length = %d, want 413", rr.Code)
+	}
+
+	rr = serveTus(h, tusRequest("HEAD", location, nil, nil))
+	if rr.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("offset after rejected chunks = %s, want 0", rr.Header().Get("Upload-Offset"))
+	}
+	if len(h.locks.locks) != 0 {
+		t.Errorf("locks left after requests finished: %d", len(h.locks.locks))
+	}
+}
+
+func TestTusKeepsDataWhenSaveFails(t *testing.T) {
+	h, storage := newTusTestHandler(t, TusOptions{Upload: FileUploadOptions{
+		OnCollision: CollisionFail,
+		Validators: []Validator{NewValidator("no-secrets", func(file *multipart.FileHeader, content Peeker) error {
+			if data, _ := content.Peek(6); string(data) == "secret" {
+				return errors.New("contains a secret")
+			}
+			return nil
+		})},
+	}})
+	ctx := context.Background()
+	storage.Put(ctx, "taken.txt", bytes.NewReader([]byte("existing")), PutOptions{})
+
+	content := []byte("new content")
+	location := createTusUpload(t, h, len(content), "taken.txt")
+	patch := func(body []byte, offset int) int {
+		return serveTus(h, tusRequest("PATCH", location, body, map[string]string{
+			"Content-Type":  tusOffsetContentType,
+			"Upload-Offset": strconv.Itoa(offset),
+		})).Code
+	}
+
+	if code := patch(content, 0); code != http.StatusConflict {
+		t.Fatalf("PATCH onto a taken key = %d, want 409", code)
+	}
+	if rr := serveTus(h, tusRequest("HEAD", location, nil, nil)); rr.Header().Get("Upload-Offset") != strconv.Itoa(len(content)) {
+		t.Fatalf("upload lost after a failed save: HEAD = %d", rr.Code)
+	}
+
+	storage.Delete(ctx, "taken.txt")
+	if code := patch(nil, len(content)); code != http.StatusNoContent {
+		t.Fatalf("retried completion = %d", code)
+	}
+	rc, _, err := storage.Get(ctx, "taken.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(data, content) {
+		t.Errorf("stored %q", data)
+	}
+
+	// Rejected content is removed, since sending it again can't succeed
+	location = createTusUpload(t, h, 6, "secret.txt")
+	if code := patch([]byte("secret"), 0); code != http.StatusUnprocessableEntity {
+		t.Fatalf("rejected PATCH = %d, want 422", code)
+	}
+	if rr := serveTus(h, tusRequest("HEAD", location, nil, nil)); rr.Code != http.StatusNotFound {
+		t.Errorf("HEAD after a rejected upload = %d, want 404", rr.Code)
+	}
+}
+
+func TestTusReservesQuotaAtCreation(t *testing.T) {
+	quota := NewMemoryQuotaStore(QuotaLimits{MaxBytes: 20})
+	h, _ := newTusTestHandler(t, TusOptions{
+		Expiration: time.Hour,
+		Upload:     FileUploadOptions{Quota: quota, QuotaOwner: "alice"},
+	})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	ctx := context.Background()
+	usage := func() QuotaUsage {
+		usage, _ := quota.Usage(ctx, "alice")
+		return usage
+	}
+
+	completed := createTusUpload(t, h, 5, "a.txt")
+	terminated := createTusUpload(t, h, 10, "b.txt")
+	if got := usage(); got.ReservedBytes != 15 || got.ReservedFiles != 2 {
+		t.Fatalf("usage after create = %+v, want the lengths reserved", got)
+	}
+
+	rr := serveTus(h, tusRequest("POST", "/files/", nil, map[string]string{"Upload-Length": "10"}))
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("create past the quota = %d, want 507", rr.Code)
+	}
+
+	rr = serveTus(h, tusRequest("PATCH", completed, []byte("hello"), map[string]string{
+		"Content-Type":  tusOffsetContentType,
+		"Upload-Offset": "0",
+	}))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("PATCH = %d %s", rr.Code, rr.Body.String())
+	}
+	if got := usage(); got != (QuotaUsage{Bytes: 5, Files: 1, ReservedBytes: 10, ReservedFiles: 1}) {
+		t.Errorf("usage after completion = %+v, want the file counted once", got)
+	}
+
+	serveTus(h, tusRequest("DELETE", terminated, nil, nil))
+	if got := usage(); got.ReservedBytes != 0 || got.ReservedFiles != 0 {
+		t.Errorf("usage after termination = %+v, want the reservation released", got)
+	}
+
+	createTusUpload(t, h, 15, "c.txt")
+	now = now.Add(2 * time.Hour)
+	h.CleanupExpired()
+	if got := usage(); got != (QuotaUsage{Bytes: 5, Files: 1}) {
+		t.Errorf("usage after expiry = %+v, want the reservation released", got)
+	}
+}
+
+func TestTusChecksArchives(t *testing.T) {
+	h, storage := newTusTestHandler(t, TusOptions{Upload: FileUploadOptions{
+		MaxSize:          1 << 20,
+		AllowedMimeTypes: []string{"application/zip"},
+		Validators:       []Validator{DefaultArchiveLimits()},
+	}})
+
+	upload := func(name string, content []byte) int {
+		location := createTusUpload(t, h, len(content), name)
+		return serveTus(h, tusRequest("PATCH", location, content, map[string]string{
+			"Content-Type":  tusOffsetContentType,
+			"Upload-Offset": "0",
+		})).Code
+	}
+
+	// The finished upload is on disk, so the zip's index can be read
+	if code := upload("docs.zip", testZip(map[string][]byte{"a.txt": []byte("hello")})); code != http.StatusNoContent {
+		t.Fatalf("zip within limits = %d, want 204", code)
+	}
+	if _, err := storage.Stat(context.Background(), "docs.zip"); err != nil {
+		t.Errorf("zip not saved: %v", err)
+	}
+
+	if code := upload("bomb.zip", testZip(map[string][]byte{"a.bin": make([]byte, 8<<20)})); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("zip bomb = %d, want 413", code)
+	}
+}
+
+func TestTusQuotaPerOwner(t *testing.T) {
+	quota := NewMemoryQuotaStore(QuotaLimits{MaxBytes: 10})
+	h, _ := newTusTestHandler(t, TusOptions{
+		Upload: FileUploadOptions{Quota: quota},
+		Owner:  func(r *http.Request) string { return r.Header.Get("X-User") },
+	})
+	create := func(user string, length int) *httptest.ResponseRecorder {
+		return serveTus(h, tusRequest("POST", "/files/", nil, map[string]string{
+			"Upload-Length": strconv.Itoa(length),
+			"X-User":        user,
+		}))
+	}
+
+	alice := create("alice", 8)
+	if alice.Code != http.StatusCreated {
+		t.Fatalf("alice's create = %d", alice.Code)
+	}
+	if rr := create("alice", 8); rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("alice's second create = %d, want 507", rr.Code)
+	}
+	if rr := create("bob", 8); rr.Code != http.StatusCreated {
+		t.Errorf("bob's create = %d, want his own quota", rr.Code)
+	}
+
+	// Bob can't write to, or end, an upload counted against alice
+	location := alice.Header().Get("Location")
+	rr := serveTus(h, tusRequest("PATCH", location, []byte("12345678"), map[string]string{
+		"Content-Type":  tusOffsetContentType,
+		"Upload-Offset": "0",
+		"X-User":        "bob",
+	}))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("bob's PATCH of alice's upload = %d, want 404", rr.Code)
+	}
+	serveTus(h, tusRequest("DELETE", location, nil, map[string]string{"X-User": "bob"}))
+
+	rr = serveTus(h, tusRequest("PATCH", location, []byte("12345678"), map[string]string{
+		"Content-Type":  tusOffsetContentType,
+		"Upload-Offset": "0",
+		"X-User":        "alice",
+	}))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("alice's PATCH = %d %s", rr.Code, rr.Body.String())
+	}
+	if usage, _ := quota.Usage(context.Background(), "alice"); usage != (QuotaUsage{Bytes: 8, Files: 1}) {
+		t.Errorf("alice's usage = %+v", usage)
+	}
+	if usage, _ := quota.Usage(context.Background(), "bob"); usage.ReservedBytes != 8 {
+		t.Errorf("bob's usage = %+v", usage)
+	}
+}
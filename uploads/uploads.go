@@ -1,16 +1,26 @@
 package uploads
 
 import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/ddddami/bindle/fs"
 	"github.com/ddddami/bindle/random"
 	"github.com/ddddami/bindle/strutil"
 )
@@ -19,25 +29,112 @@ var (
 	ErrEmptyFile       = errors.New("uploaded file is empty")
 	ErrFileTooLarge    = errors.New("uploaded file is too large")
 	ErrInvalidFileType = errors.New("file extension is not allowed")
+	// ErrUnsupportedMimeType is returned when the sniffed content type isn't allowed
+	ErrUnsupportedMimeType = errors.New("unsupported MIME type")
 )
 
 type FileUploadOptions struct {
+	// DestinationDir is where files are written when Storage is nil
 	DestinationDir string
-	MaxSize        int64
+	// Storage overrides where files are written. Defaults to a LocalStorage rooted at DestinationDir.
+	Storage Storage
+	// KeyPrefix is prepended to every saved file's storage key, e.g. "avatars/"
+	KeyPrefix string
+	MaxSize   int64
 	// AllowedExts is a list of allowed file extensions (without the dot). Leave empty to allow all.
 	AllowedExts       []string
 	AllowedMimeTypes  []string
 	FilenamePrefix    string
 	RandomizeFilename bool
-	// TODO: (custom validator) Validator func(file *multipart.FileHeader) error
+	// OnCollision decides what happens when a file with the same name is already stored.
+	// The zero value overwrites it; DefaultOptions picks CollisionSuffix.
+	OnCollision CollisionPolicy
+	// Validators run in order after the built-in checks, see ExtensionMatchesMIME,
+	// MaxImagePixels and FilenameRules
+	Validators []Validator
+	// ContentAddressed stores files under "<KeyPrefix>/sha256/…" keys derived from their
+	// content, so identical uploads share a single object
+	ContentAddressed bool
+	// RefCounter tracks uploads sharing a content-addressed object. Local and memory storage
+	// default to counts kept under "<KeyPrefix>/.refs", which are only safe within one
+	// process; other storage requires a RefCounter, which should implement ContentLocker
+	// when several servers share the storage.
+	RefCounter RefCounter
+	// Progress records how far uploads have been copied, keyed by UploadID. Nothing is
+	// recorded when either is unset.
+	Progress *ProgressRegistry
+	// UploadID names the upload in Progress, usually an ID sent by the client
+	UploadID string
+	// ProgressOwner scopes UploadID to a user, such as the session's user ID, so only a
+	// ProgressHandler asked by the same owner reports it
+	ProgressOwner string
+	// Quota limits what QuotaOwner may store. Room for each file is reserved before it's
+	// copied, and DeleteSavedFile gives it back. Nothing is counted when either is unset.
+	Quota      QuotaStore
+	QuotaOwner string
+	// TTL has a Sweeper delete saved files this long after they're saved. Zero keeps them.
+	TTL time.Duration
+	// RetentionClass names an entry of SweeperOptions.Classes deciding how long saved files
+	// are kept, so the policy can change after they're saved
+	RetentionClass string
+	// Encryption encrypts saved files at rest with data keys wrapped by the provider, see
+	// EncryptedStorage. Serve them with the same provider in DownloadOptions.Encryption.
+	Encryption KeyProvider
+	// Scanner checks every file for malware as it's copied. Files are kept under a temporary
+	// key until they're found clean, and rejected with an *InfectedError otherwise.
+	Scanner Scanner
+	// ScanFailOpen accepts files the scanner failed to scan, recording ScanFailed in
+	// SavedFile.Scan. By default they're rejected with ErrScanFailed.
+	ScanFailOpen bool
+	// QuarantinePrefix is where infected files are moved for inspection. Empty deletes them.
+	QuarantinePrefix string
 }
 
+// CollisionPolicy decides what happens when a saved file's key is already taken
+type CollisionPolicy int
+
+const (
+	// CollisionOverwrite replaces the existing file
+	CollisionOverwrite CollisionPolicy = iota
+	// CollisionFail rejects the upload with ErrObjectExists
+	CollisionFail
+	// CollisionSuffix numbers the new file: report.pdf, report_1.pdf, report_2.pdf…
+	CollisionSuffix
+	// CollisionRandomize adds a random suffix to the new file: report_x7Kq2mPa.pdf
+	CollisionRandomize
+)
+
+// maxCollisionAttempts bounds the names CollisionSuffix and CollisionRandomize try
+const maxCollisionAttempts = 1000
+
+// maxPlaceAttempts bounds how often a staged file's name is resolved again after another
+// upload took it
+const maxPlaceAttempts = 5
+
 type SavedFile struct {
 	OriginalName string
 	SavedName    string
-	SavedPath    string
-	Size         int64
-	MIMEType     string
+	// Key identifies the file in the storage it was saved to
+	Key string
+	// SavedPath is the filesystem path of the file, when it was saved to a LocalStorage
+	SavedPath string
+	Size      int64
+	MIMEType  string
+	// Digest is the hex-encoded SHA-256 of the file's content
+	Digest string
+	// Deduplicated is set when identical content was already stored and reused
+	Deduplicated bool
+	// ExpiresAt is when a Sweeper deletes the file, for files saved with a TTL
+	ExpiresAt      time.Time
+	RetentionClass string
+	// RetentionID names the file's retention marker. Keep it to delete the file with
+	// DeleteSavedFile, so a content-addressed file shared with other uploads keeps theirs.
+	RetentionID string
+	// Scan is the malware scan verdict, for files saved with a Scanner
+	Scan ScanResult
+	// Derived lists files made from this one, such as image variants. DeleteSavedFile
+	// deletes them along with it.
+	Derived []*SavedFile
 }
 
 func DefaultOptions() FileUploadOptions {
@@ -46,90 +143,388 @@ func DefaultOptions() FileUploadOptions {
 		MaxSize:          10 * 1024 * 1024, // 10 MB
 		AllowedExts:      []string{"jpg", "jpeg", "png", "gif", "pdf"},
 		AllowedMimeTypes: []string{"image/jpeg", "image/png", "image/gif", "application/pdf"},
+		OnCollision:      CollisionSuffix,
 	}
 }
 
+// storage returns the configured Storage, falling back to the local DestinationDir
+func (o *FileUploadOptions) storage() Storage {
+	storage := o.Storage
+	if storage == nil {
+		storage = NewLocalStorage(o.DestinationDir)
+	}
+	return encryptedStorage(storage, o.Encryption)
+}
+
 func SaveUploadedFile(file *multipart.FileHeader, opts *FileUploadOptions) (*SavedFile, error) {
+	return SaveUploadedFileContext(context.Background(), file, opts)
+}
+
+// SaveUploadedFileContext is SaveUploadedFile with a context that is passed on to the storage
+func SaveUploadedFileContext(ctx context.Context, file *multipart.FileHeader, opts *FileUploadOptions) (*SavedFile, error) {
 	if file.Size == 0 {
 		return nil, ErrEmptyFile
 	}
 
+	src, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open uploaded file: %w", err)
+	}
+
+	defer src.Close()
+
+	return saveFile(ctx, formFileSource(file), src, opts)
+}
+
+// SaveReader saves the contents of src as an upload named filename. It applies the same
+// validation as SaveUploadedFile, but the size is only known once src has been read, so
+// MaxSize is enforced while copying.
+func SaveReader(ctx context.Context, filename string, src io.Reader, opts *FileUploadOptions) (*SavedFile, error) {
+	return saveFile(ctx, fileSource{filename: filename}, src, opts)
+}
+
+// fileSource describes where an upload came from
+type fileSource struct {
+	filename string
+	// size is the declared size, or zero when it isn't known up front
+	size   int64
+	header textproto.MIMEHeader
+	// file is the original form file, when there is one
+	file *multipart.FileHeader
+}
+
+func formFileSource(file *multipart.FileHeader) fileSource {
+	return fileSource{
+		filename: partFilename(file.Header, file.Filename),
+		size:     file.Size,
+		header:   file.Header,
+		file:     file,
+	}
+}
+
+// fileHeader returns the form file header handed to validators, building one for
+// sources that didn't come from a parsed form
+func (s fileSource) fileHeader() *multipart.FileHeader {
+	if s.file != nil {
+		return s.file
+	}
+	return &multipart.FileHeader{Filename: s.filename, Header: s.header, Size: s.size}
+}
+
+// saveFile validates and stores src. Every save path ends up here.
+func saveFile(ctx context.Context, source fileSource, src io.Reader, opts *FileUploadOptions) (*SavedFile, error) {
 	if opts == nil {
 		defaultOpts := DefaultOptions()
 		opts = &defaultOpts
 	}
 
-	if file.Size > opts.MaxSize {
+	src, cleanup, err := spoolArchive(src, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	file, err := prepareFile(source, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	return storeFile(ctx, file, opts, false)
+}
+
+// preparedFile is an upload that passed every check and is ready to be stored
+type preparedFile struct {
+	source   fileSource
+	content  *bufio.Reader
+	ext      string
+	mimeType string
+	destName string
+}
+
+// prepareFile runs the size, extension, MIME and validator checks without storing anything
+func prepareFile(source fileSource, src io.Reader, opts *FileUploadOptions) (*preparedFile, error) {
+	if source.size > opts.MaxSize {
 		return nil, ErrFileTooLarge
 	}
 
-	origFileName := file.Filename
-	ext := strings.ToLower(filepath.Ext(origFileName))
-	if ext != "" {
-		ext = ext[1:]
+	ext, err := checkExtension(source.filename, opts)
+	if err != nil {
+		return nil, err
 	}
-	if len(opts.AllowedExts) > 0 {
-		allowed := false
-		for _, allowedExt := range opts.AllowedExts {
-			if strings.EqualFold(ext, allowedExt) {
-				allowed = true
-				break
-			}
+
+	whole, wholeSize, random := randomAccess(src)
+	content := bufio.NewReaderSize(src, peekSize)
+	var peeker Peeker = content
+	if random {
+		peeker = wholePeeker{Reader: content, whole: whole, size: wholeSize}
+	}
+
+	head, err := content.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+
+	if len(head) == 0 {
+		return nil, ErrEmptyFile
+	}
+
+	mimeType := http.DetectContentType(head)
+	if err := checkMimeType(mimeType, opts); err != nil {
+		return nil, err
+	}
+
+	if err := runValidators(opts.Validators, source.fileHeader(), peeker); err != nil {
+		return nil, err
+	}
+
+	destName, err := destinationName(source.filename, ext, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &preparedFile{
+		source:   source,
+		content:  content,
+		ext:      ext,
+		mimeType: mimeType,
+		destName: destName,
+	}, nil
+}
+
+// storeFile writes a prepared file to storage. Staged files are written to a temporary key
+// and keep their intended name in SavedName until SaveFiles moves them into place.
+func storeFile(ctx context.Context, file *preparedFile, opts *FileUploadOptions, staged bool) (*SavedFile, error) {
+	var err error
+	destFileName := file.destName
+
+	storage := opts.storage()
+	if opts.ContentAddressed {
+		if _, err := opts.refCounter(storage); err != nil {
+			return nil, err
+		}
+	}
+	key := path.Join(opts.KeyPrefix, destFileName)
+	if opts.ContentAddressed || staged {
+		// The final key isn't known yet, so stage the file under a temporary one
+		if key, err = tempKey(opts.KeyPrefix, file.ext); err != nil {
+			return nil, err
 		}
+	}
+	if key, err = CleanKey(key); err != nil {
+		return nil, err
+	}
 
-		if !allowed {
-			return nil, ErrInvalidFileType
+	noClobber := !opts.ContentAddressed && !staged && opts.OnCollision != CollisionOverwrite
+	wantKey := key
+	if noClobber {
+		if key, err = resolveCollision(ctx, storage, key, opts.OnCollision); err != nil {
+			return nil, err
 		}
+		destFileName = path.Base(key)
 	}
 
-	if err := os.MkdirAll(opts.DestinationDir, 0o755); err != nil {
-		return nil, fmt.Errorf("failed to create destination directory: %w", err)
+	// Scanned files are staged until they're found clean, so an infected upload never
+	// replaces another file or sits under its name. Files that get renamed on collisions are
+	// staged too, so a name taken while they were written can be swapped for another.
+	finalKey := key
+	renamed := opts.OnCollision == CollisionSuffix || opts.OnCollision == CollisionRandomize
+	if (opts.Scanner != nil || (noClobber && renamed)) && !opts.ContentAddressed && !staged {
+		if key, err = tempKey(opts.KeyPrefix, file.ext); err != nil {
+			return nil, err
+		}
 	}
 
-	var destFileName string
+	quota, err := reserveQuota(ctx, opts, file.source.size)
+	if err != nil {
+		return nil, err
+	}
 
-	baseFileName := strings.TrimSuffix(origFileName, filepath.Ext(origFileName))
-	if opts.FilenamePrefix != "" {
-		baseFileName = fmt.Sprintf("%s_%s", opts.FilenamePrefix, baseFileName)
+	progress := opts.Progress.start(opts.ProgressOwner, opts.UploadID, file.source.filename, file.source.size)
+	hasher := sha256.New()
+	limited := &maxSizeReader{r: progress.reader(file.content), remaining: opts.MaxSize}
+	counter := &countingReader{r: io.TeeReader(limited, hasher)}
+	var content io.Reader = counter
+	var scan *scanJob
+	if opts.Scanner != nil {
+		content, scan = startScan(ctx, opts.Scanner, counter)
+	}
+	// Put leaves nothing behind when it fails. With CollisionFail, losing a race for the name
+	// fails the upload rather than overwriting the other file.
+	info, err := storage.Put(ctx, key, content, PutOptions{
+		ContentType: file.mimeType,
+		Size:        file.source.size,
+		IfNotExists: noClobber,
+	})
+	scanResult, scanErr := scan.wait(err)
+	if err == nil {
+		scanResult, err = checkScan(ctx, storage, key, destFileName, scanResult, scanErr, opts)
+	}
+	if err == nil && key != finalKey {
+		if finalKey, err = placeStaged(ctx, storage, key, wantKey, finalKey, opts.OnCollision); err != nil {
+			storage.Delete(context.WithoutCancel(ctx), key)
+		}
+		info.Key = finalKey
+		destFileName = path.Base(finalKey)
+	}
+	if err != nil {
+		quota.release(context.WithoutCancel(ctx))
+		progress.finish(err)
+		return nil, err
 	}
 
-	if opts.RandomizeFilename {
-		random, err := random.Generate(random.Options{Length: 8})
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	deduplicated := false
+	if opts.ContentAddressed {
+		info.Key, deduplicated, err = commitContentAddressed(ctx, storage, key, digest, file.ext, opts)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate random string: %w", err)
+			storage.Delete(context.WithoutCancel(ctx), key)
+			quota.release(context.WithoutCancel(ctx))
+			progress.finish(err)
+			return nil, err
 		}
+		destFileName = path.Base(info.Key)
+	}
+	progress.finish(nil)
 
-		destFileName = fmt.Sprintf("%s_%s.%s", baseFileName, random, ext)
+	declaredType := file.source.header.Get("Content-Type")
+	if declaredType == "" {
+		declaredType = file.mimeType
+	}
 
-	} else {
-		destFileName = origFileName
+	savedFile := &SavedFile{
+		OriginalName: file.source.filename,
+		SavedName:    destFileName,
+		Key:          info.Key,
+		Size:         counter.n,
+		MIMEType:     declaredType,
+		Digest:       digest,
+		Deduplicated: deduplicated,
+		Scan:         scanResult,
+	}
+	if local, ok := localStorage(storage); ok {
+		savedFile.SavedPath, _ = local.Path(info.Key)
 	}
 
-	destFileName = strutil.FormatFilename(destFileName)
+	if err := quota.commit(ctx, counter.n); err != nil {
+		uncounted := *opts
+		uncounted.Quota = nil
+		DeleteSavedFile(context.WithoutCancel(ctx), savedFile, &uncounted)
+		quota.release(context.WithoutCancel(ctx))
+		return nil, fmt.Errorf("failed to record quota usage: %w", err)
+	}
 
-	destPath := filepath.Join(opts.DestinationDir, destFileName)
+	// Content-addressed files are under their final key even when staged
+	if !staged || opts.ContentAddressed {
+		if err := recordRetention(ctx, storage, savedFile, opts); err != nil {
+			DeleteSavedFile(context.WithoutCancel(ctx), savedFile, opts)
+			return nil, err
+		}
+	}
+	return savedFile, nil
+}
 
-	src, err := file.Open()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open uploaded file: %w", err)
+// StatusForError maps the errors of the save functions to the HTTP status codes this
+// package's handlers answer with, such as 413 for ErrFileTooLarge, 507 or 413 for
+// ErrQuotaExceeded and 500 for errors it doesn't know
+func StatusForError(err error) int {
+	switch {
+	case errors.Is(err, ErrFileTooLarge), errors.Is(err, ErrArchiveTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrInvalidFileType), errors.Is(err, ErrUnsupportedMimeType), errors.Is(err, ErrUnsupportedArchive):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrEmptyFile), errors.Is(err, ErrInvalidKey), errors.Is(err, ErrUnsafeArchiveEntry):
+		return http.StatusBadRequest
+	case errors.As(err, new(*ValidationError)):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrObjectExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrQuotaExceeded):
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) && !quotaErr.TooLarge() {
+			return http.StatusInsufficientStorage
+		}
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUploadRateExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrInfected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrScanFailed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
 	}
+}
 
-	defer src.Close()
+// isRejection reports whether err rejects the file itself, so retrying the same upload
+// can't succeed. Errors such as a full quota, a storage failure or an unavailable scanner
+// may pass.
+func isRejection(err error) bool {
+	if errors.Is(err, ErrQuotaExceeded) {
+		return false
+	}
+	switch StatusForError(err) {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
 
-	buffer := make([]byte, 512)
-	n, err := src.Read(buffer)
-	if err != nil && err != io.EOF {
-		return nil, fmt.Errorf("failed to read file header: %w", err)
+// wholePeeker hands validators the whole upload next to the peek window
+type wholePeeker struct {
+	*bufio.Reader
+	whole io.ReaderAt
+	size  int64
+}
+
+func (p wholePeeker) Content() (io.ReaderAt, int64) {
+	return p.whole, p.size
+}
+
+// randomAccess returns a reader over the rest of src when it can be read at random, such
+// as a form file or an *os.File, without moving its offset
+func randomAccess(src io.Reader) (io.ReaderAt, int64, bool) {
+	ra, ok := src.(io.ReaderAt)
+	seeker, isSeeker := src.(io.Seeker)
+	if !ok || !isSeeker {
+		return nil, 0, false
 	}
 
-	buffer = buffer[:n]
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, false
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if _, seekErr := seeker.Seek(start, io.SeekStart); err != nil || seekErr != nil {
+		return nil, 0, false
+	}
+	return io.NewSectionReader(ra, start, end-start), end - start, true
+}
 
-	mimeType := http.DetectContentType(buffer)
+// peekSize is how much of a file can be inspected before it's copied
+const peekSize = 64 << 10
 
-	if _, err = src.Seek(0, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to reset file reader: %w", err)
+// checkExtension returns the lowercased extension of filename (without the dot)
+func checkExtension(filename string, opts *FileUploadOptions) (string, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext != "" {
+		ext = ext[1:]
 	}
+	if len(opts.AllowedExts) > 0 {
+		allowed := false
+		for _, allowedExt := range opts.AllowedExts {
+			if strings.EqualFold(ext, allowedExt) {
+				allowed = true
+				break
+			}
+		}
 
+		if !allowed {
+			return "", ErrInvalidFileType
+		}
+	}
+	return ext, nil
+}
+
+func checkMimeType(mimeType string, opts *FileUploadOptions) error {
 	if opts.AllowedMimeTypes != nil {
 		allowed := false
 		for _, allowedMime := range opts.AllowedMimeTypes {
@@ -139,35 +534,120 @@ func SaveUploadedFile(file *multipart.FileHeader, opts *FileUploadOptions) (*Sav
 			}
 		}
 		if !allowed {
-			return nil, fmt.Errorf("unsupported MIME type: %s", mimeType)
+			return fmt.Errorf("%w: %s", ErrUnsupportedMimeType, mimeType)
 		}
 	} else {
 		if !strings.HasPrefix(mimeType, "image/") &&
 			mimeType != "application/pdf" &&
 			!strings.HasPrefix(mimeType, "text/") {
-			return nil, fmt.Errorf("unsupported MIME type: %s", mimeType)
+			return fmt.Errorf("%w: %s", ErrUnsupportedMimeType, mimeType)
 		}
 	}
+	return nil
+}
 
-	dst, err := os.Create(destPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to created destination file: %w", err)
+// placeStaged moves a file staged under stagedKey to key, which resolveCollision picked for
+// wantKey. Unless policy is CollisionOverwrite, the move never replaces another file; with
+// CollisionSuffix and CollisionRandomize, a key taken in the meantime is resolved again.
+// It returns the key the file ended up under.
+func placeStaged(ctx context.Context, storage Storage, stagedKey, wantKey, key string, policy CollisionPolicy) (string, error) {
+	if policy == CollisionOverwrite {
+		return key, MoveObject(ctx, storage, stagedKey, key)
 	}
 
-	defer dst.Close()
+	for attempt := 1; ; attempt++ {
+		err := MoveObjectIfNotExists(ctx, storage, stagedKey, key)
+		if !errors.Is(err, ErrObjectExists) || policy == CollisionFail || attempt == maxPlaceAttempts {
+			return key, err
+		}
+		if key, err = resolveCollision(ctx, storage, wantKey, policy); err != nil {
+			return "", err
+		}
+	}
+}
 
-	if _, err := io.Copy(dst, src); err != nil {
-		return nil, fmt.Errorf("failed to copy file: %w", err)
+// resolveCollision finds a free key according to policy. Another upload can still claim
+// the key before it's written, which Put's IfNotExists and placeStaged catch.
+func resolveCollision(ctx context.Context, storage Storage, key string, policy CollisionPolicy) (string, error) {
+	ext := path.Ext(key)
+	base := strings.TrimSuffix(key, ext)
+
+	candidate := key
+	for attempt := 1; attempt <= maxCollisionAttempts; attempt++ {
+		_, err := storage.Stat(ctx, candidate)
+		if errors.Is(err, ErrObjectNotFound) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch policy {
+		case CollisionSuffix:
+			candidate = fmt.Sprintf("%s_%d%s", base, attempt, ext)
+		case CollisionRandomize:
+			suffix, err := random.Generate(random.Options{Length: 8})
+			if err != nil {
+				return "", fmt.Errorf("failed to generate random string: %w", err)
+			}
+			candidate = fmt.Sprintf("%s_%s%s", base, suffix, ext)
+		default:
+			return "", fmt.Errorf("%w: %s", ErrObjectExists, key)
+		}
 	}
+	return "", fmt.Errorf("%w: no free name for %s", ErrObjectExists, key)
+}
 
-	savedFile := &SavedFile{
-		OriginalName: origFileName,
-		SavedName:    destFileName,
-		SavedPath:    destPath,
-		Size:         file.Size,
-		MIMEType:     file.Header.Get("Content-Type"),
+func destinationName(origFileName, ext string, opts *FileUploadOptions) (string, error) {
+	var destFileName string
+
+	baseFileName := strings.TrimSuffix(origFileName, filepath.Ext(origFileName))
+	if opts.FilenamePrefix != "" {
+		baseFileName = fmt.Sprintf("%s_%s", opts.FilenamePrefix, baseFileName)
 	}
-	return savedFile, nil
+
+	if opts.RandomizeFilename {
+		random, err := random.Generate(random.Options{Length: 8})
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random string: %w", err)
+		}
+
+		destFileName = fmt.Sprintf("%s_%s.%s", baseFileName, random, ext)
+
+	} else {
+		destFileName = origFileName
+	}
+
+	return strutil.FormatFilename(destFileName), nil
+}
+
+// maxSizeReader fails with ErrFileTooLarge as soon as more than remaining bytes are read
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+	n, err := m.r.Read(p)
+	if int64(n) > m.remaining {
+		return 0, ErrFileTooLarge
+	}
+	m.remaining -= int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
 func SaveSingleFormFile(r *http.Request, fieldName string, opts *FileUploadOptions) (*SavedFile, error) {
@@ -182,10 +662,11 @@ func SaveSingleFormFile(r *http.Request, fieldName string, opts *FileUploadOptio
 		return nil, fmt.Errorf("no file uploaded with field name '%s'", fieldName)
 	}
 
-	return SaveUploadedFile(files[0], opts)
+	return SaveUploadedFileContext(r.Context(), files[0], opts)
 }
 
-func SaveMultipleFormFiles(r *http.Request, fieldName string, opts *FileUploadOptions) ([]*SavedFile, error) {
+// SaveMultipleFormFiles saves every file sent under fieldName as one batch, see SaveFiles
+func SaveMultipleFormFiles(r *http.Request, fieldName string, opts *FileUploadOptions, batchOpts ...BatchOptions) ([]*SavedFile, error) {
 	if r.MultipartForm == nil {
 		if err := r.ParseMultipartForm(32 << 20); err != nil {
 			return nil, fmt.Errorf("failed to parse multipart from %w", err)
@@ -197,36 +678,31 @@ func SaveMultipleFormFiles(r *http.Request, fieldName string, opts *FileUploadOp
 		return nil, fmt.Errorf("no files uploaded with the given field name '%s'", fieldName)
 	}
 
-	var savedFiles []*SavedFile
-	for _, fileHeader := range files {
-		savedFile, err := SaveUploadedFile(fileHeader, opts)
-		if err != nil {
-			for _, saved := range savedFiles {
-				os.Remove(saved.SavedPath)
-			}
-		}
-
-		savedFiles = append(savedFiles, savedFile)
-
-	}
-	return savedFiles, nil
+	return SaveFiles(r.Context(), files, opts, batchOpts...)
 }
 
 type DownloadOptions struct {
 	ForceDownload     bool
 	SuggestedFilename string
 	ContentType       string
-	ExtraHeaders      map[string]string
+	// CacheControl is sent as the Cache-Control header, e.g. "private, max-age=3600".
+	// Empty leaves the header unset.
+	CacheControl string
+	ExtraHeaders map[string]string
+	// Encryption decrypts files saved with FileUploadOptions.Encryption
+	Encryption KeyProvider
 }
 
 func DefaultDownloadOptions() DownloadOptions {
 	return DownloadOptions{
 		ForceDownload: true,
+		CacheControl:  "private, no-cache",
 		ExtraHeaders:  make(map[string]string),
 	}
 }
 
-// ServeFileForDownload serves a file for download with the specified options
+// ServeFileForDownload serves a file for download with the specified options. See
+// ServeStoredFile for the range and caching support.
 func ServeFileForDownload(w http.ResponseWriter, r *http.Request, filePath string, opts DownloadOptions) error {
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
@@ -240,43 +716,283 @@ func ServeFileForDownload(w http.ResponseWriter, r *http.Request, filePath strin
 		return fmt.Errorf("cannot download a directory: %s", filePath)
 	}
 
-	file, err := os.Open(filePath)
+	storage := NewLocalStorage(filepath.Dir(filePath))
+	return ServeStoredFile(w, r, storage, filepath.Base(filePath), opts)
+}
+
+// ServeStoredFile serves the object stored under key for download with the specified options.
+// It answers HEAD requests, single and multipart Range requests (honouring If-Range), and
+// conditional requests against the object's ETag and modification time with 304 or 412.
+// Storages whose readers can't seek get the whole object in a 200 instead of a range.
+func ServeStoredFile(w http.ResponseWriter, r *http.Request, storage Storage, key string, opts DownloadOptions) error {
+	storage = encryptedStorage(storage, opts.Encryption)
+	file, info, err := storage.Get(r.Context(), key)
 	if err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return fmt.Errorf("file not found: %w", err)
+		}
 		return fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
 	downloadFilename := opts.SuggestedFilename
 	if downloadFilename == "" {
-		downloadFilename = filepath.Base(filePath)
+		downloadFilename = path.Base(info.Key)
 	}
 
 	contentType := opts.ContentType
 	if contentType == "" {
-		contentType = mime.TypeByExtension(filepath.Ext(filePath))
+		contentType = mime.TypeByExtension(path.Ext(info.Key))
+		if contentType == "" {
+			contentType = info.ContentType
+		}
 		if contentType == "" {
 			// Default to binary data if type can't be determined
 			contentType = "application/octet-stream"
 		}
 	}
 
-	w.Header().Set("Content-Type", contentType)
+	header := w.Header()
+	header.Set("Content-Type", contentType)
 	if opts.ForceDownload {
-		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, downloadFilename))
+		header.Set("Content-Disposition", ContentDisposition("attachment", downloadFilename))
 	} else {
-		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, downloadFilename))
+		header.Set("Content-Disposition", ContentDisposition("inline", downloadFilename))
 	}
 
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+	if info.ETag != "" {
+		header.Set("ETag", info.ETag)
+	}
+	if opts.CacheControl != "" {
+		header.Set("Cache-Control", opts.CacheControl)
+	}
 
 	for key, value := range opts.ExtraHeaders {
-		w.Header().Set(key, value)
+		header.Set(key, value)
+	}
+
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		// ServeContent handles Range, If-Range, If-Match, If-None-Match,
+		// If-(Un)Modified-Since and HEAD
+		http.ServeContent(w, r, downloadFilename, info.ModTime, seeker)
+		return nil
+	}
+
+	// Without seeking, ranges can't be served, so the whole file is sent instead
+	header.Set("Accept-Ranges", "none")
+	if !info.ModTime.IsZero() {
+		header.Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	if status := checkPreconditions(r, info.ETag, info.ModTime); status != 0 {
+		if status == http.StatusNotModified {
+			header.Del("Content-Type")
+		}
+		w.WriteHeader(status)
+		return nil
+	}
+
+	header.Set("Content-Length", fmt.Sprintf("%d", info.Size))
+
+	if r.Method == http.MethodHead {
+		return nil
 	}
 
 	if _, err := io.Copy(w, file); err != nil {
 		return fmt.Errorf("error sending file: %w", err)
 	}
-	// http.ServeFile(w, r, downloadFilename)
 
 	return nil
 }
+
+// checkPreconditions evaluates the conditional request headers against a file the way
+// http.ServeContent does, returning 304 or 412 when the body shouldn't be sent, or 0
+func checkPreconditions(r *http.Request, etag string, modTime time.Time) int {
+	getOrHead := r.Method == http.MethodGet || r.Method == http.MethodHead
+	// changedSince reports whether the file changed after the date in header, and whether
+	// there was a date to compare with
+	changedSince := func(header string) (bool, bool) {
+		since, err := http.ParseTime(r.Header.Get(header))
+		if err != nil || modTime.IsZero() {
+			return false, false
+		}
+		return modTime.Truncate(time.Second).After(since), true
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !etagListMatches(match, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if changed, ok := changedSince("If-Unmodified-Since"); ok && changed {
+		return http.StatusPreconditionFailed
+	}
+
+	if noneMatch := r.Header.Get("If-None-Match"); noneMatch != "" {
+		if !etagListMatches(noneMatch, etag, true) {
+			return 0
+		}
+		if getOrHead {
+			return http.StatusNotModified
+		}
+		return http.StatusPreconditionFailed
+	}
+
+	if changed, ok := changedSince("If-Modified-Since"); ok && !changed && getOrHead {
+		return http.StatusNotModified
+	}
+	return 0
+}
+
+// etagListMatches reports whether a list of entity tags from a conditional header includes
+// etag. Weak comparison ignores the W/ prefix; strong comparison never matches weak tags.
+func etagListMatches(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		switch {
+		case candidate == "*":
+			return true
+		case etag == "":
+			continue
+		case weak && strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/"):
+			return true
+		case !weak && candidate == etag && !strings.HasPrefix(etag, "W/"):
+			return true
+		}
+	}
+	return false
+}
+
+// ZipEntry is a stored file to include in a zip download
+type ZipEntry struct {
+	Key string
+	// Name is the file's path inside the archive. Defaults to the last element of Key.
+	Name string
+
+	storage Storage
+}
+
+// ServeFilesAsZip streams the files at filePaths as a zip archive. See ServeZipDownload.
+func ServeFilesAsZip(w http.ResponseWriter, r *http.Request, filePaths []string, opts DownloadOptions) error {
+	entries := make([]ZipEntry, len(filePaths))
+	for i, filePath := range filePaths {
+		entries[i] = ZipEntry{
+			Key:     filepath.Base(filePath),
+			storage: encryptedStorage(NewLocalStorage(filepath.Dir(filePath)), opts.Encryption),
+		}
+	}
+	return ServeZipDownload(w, r, nil, entries, opts)
+}
+
+// ServeZipDownload streams the stored files as a zip archive built on the fly, without
+// temporary files. Entries with the same name are numbered (report.pdf, report_1.pdf…) and
+// the archive is named by opts.SuggestedFilename, "download.zip" by default.
+//
+// Every entry is looked up before anything is written, so a missing file returns an error
+// wrapping ErrObjectNotFound while the response can still be changed. Once streaming has
+// started, errors, including the client going away, stop it and are returned.
+func ServeZipDownload(w http.ResponseWriter, r *http.Request, storage Storage, entries []ZipEntry, opts DownloadOptions) error {
+	ctx := r.Context()
+
+	entries = slices.Clone(entries)
+	infos := make([]ObjectInfo, len(entries))
+	for i, entry := range entries {
+		if entry.storage == nil {
+			entries[i].storage = encryptedStorage(storage, opts.Encryption)
+		}
+		info, err := entries[i].storage.Stat(ctx, entry.Key)
+		if err != nil {
+			if errors.Is(err, ErrObjectNotFound) {
+				return fmt.Errorf("file not found: %s: %w", entry.Key, err)
+			}
+			return fmt.Errorf("failed to open file: %w", err)
+		}
+		infos[i] = info
+	}
+
+	downloadFilename := opts.SuggestedFilename
+	if downloadFilename == "" {
+		downloadFilename = "download.zip"
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/zip")
+	header.Set("Content-Disposition", ContentDisposition("attachment", downloadFilename))
+	if opts.CacheControl != "" {
+		header.Set("Cache-Control", opts.CacheControl)
+	}
+	for key, value := range opts.ExtraHeaders {
+		header.Set(key, value)
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool, len(entries))
+	for i, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("zip download stopped: %w", err)
+		}
+
+		name := uniqueZipName(zipEntryName(entry), names)
+		if err := writeZipEntry(ctx, zw, entry, name, infos[i].ModTime); err != nil {
+			return fmt.Errorf("zip download stopped at %s: %w", entry.Key, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("zip download stopped: %w", err)
+	}
+	return nil
+}
+
+func writeZipEntry(ctx context.Context, zw *zip.Writer, entry ZipEntry, name string, modTime time.Time) error {
+	file, _, err := entry.storage.Get(ctx, entry.Key)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fw, contextReader{ctx: ctx, r: file})
+	return err
+}
+
+// zipEntryName cleans an entry's name into a relative path, falling back to its base name
+func zipEntryName(entry ZipEntry) string {
+	name := entry.Name
+	if name == "" {
+		name = path.Base(entry.Key)
+	}
+
+	name = path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if _, err := fs.SafeJoin("", name); err != nil {
+		name = path.Base(name)
+	}
+
+	dir, base := path.Split(name)
+	if base = cleanFilename(base); base == "" {
+		base = "file"
+	}
+	return dir + base
+}
+
+// uniqueZipName numbers name until it doesn't clash with taken, ignoring case as most
+// filesystems the archive is extracted to do
+func uniqueZipName(name string, taken map[string]bool) string {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for n := 1; taken[strings.ToLower(candidate)]; n++ {
+		candidate = fmt.Sprintf("%s_%d%s", stem, n, ext)
+	}
+	taken[strings.ToLower(candidate)] = true
+	return candidate
+}
@@ -1,12 +1,21 @@
 package uploads
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSaveUploadedFile(t *testing.T) {
@@ -147,3 +156,436 @@ func createTestFileHeader(filename string, content []byte) *multipart.FileHeader
 
 	return file
 }
+
+func TestSaveUploadedFileToStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+	opts := FileUploadOptions{
+		Storage:   storage,
+		KeyPrefix: "docs",
+		MaxSize:   10 * 1024 * 1024,
+	}
+
+	savedFile, err := SaveUploadedFile(createTestFileHeader("Report Q1.txt", []byte("quarterly numbers")), &opts)
+	if err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+
+	if savedFile.Key != "docs/report_q1.txt" || savedFile.SavedPath != "" {
+		t.Errorf("unexpected saved file: %+v", savedFile)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/download", nil)
+	if err := ServeStoredFile(rr, req, storage, savedFile.Key, DefaultDownloadOptions()); err != nil {
+		t.Fatalf("ServeStoredFile() error = %v", err)
+	}
+
+	if rr.Body.String() != "quarterly numbers" {
+		t.Errorf("body = %q", rr.Body.String())
+	}
+
+	if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="report_q1.txt"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+}
+
+func TestSaveUploadedFileCollisions(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   CollisionPolicy
+		wantKeys []string
+		wantErr  error
+	}{
+		{name: "overwrite", policy: CollisionOverwrite, wantKeys: []string{"docs/report.txt", "docs/report.txt", "docs/report.txt"}},
+		{name: "suffix", policy: CollisionSuffix, wantKeys: []string{"docs/report.txt", "docs/report_1.txt", "docs/report_2.txt"}},
+		{name: "fail", policy: CollisionFail, wantKeys: []string{"docs/report.txt"}, wantErr: ErrObjectExists},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := NewMemoryStorage()
+			opts := &FileUploadOptions{Storage: storage, KeyPrefix: "docs", MaxSize: 1 << 20, OnCollision: tt.policy}
+
+			var keys []string
+			for i := 0; i < 3; i++ {
+				saved, err := SaveUploadedFile(createTestFileHeader("report.txt", []byte("version "+string(rune('a'+i)))), opts)
+				if err != nil {
+					if !errors.Is(err, tt.wantErr) {
+						t.Fatalf("save %d: error = %v, want %v", i, err, tt.wantErr)
+					}
+					if StatusForError(err) != http.StatusConflict {
+						t.Errorf("StatusForError() = %d, want 409", StatusForError(err))
+					}
+					break
+				}
+				if saved.SavedName != path.Base(saved.Key) {
+					t.Errorf("SavedName = %q, want it to match key %q", saved.SavedName, saved.Key)
+				}
+				keys = append(keys, saved.Key)
+			}
+
+			if strings.Join(keys, ",") != strings.Join(tt.wantKeys, ",") {
+				t.Errorf("keys = %v, want %v", keys, tt.wantKeys)
+			}
+
+			rc, _, _ := storage.Get(context.Background(), "docs/report.txt")
+			data, _ := io.ReadAll(rc)
+			want := "version a"
+			if tt.policy == CollisionOverwrite {
+				want = "version c"
+			}
+			if string(data) != want {
+				t.Errorf("docs/report.txt = %q, want %q", data, want)
+			}
+		})
+	}
+}
+
+func TestSaveUploadedFileRandomizeCollision(t *testing.T) {
+	opts := &FileUploadOptions{Storage: NewMemoryStorage(), MaxSize: 1 << 20, OnCollision: CollisionRandomize}
+
+	first, _ := SaveUploadedFile(createTestFileHeader("report.txt", []byte("one")), opts)
+	second, err := SaveUploadedFile(createTestFileHeader("report.txt", []byte("two")), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Key != "report.txt" || second.Key == first.Key || !strings.HasPrefix(second.Key, "report_") || !strings.HasSuffix(second.Key, ".txt") {
+		t.Errorf("keys = %q, %q, want report.txt and a randomized report_….txt", first.Key, second.Key)
+	}
+}
+
+// racingStorage stores a competing file under raceKey while an upload is being written,
+// like another request claiming the name in the meantime
+type racingStorage struct {
+	*MemoryStorage
+	raceKey string
+}
+
+func (s racingStorage) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (ObjectInfo, error) {
+	s.MemoryStorage.Put(ctx, s.raceKey, strings.NewReader("competing"), PutOptions{})
+	return s.MemoryStorage.Put(ctx, key, r, opts)
+}
+
+func TestSaveUploadedFileCollisionRace(t *testing.T) {
+	for _, policy := range []CollisionPolicy{CollisionSuffix, CollisionRandomize, CollisionFail} {
+		storage := racingStorage{MemoryStorage: NewMemoryStorage(), raceKey: "docs/report.txt"}
+		opts := &FileUploadOptions{Storage: storage, KeyPrefix: "docs", MaxSize: 1 << 20, OnCollision: policy}
+
+		saved, err := SaveUploadedFile(createTestFileHeader("report.txt", []byte("mine")), opts)
+		if policy == CollisionFail {
+			if !errors.Is(err, ErrObjectExists) {
+				t.Errorf("fail: err = %v, want ErrObjectExists", err)
+			}
+		} else if err != nil {
+			t.Errorf("policy %d: %v", policy, err)
+		} else if saved.Key == "docs/report.txt" || saved.SavedName != path.Base(saved.Key) {
+			t.Errorf("policy %d: saved = %+v", policy, saved)
+		}
+
+		rc, _, _ := storage.Get(context.Background(), "docs/report.txt")
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != "competing" {
+			t.Errorf("policy %d: the competing file was replaced with %q", policy, data)
+		}
+		if staged, _ := storage.List(context.Background(), ".tmp/docs/"); len(staged) != 0 {
+			t.Errorf("policy %d: staged objects left behind: %v", policy, staged)
+		}
+	}
+}
+
+func TestServeFileForDownload(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "notes.txt")
+	os.WriteFile(filePath, []byte("some notes"), 0o644)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/download", nil)
+	err := ServeFileForDownload(rr, req, filePath, DownloadOptions{SuggestedFilename: "my-notes.txt"})
+	if err != nil {
+		t.Fatalf("ServeFileForDownload() error = %v", err)
+	}
+
+	if rr.Body.String() != "some notes" || rr.Header().Get("Content-Length") != "10" {
+		t.Errorf("unexpected response: %q %v", rr.Body.String(), rr.Header())
+	}
+
+	if got := rr.Header().Get("Content-Disposition"); got != `inline; filename="my-notes.txt"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	if err := ServeFileForDownload(httptest.NewRecorder(), req, dir, DownloadOptions{}); err == nil {
+		t.Errorf("expected an error when downloading a directory")
+	}
+}
+
+func TestServeStoredFileConditionalAndRanges(t *testing.T) {
+	storages := map[string]Storage{
+		"local":  NewLocalStorage(t.TempDir()),
+		"memory": NewMemoryStorage(),
+	}
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			info, err := storage.Put(ctx, "video.txt", strings.NewReader("0123456789"), PutOptions{ContentType: "text/plain"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			serve := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, "/download", nil)
+				for k, v := range headers {
+					req.Header.Set(k, v)
+				}
+				rr := httptest.NewRecorder()
+				opts := DefaultDownloadOptions()
+				opts.CacheControl = "private, max-age=60"
+				if err := ServeStoredFile(rr, req, storage, "video.txt", opts); err != nil {
+					t.Fatalf("ServeStoredFile() error = %v", err)
+				}
+				return rr
+			}
+
+			rr := serve("GET", nil)
+			if rr.Code != 200 || rr.Body.String() != "0123456789" {
+				t.Errorf("GET = %d %q", rr.Code, rr.Body.String())
+			}
+			etag := rr.Header().Get("ETag")
+			if etag != info.ETag || rr.Header().Get("Last-Modified") == "" || rr.Header().Get("Accept-Ranges") != "bytes" {
+				t.Errorf("missing validators: %v", rr.Header())
+			}
+			if rr.Header().Get("Cache-Control") != "private, max-age=60" {
+				t.Errorf("Cache-Control = %q", rr.Header().Get("Cache-Control"))
+			}
+			if rr.Header().Get("Content-Disposition") != `attachment; filename="video.txt"` {
+				t.Errorf("Content-Disposition = %q", rr.Header().Get("Content-Disposition"))
+			}
+
+			tests := []struct {
+				name     string
+				method   string
+				headers  map[string]string
+				wantCode int
+				wantBody string
+			}{
+				{name: "head", method: "HEAD", wantCode: 200},
+				{name: "range", method: "GET", headers: map[string]string{"Range": "bytes=2-4"}, wantCode: 206, wantBody: "234"},
+				{name: "suffix range", method: "GET", headers: map[string]string{"Range": "bytes=-3"}, wantCode: 206, wantBody: "789"},
+				{name: "unsatisfiable range", method: "GET", headers: map[string]string{"Range": "bytes=20-30"}, wantCode: 416},
+				{name: "if-range matching", method: "GET", headers: map[string]string{"Range": "bytes=0-1", "If-Range": etag}, wantCode: 206, wantBody: "01"},
+				{name: "if-range stale", method: "GET", headers: map[string]string{"Range": "bytes=0-1", "If-Range": `"stale"`}, wantCode: 200, wantBody: "0123456789"},
+				{name: "if-none-match", method: "GET", headers: map[string]string{"If-None-Match": etag}, wantCode: 304},
+				{name: "if-modified-since", method: "GET", headers: map[string]string{"If-Modified-Since": rr.Header().Get("Last-Modified")}, wantCode: 304},
+				{name: "if-match failing", method: "GET", headers: map[string]string{"If-Match": `"stale"`}, wantCode: 412},
+			}
+
+			for _, tt := range tests {
+				got := serve(tt.method, tt.headers)
+				if got.Code != tt.wantCode || (tt.wantBody != "" && got.Body.String() != tt.wantBody) {
+					t.Errorf("%s: got %d %q, want %d %q", tt.name, got.Code, got.Body.String(), tt.wantCode, tt.wantBody)
+				}
+			}
+
+			multi := serve("GET", map[string]string{"Range": "bytes=0-1,5-6"})
+			if multi.Code != 206 || !strings.HasPrefix(multi.Header().Get("Content-Type"), "multipart/byteranges") ||
+				!strings.Contains(multi.Body.String(), "01") || !strings.Contains(multi.Body.String(), "56") {
+				t.Errorf("multipart range = %d %v %q", multi.Code, multi.Header(), multi.Body.String())
+			}
+		})
+	}
+}
+
+// streamingStorage returns objects as plain streams that can't seek, like a decrypting reader
+type streamingStorage struct {
+	*MemoryStorage
+}
+
+func (s streamingStorage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	rc, info, err := s.MemoryStorage.Get(ctx, key)
+	if err != nil {
+		return nil, info, err
+	}
+	return struct{ io.ReadCloser }{rc}, info, nil
+}
+
+func TestServeStoredFileConditionalWithoutSeeking(t *testing.T) {
+	storage := streamingStorage{NewMemoryStorage()}
+	info, err := storage.Put(context.Background(), "video.txt", strings.NewReader("0123456789"), PutOptions{ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastModified := info.ModTime.UTC().Format(http.TimeFormat)
+	before := info.ModTime.Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name     string
+		method   string
+		headers  map[string]string
+		wantCode int
+		wantBody string
+	}{
+		{name: "get", method: "GET", wantCode: 200, wantBody: "0123456789"},
+		{name: "if-none-match", method: "GET", headers: map[string]string{"If-None-Match": `"other", ` + info.ETag}, wantCode: 304},
+		{name: "if-none-match stale", method: "GET", headers: map[string]string{"If-None-Match": `"stale"`}, wantCode: 200, wantBody: "0123456789"},
+		{name: "if-none-match on post", method: "POST", headers: map[string]string{"If-None-Match": "*"}, wantCode: 412},
+		{name: "if-modified-since", method: "GET", headers: map[string]string{"If-Modified-Since": lastModified}, wantCode: 304},
+		{name: "if-modified-since older", method: "GET", headers: map[string]string{"If-Modified-Since": before}, wantCode: 200, wantBody: "0123456789"},
+		{name: "if-match", method: "GET", headers: map[string]string{"If-Match": info.ETag}, wantCode: 200, wantBody: "0123456789"},
+		{name: "if-match failing", method: "GET", headers: map[string]string{"If-Match": `"stale"`}, wantCode: 412},
+		{name: "if-unmodified-since failing", method: "GET", headers: map[string]string{"If-Unmodified-Since": before}, wantCode: 412},
+		{name: "range sends everything", method: "GET", headers: map[string]string{"Range": "bytes=2-4"}, wantCode: 200, wantBody: "0123456789"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/download", nil)
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		if err := ServeStoredFile(rr, req, storage, "video.txt", DefaultDownloadOptions()); err != nil {
+			t.Fatalf("%s: ServeStoredFile() error = %v", tt.name, err)
+		}
+		if rr.Code != tt.wantCode || rr.Body.String() != tt.wantBody {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, rr.Code, rr.Body.String(), tt.wantCode, tt.wantBody)
+		}
+		if rr.Header().Get("Accept-Ranges") != "none" {
+			t.Errorf("%s: Accept-Ranges = %q, want none", tt.name, rr.Header().Get("Accept-Ranges"))
+		}
+	}
+}
+
+func TestServeZipDownload(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+	for key, content := range map[string]string{
+		"a/report.pdf": "first",
+		"b/report.pdf": "second",
+		"b/REPORT.pdf": "third",
+		"c/notes.txt":  "notes",
+	} {
+		storage.Put(ctx, key, strings.NewReader(content), PutOptions{})
+	}
+
+	entries := []ZipEntry{
+		{Key: "a/report.pdf"},
+		{Key: "b/report.pdf"},
+		{Key: "b/REPORT.pdf"},
+		{Key: "c/notes.txt", Name: "docs/notes.txt"},
+		{Key: "c/notes.txt", Name: "../../etc/notes.txt"},
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/download-all", nil)
+	if err := ServeZipDownload(rr, req, storage, entries, DownloadOptions{SuggestedFilename: "attachments.zip"}); err != nil {
+		t.Fatalf("ServeZipDownload() error = %v", err)
+	}
+
+	if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="attachments.zip"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "application/zip" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"report.pdf":     "first",
+		"report_1.pdf":   "second",
+		"REPORT_2.pdf":   "third",
+		"docs/notes.txt": "notes",
+		"notes.txt":      "notes",
+	}
+	if len(zr.File) != len(want) {
+		t.Fatalf("archive has %d entries, want %d", len(zr.File), len(want))
+	}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		if want[f.Name] != string(content) {
+			t.Errorf("entry %q = %q, want %q", f.Name, content, want[f.Name])
+		}
+	}
+
+	// Missing files are reported before anything is written
+	rr = httptest.NewRecorder()
+	err = ServeZipDownload(rr, req, storage, []ZipEntry{{Key: "a/report.pdf"}, {Key: "missing.pdf"}}, DownloadOptions{})
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("missing file err = %v", err)
+	}
+	if rr.Body.Len() != 0 || rr.Header().Get("Content-Type") != "" {
+		t.Errorf("response was written for a missing file")
+	}
+}
+
+func TestServeFilesAsZip(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "one"), 0o755)
+	os.MkdirAll(filepath.Join(dir, "two"), 0o755)
+	os.WriteFile(filepath.Join(dir, "one", "photo.jpg"), []byte("one"), 0o644)
+	os.WriteFile(filepath.Join(dir, "two", "photo.jpg"), []byte("two"), 0o644)
+
+	rr := httptest.NewRecorder()
+	err := ServeFilesAsZip(rr, httptest.NewRequest("GET", "/", nil), []string{
+		filepath.Join(dir, "one", "photo.jpg"),
+		filepath.Join(dir, "two", "photo.jpg"),
+	}, DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "photo.jpg" || zr.File[1].Name != "photo_1.jpg" {
+		t.Errorf("unexpected entries %v", zr.File)
+	}
+	if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="download.zip"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+}
+
+// cancelingWriter cancels the request once the response has started
+type cancelingWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestServeZipDownloadStopsOnDisconnect(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+
+	// Random content doesn't compress, so the zip writer flushes while copying
+	content := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(content)
+	var entries []ZipEntry
+	for _, key := range []string{"1.bin", "2.bin", "3.bin"} {
+		storage.Put(ctx, key, bytes.NewReader(content), PutOptions{})
+		entries = append(entries, ZipEntry{Key: key})
+	}
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(reqCtx)
+	w := &cancelingWriter{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+
+	err := ServeZipDownload(w, req, storage, entries, DownloadOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if w.Body.Len() >= 3*len(content) {
+		t.Errorf("kept writing %d bytes after the client went away", w.Body.Len())
+	}
+}
@@ -0,0 +1,182 @@
+package uploads
+
+import (
+	"errors"
+	"fmt"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrMIMEMismatch    = errors.New("file content does not match its extension")
+	ErrImageTooLarge   = errors.New("image dimensions are too large")
+	ErrInvalidFilename = errors.New("filename is not allowed")
+)
+
+// Peeker gives validators a look at the start of a file without consuming it.
+// Peek can return up to 64 KB; asking for more returns what's available.
+type Peeker interface {
+	Peek(n int) ([]byte, error)
+}
+
+// WholeContent is implemented by the Peeker handed to validators when the whole upload can
+// be read before it's saved, as with form files, tus uploads and SaveReader sources that
+// implement io.ReaderAt and io.Seeker. Content returns a reader over all of it and its size.
+type WholeContent interface {
+	Content() (io.ReaderAt, int64)
+}
+
+// Validator checks a file before it's saved. Validators run in order after the extension,
+// size and MIME checks, and the first one to return an error rejects the file.
+type Validator interface {
+	Name() string
+	Validate(file *multipart.FileHeader, content Peeker) error
+}
+
+// ValidationError reports which validator rejected a file
+type ValidationError struct {
+	Validator string
+	Filename  string
+	Err       error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s rejected %q: %v", e.Validator, e.Filename, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+type validatorFunc struct {
+	name string
+	fn   func(file *multipart.FileHeader, content Peeker) error
+}
+
+func (v validatorFunc) Name() string {
+	return v.name
+}
+
+func (v validatorFunc) Validate(file *multipart.FileHeader, content Peeker) error {
+	return v.fn(file, content)
+}
+
+// NewValidator turns a function into a named Validator
+func NewValidator(name string, fn func(file *multipart.FileHeader, content Peeker) error) Validator {
+	return validatorFunc{name: name, fn: fn}
+}
+
+// runValidators runs each validator in order and wraps the first failure in a ValidationError
+func runValidators(validators []Validator, file *multipart.FileHeader, content Peeker) error {
+	for _, v := range validators {
+		if err := v.Validate(file, content); err != nil {
+			return &ValidationError{Validator: v.Name(), Filename: file.Filename, Err: err}
+		}
+	}
+	return nil
+}
+
+// ExtensionMatchesMIME rejects files whose sniffed content type contradicts their extension,
+// such as an executable renamed to photo.jpg. Unknown extensions are let through.
+func ExtensionMatchesMIME() Validator {
+	return NewValidator("extension-mime", func(file *multipart.FileHeader, content Peeker) error {
+		extType := baseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(file.Filename))))
+		if extType == "" {
+			return nil
+		}
+
+		head, _ := content.Peek(512)
+		sniffed := baseMediaType(http.DetectContentType(head))
+
+		switch {
+		case sniffed == extType:
+			return nil
+		case strings.HasPrefix(sniffed, "text/") && strings.HasPrefix(extType, "text/"):
+			return nil
+		case sniffed == "application/zip" && (strings.Contains(extType, "openxmlformats") || strings.Contains(extType, "opendocument") || strings.Contains(extType, "zip")):
+			// Office documents, epubs and jars are zip archives underneath
+			return nil
+		case sniffed == "application/octet-stream" && !strings.HasPrefix(extType, "text/") &&
+			!strings.HasPrefix(extType, "image/") && extType != "application/pdf":
+			// DetectContentType doesn't know most binary formats
+			return nil
+		}
+
+		return fmt.Errorf("%w: %s content with .%s extension", ErrMIMEMismatch, sniffed, strings.TrimPrefix(filepath.Ext(file.Filename), "."))
+	})
+}
+
+// MaxImagePixels rejects images whose width × height exceeds maxPixels, reading only the
+// image header. Files that aren't JPEG, PNG or GIF images are let through. See ImageLimits
+// to bound the width and height as well.
+func MaxImagePixels(maxPixels int64) Validator {
+	return NewValidator("max-image-pixels", ImageLimits{MaxPixels: maxPixels}.Validate)
+}
+
+// FilenameRules validates the original filename. Control characters and path separators
+// are always rejected.
+type FilenameRules struct {
+	// MaxLength is the maximum length in bytes. Zero means no limit.
+	MaxLength int
+	// AllowHidden permits names starting with a dot
+	AllowHidden bool
+	// ASCIIOnly rejects names with non-ASCII characters
+	ASCIIOnly bool
+	// Reserved lists names (without extension, case-insensitive) that are rejected, e.g. "CON" or "index"
+	Reserved []string
+}
+
+func (FilenameRules) Name() string {
+	return "filename-rules"
+}
+
+func (r FilenameRules) Validate(file *multipart.FileHeader, content Peeker) error {
+	name := file.Filename
+
+	if name == "" || !utf8.ValidString(name) {
+		return fmt.Errorf("%w: empty or invalid UTF-8", ErrInvalidFilename)
+	}
+
+	if r.MaxLength > 0 && len(name) > r.MaxLength {
+		return fmt.Errorf("%w: longer than %d bytes", ErrInvalidFilename, r.MaxLength)
+	}
+
+	if !r.AllowHidden && strings.HasPrefix(name, ".") {
+		return fmt.Errorf("%w: hidden files are not allowed", ErrInvalidFilename)
+	}
+
+	for _, c := range name {
+		if unicode.IsControl(c) || c == '/' || c == '\\' {
+			return fmt.Errorf("%w: contains %q", ErrInvalidFilename, c)
+		}
+		if r.ASCIIOnly && c > unicode.MaxASCII {
+			return fmt.Errorf("%w: contains non-ASCII characters", ErrInvalidFilename)
+		}
+	}
+
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, reserved := range r.Reserved {
+		if strings.EqualFold(base, reserved) {
+			return fmt.Errorf("%w: %q is reserved", ErrInvalidFilename, base)
+		}
+	}
+
+	return nil
+}
+
+func baseMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
@@ -0,0 +1,126 @@
+package uploads
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"testing"
+)
+
+func testPNG(width, height int) []byte {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, image.NewGray(image.Rect(0, 0, width, height)))
+	return buf.Bytes()
+}
+
+func peekerFor(content []byte) Peeker {
+	return bufio.NewReaderSize(bytes.NewReader(content), peekSize)
+}
+
+func TestExtensionMatchesMIME(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  []byte
+		wantErr  bool
+	}{
+		{name: "png as png", filename: "a.png", content: testPNG(2, 2)},
+		{name: "png as jpg", filename: "a.jpg", content: testPNG(2, 2), wantErr: true},
+		{name: "text as csv", filename: "a.csv", content: []byte("a,b\n1,2\n")},
+		{name: "executable as pdf", filename: "a.pdf", content: []byte("MZ\x90\x00\x03\x00\x00\x00"), wantErr: true},
+		{name: "unknown extension", filename: "a.xyz123", content: []byte("MZ\x90\x00")},
+		{name: "zip as docx", filename: "a.docx", content: []byte("PK\x03\x04rest")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ExtensionMatchesMIME().Validate(&multipart.FileHeader{Filename: tt.filename}, peekerFor(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrMIMEMismatch) {
+				t.Errorf("Validate() error = %v, want ErrMIMEMismatch", err)
+			}
+		})
+	}
+}
+
+func TestMaxImagePixels(t *testing.T) {
+	v := MaxImagePixels(100 * 100)
+	fh := &multipart.FileHeader{Filename: "a.png"}
+
+	if err := v.Validate(fh, peekerFor(testPNG(100, 100))); err != nil {
+		t.Errorf("100x100 image: unexpected error %v", err)
+	}
+
+	if err := v.Validate(fh, peekerFor(testPNG(101, 100))); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("101x100 image: error = %v, want ErrImageTooLarge", err)
+	}
+
+	if err := v.Validate(fh, peekerFor([]byte("not an image"))); err != nil {
+		t.Errorf("non-image: unexpected error %v", err)
+	}
+}
+
+func TestFilenameRules(t *testing.T) {
+	rules := FilenameRules{MaxLength: 20, ASCIIOnly: true, Reserved: []string{"con"}}
+
+	tests := []struct {
+		filename string
+		wantErr  bool
+	}{
+		{filename: "report.pdf"},
+		{filename: "a-very-long-filename-indeed.pdf", wantErr: true},
+		{filename: ".env", wantErr: true},
+		{filename: "résumé.pdf", wantErr: true},
+		{filename: "bad\nname.txt", wantErr: true},
+		{filename: "CON.txt", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := rules.Validate(&multipart.FileHeader{Filename: tt.filename}, peekerFor(nil))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%q) error = %v, wantErr %v", tt.filename, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSaveUploadedFileValidators(t *testing.T) {
+	var ran []string
+	record := func(name string, fail bool) Validator {
+		return NewValidator(name, func(file *multipart.FileHeader, content Peeker) error {
+			ran = append(ran, name)
+			if head, _ := content.Peek(4); string(head) != "\x89PNG" {
+				t.Errorf("%s: expected to peek the file header, got %q", name, head)
+			}
+			if fail {
+				return errors.New("nope")
+			}
+			return nil
+		})
+	}
+
+	opts := &FileUploadOptions{
+		Storage:    NewMemoryStorage(),
+		MaxSize:    1 << 20,
+		Validators: []Validator{record("first", false), record("second", true), record("third", false)},
+	}
+
+	_, err := SaveUploadedFile(createTestFileHeader("photo.png", testPNG(10, 10)), opts)
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Validator != "second" {
+		t.Fatalf("error = %v, want ValidationError from second", err)
+	}
+
+	if len(ran) != 2 {
+		t.Errorf("validators ran = %v, want the chain to stop at the first failure", ran)
+	}
+
+	if StatusForError(err) != 422 {
+		t.Errorf("StatusForError() = %d, want 422", StatusForError(err))
+	}
+}